@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/log"
+	"github.com/urfave/cli/v2"
+	"sort"
+)
+
+func newClassifierTrainCommand(configPath *string, logLevel *string, logJSON *bool) *cli.Command {
+	var account string
+	var full bool
+
+	return &cli.Command{
+		Name:  "classifier-train",
+		Usage: "learn the messages of the classifier mailboxes of an account and store the model",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "account",
+				Aliases:     []string{"a"},
+				Usage:       "account name whose classifier is trained",
+				Required:    true,
+				Destination: &account,
+			},
+			&cli.BoolFlag{
+				Name:        "full",
+				Usage:       "learn all messages from scratch instead of only the ones added since the last training",
+				Destination: &full,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := log.InitWithConfig(*logLevel, *logJSON); err != nil {
+				return err
+			}
+
+			return runClassifierTrain(*configPath, account, full)
+		},
+	}
+}
+
+func runClassifierTrain(configPath string, account string, full bool) error {
+	cfg, err := config.NewConfigFromFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	acc, ok := cfg.Accounts[account]
+	if !ok {
+		return fmt.Errorf("account %v is not configured or not enabled", account)
+	}
+
+	if acc.Model == nil {
+		return fmt.Errorf("no classifier configuration found for account %v", account)
+	}
+
+	if err := acc.Connection.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to server %q with username %q", acc.Connection.Server, acc.Connection.Username)
+	}
+	defer acc.Connection.Disconnect()
+
+	learned, err := acc.Model.Train(&acc.Connection, full)
+	if err != nil {
+		return err
+	}
+
+	if err := acc.Model.Save(); err != nil {
+		return err
+	}
+
+	messages := acc.Model.Messages()
+	var mailboxes []string
+	for mailbox := range messages {
+		mailboxes = append(mailboxes, mailbox)
+	}
+	sort.Strings(mailboxes)
+
+	fmt.Printf("Learned %v new messages\n", learned)
+	for _, mailbox := range mailboxes {
+		fmt.Printf("%v: %v messages\n", mailbox, messages[mailbox])
+	}
+
+	return nil
+}
+
+// retrainClassifier learns the messages that were added to the classifier mailboxes of an account since the last training, if it's due.
+// Failures are only logged. The messages learned until the failure are kept and saved, the training is retried once the retrain interval passed again.
+func retrainClassifier(name string, acc *config.Account) {
+	if acc.Model == nil || acc.Classifier.Retrain <= 0 || !acc.Model.Due(acc.Classifier.Retrain) {
+		return
+	}
+
+	log.Infow("Retraining classifier", "account", name)
+	learned, trainErr := acc.Model.Train(&acc.Connection, false)
+	if trainErr != nil {
+		log.Errorw("Failed to retrain classifier, keeping the messages learned so far", trainErr, "account", name, "learned_messages", learned)
+	}
+
+	if err := acc.Model.Save(); err != nil {
+		log.Errorw("Failed to save classifier model", err, "account", name)
+		return
+	}
+
+	if trainErr == nil {
+		log.Infow("Retrained classifier", "account", name, "learned_messages", learned)
+	}
+}
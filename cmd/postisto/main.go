@@ -10,6 +10,7 @@ import (
 	goLog "log"
 	"os"
 	"time"
+	_ "time/tzdata" // embed the timezone database for timezone-aware rules, our container images don't ship it
 )
 
 var build string
@@ -73,6 +74,11 @@ func newApp() *cli.App {
 				Destination: &onetime,
 			},
 		},
+		Commands: []*cli.Command{
+			newSieveImportCommand(),
+			newSieveExportCommand(&configPath, &logLevel, &logJSON),
+			newClassifierTrainCommand(&configPath, &logLevel, &logJSON),
+		},
 		Action: func(c *cli.Context) error {
 			return runApp(configPath, logLevel, logJSON, pollInterval, onetime)
 		},
@@ -108,7 +114,7 @@ func runApp(configPath string, logLevel string, logJSON bool, pollInterval time.
 	type accInfo struct {
 		name    string
 		acc     *config.Account
-		filters map[string]filter.Filter
+		filters filter.FilterSet
 	}
 
 	var accs []*accInfo
@@ -124,6 +130,17 @@ func runApp(configPath string, logLevel string, logJSON bool, pollInterval time.
 			return fmt.Errorf("failed to initially connect to server %q with username %q", acc.Connection.Server, acc.Connection.Username)
 		}
 
+		if filters.DeletesDuplicates() {
+			uidPlus, err := acc.Connection.SupportsUIDPlus()
+			if err != nil {
+				return fmt.Errorf("failed to check the capabilities of server %q: %v", acc.Connection.Server, err)
+			}
+
+			if !uidPlus {
+				return fmt.Errorf("account %v deletes duplicates with dedupe: delete, but server %q doesn't support UIDPLUS. Use dedupe: flag or move instead", name, acc.Connection.Server)
+			}
+		}
+
 		accs = append(accs, &accInfo{name: name, acc: &acc, filters: filters})
 	}
 
@@ -134,7 +151,14 @@ func runApp(configPath string, logLevel string, logJSON bool, pollInterval time.
 	}
 
 	for {
+		// Address lists may be edited while we're running, so pick up their changes
+		if err := cfg.ReloadLists(); err != nil {
+			log.Errorw("Failed to reload address lists, keeping the previously loaded ones", err)
+		}
+
 		for _, accInfo := range accs {
+			retrainClassifier(accInfo.name, accInfo.acc)
+
 			if err := filter.EvaluateFilterSetsOnMsgs(&accInfo.acc.Connection, *accInfo.acc.InputMailbox, []string{server.SeenFlag, server.FlaggedFlag}, *accInfo.acc.FallbackMailbox, accInfo.filters); err != nil {
 				if server.IsDisconnected(err) {
 					// this can happen, so let's just reconnect
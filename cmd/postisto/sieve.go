@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/log"
+	"github.com/arnisoph/postisto/pkg/sieve"
+	"github.com/urfave/cli/v2"
+	"os"
+)
+
+func newSieveImportCommand() *cli.Command {
+	var account string
+	var output string
+
+	return &cli.Command{
+		Name:      "sieve-import",
+		Usage:     "translate a Sieve script into a filter config file",
+		ArgsUsage: "<script.sieve>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "account",
+				Aliases:     []string{"a"},
+				Usage:       "account name the filters are configured for",
+				Required:    true,
+				Destination: &account,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "file path to write the filter config to, defaults to stdout",
+				Destination: &output,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("expected exactly one Sieve script path")
+			}
+
+			return runSieveImport(c.Args().First(), account, output)
+		},
+	}
+}
+
+func runSieveImport(scriptPath string, account string, output string) error {
+	script, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := sieve.Import(string(script))
+	if err != nil {
+		return fmt.Errorf("failed to parse %v: %v", scriptPath, err)
+	}
+
+	for _, problem := range result.Problems {
+		fmt.Fprintf(os.Stderr, "%v:%v: skipped: %v\n", scriptPath, problem.Line, problem.Message)
+	}
+
+	b, err := result.YAML(account)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	return os.WriteFile(output, b, 0600)
+}
+
+func newSieveExportCommand(configPath *string, logLevel *string, logJSON *bool) *cli.Command {
+	var account string
+	var output string
+	var upload bool
+
+	return &cli.Command{
+		Name:  "sieve-export",
+		Usage: "translate the filters of an account into a Sieve script and optionally upload it via ManageSieve",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "account",
+				Aliases:     []string{"a"},
+				Usage:       "account name whose filters are translated",
+				Required:    true,
+				Destination: &account,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "file path to write the Sieve script to, defaults to stdout unless the script is uploaded",
+				Destination: &output,
+			},
+			&cli.BoolFlag{
+				Name:        "upload",
+				Usage:       "upload and activate the script using the managesieve config of the account",
+				Destination: &upload,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := log.InitWithConfig(*logLevel, *logJSON); err != nil {
+				return err
+			}
+
+			return runSieveExport(*configPath, account, output, upload)
+		},
+	}
+}
+
+func runSieveExport(configPath string, account string, output string, upload bool) error {
+	cfg, err := config.NewConfigFromFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	filters, ok := cfg.Filters[account]
+	if !ok {
+		return fmt.Errorf("no filter configuration found for account %v", account)
+	}
+
+	script, err := sieve.Generate(filters)
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		if err := os.WriteFile(output, []byte(script), 0600); err != nil {
+			return err
+		}
+	} else if !upload {
+		if _, err := os.Stdout.WriteString(script); err != nil {
+			return err
+		}
+	}
+
+	if !upload {
+		return nil
+	}
+
+	acc, ok := cfg.Accounts[account]
+	if !ok {
+		return fmt.Errorf("account %v is not configured or not enabled", account)
+	}
+
+	if acc.ManageSieve == nil {
+		return fmt.Errorf("no managesieve configuration found for account %v", account)
+	}
+
+	return acc.ManageSieve.Upload(script)
+}
@@ -0,0 +1,455 @@
+package classifier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// modelVersion is increased whenever the tokens change, models of other versions are trained from scratch
+	modelVersion = 1
+	// maxBodyTokens limits how many distinct tokens of a message body are learned
+	maxBodyTokens = 1000
+	// fetchBatchSize limits how many messages are fetched and kept in memory at once when training
+	fetchBatchSize = 500
+)
+
+// headers whose words are learned. Tokens are prefixed with the header name since "invoice" in the subject says more than in a signature.
+var learnedHeaders = []string{"from", "to", "cc", "reply-to", "sender", "subject", "list-id", "x-mailer"}
+
+var addressDomainPattern = regexp.MustCompile(`@([^\s<>@",;]+)`)
+
+// Model is a naive Bayes classifier whose classes are the mailboxes it's trained on. It learns the words of the headers, and optionally of the bodies,
+// of the messages that were sorted into the mailboxes and predicts the mailbox of new messages offline. It's stored as JSON file.
+type Model struct {
+	Mailboxes []string // trained mailboxes, they are the classes
+	Bodies    bool     // whether the text of the message bodies is learned as well
+
+	path      string
+	mu        sync.RWMutex
+	data      modelData
+	vocab     int // number of distinct tokens of all classes, -1 if it needs to be counted again
+	changed   bool
+	attempted time.Time // start of the last training, successful or not
+}
+
+type modelData struct {
+	Version   int                   `json:"version"`
+	Bodies    bool                  `json:"bodies"`
+	TrainedAt time.Time             `json:"trained_at"`
+	Classes   map[string]*classData `json:"classes"`
+}
+
+type classData struct {
+	UIDValidity uint32         `json:"uid_validity"` // UIDVALIDITY of the mailbox, the class is trained from scratch if it changes
+	LastUID     uint32         `json:"last_uid"`     // highest UID that was learned
+	Messages    int            `json:"messages"`
+	Tokens      int            `json:"tokens"`
+	Counts      map[string]int `json:"counts"`
+}
+
+// NewModel creates a classifier for the mailboxes. The model is kept in memory only if path is empty, otherwise it's loaded from the JSON file at path if it exists already.
+// Classes of mailboxes that aren't configured anymore are dropped.
+func NewModel(mailboxes []string, bodies bool, path string) (*Model, error) {
+	if len(mailboxes) < 2 {
+		return nil, fmt.Errorf("at least two mailboxes to learn from are required")
+	}
+
+	model := &Model{Mailboxes: mailboxes, Bodies: bodies, path: path, vocab: -1}
+	model.reset()
+
+	if path == "" {
+		return model, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return model, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var loaded modelData
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse classifier model %q: %v", path, err)
+	}
+
+	if loaded.Version != modelVersion || loaded.Bodies != bodies {
+		log.Infow("Warning: classifier model was trained with other settings and is trained from scratch", "model", path)
+		return model, nil
+	}
+
+	model.data.TrainedAt = loaded.TrainedAt
+	for _, mailbox := range mailboxes {
+		if class, ok := loaded.Classes[mailbox]; ok && class.Counts != nil {
+			model.data.Classes[mailbox] = class
+		}
+	}
+
+	return model, nil
+}
+
+func (model *Model) reset() {
+	model.data = modelData{Version: modelVersion, Bodies: model.Bodies, Classes: map[string]*classData{}}
+	for _, mailbox := range model.Mailboxes {
+		model.data.Classes[mailbox] = &classData{Counts: map[string]int{}}
+	}
+
+	model.vocab = -1
+	model.changed = true
+}
+
+// Train learns the messages of the mailboxes that were added since the last training, or all of them if full is set.
+// Mailboxes whose UIDVALIDITY changed are learned from scratch. It returns the number of learned messages.
+// Messages that were moved away from a mailbox stay learned until the model is trained in full. If the training fails, the messages
+// learned until then stay learned as well and the next training continues after them.
+func (model *Model) Train(conn *server.Connection, full bool) (int, error) {
+	model.mu.Lock()
+	model.attempted = time.Now()
+	if full {
+		model.reset()
+	}
+	model.mu.Unlock()
+
+	learned := 0
+	for _, mailbox := range model.Mailboxes {
+		n, err := model.trainMailbox(conn, mailbox)
+		learned += n
+		if err != nil {
+			return learned, fmt.Errorf("failed to learn mailbox %q: %v", mailbox, err)
+		}
+	}
+
+	model.mu.Lock()
+	model.data.TrainedAt = time.Now()
+	model.changed = true
+	model.mu.Unlock()
+
+	return learned, nil
+}
+
+func (model *Model) trainMailbox(conn *server.Connection, mailbox string) (int, error) {
+	status, err := conn.Select(mailbox, true, false)
+	if err != nil {
+		return 0, err
+	}
+
+	model.mu.Lock()
+	class := model.data.Classes[mailbox]
+	if class.UIDValidity != status.UidValidity {
+		if class.UIDValidity != 0 {
+			log.Infow("UIDVALIDITY of mailbox changed, learning it from scratch", "mailbox", mailbox)
+		}
+
+		class = &classData{UIDValidity: status.UidValidity, Counts: map[string]int{}}
+		model.data.Classes[mailbox] = class
+		model.vocab = -1
+	}
+	lastUID := class.LastUID
+	model.mu.Unlock()
+
+	// Messages are fetched and learned in batches so that mailboxes with years of mail don't need to fit into memory.
+	// The first training searches 1:*, later ones only the messages added since.
+	criteria := imapUtil.NewSearchCriteria()
+	criteria.Uid = new(imapUtil.SeqSet)
+	criteria.Uid.AddRange(lastUID+1, 0)
+
+	uids, err := conn.SearchCriteria(mailbox, criteria)
+	if err != nil {
+		return 0, err
+	}
+
+	// UID ranges like 42:* always contain the highest UID, even if it's lower than 42
+	var newUIDs []uint32
+	for _, uid := range uids {
+		if uid > lastUID {
+			newUIDs = append(newUIDs, uid)
+		}
+	}
+
+	learned := 0
+	for start := 0; start < len(newUIDs); start += fetchBatchSize {
+		end := start + fetchBatchSize
+		if end > len(newUIDs) {
+			end = len(newUIDs)
+		}
+
+		msgs, err := conn.Fetch(mailbox, newUIDs[start:end])
+		if err != nil {
+			return learned, err
+		}
+
+		for _, msg := range msgs {
+			if err := model.Learn(mailbox, msg); err != nil {
+				return learned, err
+			}
+
+			learned++
+		}
+	}
+
+	log.Debugw("Learned messages of mailbox", "mailbox", mailbox, "messages", learned)
+	return learned, nil
+}
+
+// Learn adds a message to the class of the mailbox
+func (model *Model) Learn(mailbox string, msg *server.Message) error {
+	tokens, err := model.tokens(msg)
+	if err != nil {
+		return err
+	}
+
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	class, ok := model.data.Classes[mailbox]
+	if !ok {
+		return fmt.Errorf("mailbox %q isn't one of the mailboxes the classifier learns from", mailbox)
+	}
+
+	class.Messages++
+	for _, token := range tokens {
+		class.Counts[token]++
+		class.Tokens++
+	}
+
+	if msg.RawMessage.Uid > class.LastUID {
+		class.LastUID = msg.RawMessage.Uid
+	}
+
+	model.vocab = -1
+	model.changed = true
+	return nil
+}
+
+// Classify returns the most probable mailbox of the message and its probability between 0 and 1.
+// The mailbox is empty if less than two mailboxes have been learned yet.
+func (model *Model) Classify(msg *server.Message) (string, float64, error) {
+	tokens, err := model.tokens(msg)
+	if err != nil {
+		return "", 0, err
+	}
+
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	total := 0
+	var classes []string
+	for mailbox, class := range model.data.Classes {
+		if class.Messages > 0 {
+			total += class.Messages
+			classes = append(classes, mailbox)
+		}
+	}
+
+	if len(classes) < 2 {
+		return "", 0, nil
+	}
+	sort.Strings(classes)
+
+	vocab := model.vocabulary()
+
+	// log P(class) + sum of log P(token|class) with Laplace smoothing. Tokens that were never seen say nothing about the class.
+	scores := make([]float64, len(classes))
+	for i, mailbox := range classes {
+		class := model.data.Classes[mailbox]
+		scores[i] = math.Log(float64(class.Messages) / float64(total))
+
+		for _, token := range tokens {
+			if !model.known(token) {
+				continue
+			}
+
+			scores[i] += math.Log(float64(class.Counts[token]+1) / float64(class.Tokens+vocab))
+		}
+	}
+
+	best := 0
+	for i := range scores {
+		if scores[i] > scores[best] {
+			best = i
+		}
+	}
+
+	// Normalize the scores to probabilities, relative to the best one to avoid underflows
+	sum := 0.0
+	for _, score := range scores {
+		sum += math.Exp(score - scores[best])
+	}
+
+	return classes[best], 1 / sum, nil
+}
+
+// Due reports whether the last training is longer ago than the interval. Failed trainings count as well, so that they aren't retried right away.
+func (model *Model) Due(interval time.Duration) bool {
+	model.mu.RLock()
+	defer model.mu.RUnlock()
+
+	return time.Since(model.data.TrainedAt) >= interval && time.Since(model.attempted) >= interval
+}
+
+// Messages returns the number of learned messages by mailbox
+func (model *Model) Messages() map[string]int {
+	model.mu.RLock()
+	defer model.mu.RUnlock()
+
+	messages := map[string]int{}
+	for mailbox, class := range model.data.Classes {
+		messages[mailbox] = class.Messages
+	}
+
+	return messages
+}
+
+// Save writes the model to its file if it changed
+func (model *Model) Save() error {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	if model.path == "" || !model.changed {
+		return nil
+	}
+
+	data, err := json.Marshal(model.data)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that the model doesn't get corrupted if we're interrupted
+	tmpFile, err := os.CreateTemp(filepath.Dir(model.path), filepath.Base(model.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), model.path); err != nil {
+		return err
+	}
+
+	model.changed = false
+	return nil
+}
+
+// vocabulary returns the number of distinct tokens of all classes. The caller holds the lock.
+func (model *Model) vocabulary() int {
+	if model.vocab >= 0 {
+		return model.vocab
+	}
+
+	tokens := map[string]bool{}
+	for _, class := range model.data.Classes {
+		for token := range class.Counts {
+			tokens[token] = true
+		}
+	}
+
+	model.vocab = len(tokens)
+	return model.vocab
+}
+
+// known reports whether any class has seen the token. The caller holds the lock.
+func (model *Model) known(token string) bool {
+	for _, class := range model.data.Classes {
+		if class.Counts[token] > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tokens returns the distinct tokens of a message: the words of the learned headers prefixed with the header name, the domains of addresses and the words of the body if enabled
+func (model *Model) tokens(msg *server.Message) ([]string, error) {
+	var tokens []string
+	seen := map[string]bool{}
+
+	add := func(token string) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	for _, name := range learnedHeaders {
+		for _, value := range headerValues(msg, name) {
+			for _, word := range words(value) {
+				add(name + ":" + word)
+			}
+
+			for _, domain := range addressDomainPattern.FindAllStringSubmatch(strings.ToLower(value), -1) {
+				add(name + ":@" + domain[1])
+			}
+		}
+	}
+
+	if !model.Bodies {
+		return tokens, nil
+	}
+
+	text, err := msg.Text()
+	if err != nil {
+		return nil, err
+	}
+
+	bodyTokens := 0
+	for _, word := range words(text) {
+		if bodyTokens >= maxBodyTokens {
+			break
+		}
+
+		if !seen["body:"+word] {
+			add("body:" + word)
+			bodyTokens++
+		}
+	}
+
+	return tokens, nil
+}
+
+// words splits a text into lower case words of letters and digits. Very short and very long words are mostly noise like IDs.
+func words(text string) []string {
+	var result []string
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) >= 2 && len(word) <= 30 {
+			result = append(result, word)
+		}
+	}
+
+	return result
+}
+
+func headerValues(msg *server.Message, name string) []string {
+	switch h := msg.Headers[name].(type) {
+	case string:
+		return []string{h}
+	case []string:
+		return h
+	}
+
+	return nil
+}
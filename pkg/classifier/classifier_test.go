@@ -0,0 +1,172 @@
+package classifier_test
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/classifier"
+	"github.com/arnisoph/postisto/pkg/server"
+	"github.com/arnisoph/postisto/test/integration"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newMsg(uid uint32, headers server.MessageHeaders) *server.Message {
+	return server.NewMessage(&imapUtil.Message{Uid: uid}, headers)
+}
+
+func TestModel(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	_, err := classifier.NewModel([]string{"Newsletters"}, false, "")
+	require.EqualError(err, "at least two mailboxes to learn from are required")
+
+	modelPath := filepath.Join(t.TempDir(), "model.json")
+	model, err := classifier.NewModel([]string{"Newsletters", "Work"}, false, modelPath)
+	require.NoError(err)
+	require.True(model.Due(time.Hour))
+
+	// Nothing is predicted before both mailboxes were learned
+	msg := newMsg(0, server.MessageHeaders{"from": "news@shop.example.com", "subject": "Our weekly deals"})
+	mailbox, probability, err := model.Classify(msg)
+	require.NoError(err)
+	require.Empty(mailbox)
+	require.Zero(probability)
+
+	trainingMsgs := []struct {
+		mailbox string
+		headers server.MessageHeaders
+	}{
+		{mailbox: "Newsletters", headers: server.MessageHeaders{"from": "news@shop.example.com", "subject": "Weekly deals on shoes", "list-id": "<deals.shop.example.com>"}},
+		{mailbox: "Newsletters", headers: server.MessageHeaders{"from": "Shop <news@shop.example.com>", "subject": "Deals of the week"}},
+		{mailbox: "Newsletters", headers: server.MessageHeaders{"from": "digest@blog.example.org", "subject": "Your weekly digest"}},
+		{mailbox: "Work", headers: server.MessageHeaders{"from": "jane@corp.example.net", "subject": "Budget review meeting", "to": "me@corp.example.net"}},
+		{mailbox: "Work", headers: server.MessageHeaders{"from": "john@corp.example.net", "subject": "Re: Budget review", "cc": []string{"jane@corp.example.net", "me@corp.example.net"}}},
+		{mailbox: "Work", headers: server.MessageHeaders{"from": "jane@corp.example.net", "subject": "Quarterly planning"}},
+	}
+
+	for i, training := range trainingMsgs {
+		require.NoError(model.Learn(training.mailbox, newMsg(uint32(i+1), training.headers)))
+	}
+	require.Equal(map[string]int{"Newsletters": 3, "Work": 3}, model.Messages())
+
+	require.EqualError(model.Learn("Spam", msg), `mailbox "Spam" isn't one of the mailboxes the classifier learns from`)
+
+	classifyTests := []struct {
+		headers server.MessageHeaders
+		mailbox string
+	}{
+		{headers: server.MessageHeaders{"from": "news@shop.example.com", "subject": "Weekly deals"}, mailbox: "Newsletters"},
+		{headers: server.MessageHeaders{"from": "jane@corp.example.net", "subject": "Budget for the planning meeting"}, mailbox: "Work"},
+		{headers: server.MessageHeaders{"from": "someone@else.example.com", "subject": "Budget review"}, mailbox: "Work"},
+	}
+
+	for i, test := range classifyTests {
+		mailbox, probability, err := model.Classify(newMsg(0, test.headers))
+		require.NoError(err)
+		require.Equal(test.mailbox, mailbox, "Test #%v", i+1)
+		require.Greater(probability, 0.5, "Test #%v", i+1)
+		require.LessOrEqual(probability, 1.0, "Test #%v", i+1)
+	}
+
+	// Bodies are fetched from the server
+	bodyModel, err := classifier.NewModel([]string{"Newsletters", "Work"}, true, "")
+	require.NoError(err)
+	require.EqualError(bodyModel.Learn("Work", msg), "message text can't be fetched without a server connection")
+
+	msg.SetText("Unsubscribe from our deals")
+	require.NoError(bodyModel.Learn("Newsletters", msg))
+
+	// The model is stored in a file
+	require.NoError(model.Save())
+
+	loaded, err := classifier.NewModel([]string{"Work", "Newsletters", "Private"}, false, modelPath)
+	require.NoError(err)
+	require.Equal(map[string]int{"Newsletters": 3, "Work": 3, "Private": 0}, loaded.Messages())
+
+	for i, test := range classifyTests {
+		mailbox, _, err := loaded.Classify(newMsg(0, test.headers))
+		require.NoError(err)
+		require.Equal(test.mailbox, mailbox, "Test #%v", i+1)
+	}
+
+	// Models trained with other settings are trained from scratch
+	loaded, err = classifier.NewModel([]string{"Work", "Newsletters"}, true, modelPath)
+	require.NoError(err)
+	require.Equal(map[string]int{"Newsletters": 0, "Work": 0}, loaded.Messages())
+
+	require.NoError(os.WriteFile(modelPath, []byte("{"), 0600))
+	_, err = classifier.NewModel([]string{"Work", "Newsletters"}, false, modelPath)
+	require.EqualError(err, `failed to parse classifier model "`+modelPath+`": unexpected end of JSON input`)
+}
+
+func TestTrain(t *testing.T) {
+	require := require.New(t)
+
+	testContainer := integration.NewTestContainer()
+	acc := integration.NewAccount(t, testContainer.IP, "", "test", testContainer.Imap, true, false, true, nil, testContainer.Redis)
+
+	require.NoError(acc.Connection.Connect())
+	defer func() {
+		require.Nil(acc.Connection.Disconnect())
+	}()
+
+	// Messages sorted by hand
+	for mailbox, mailNums := range map[string][]int{"Youth4work": {1, 2, 3}, "WebSummit": {6, 7, 10, 11}} {
+		for _, mailNum := range mailNums {
+			require.NoError(acc.Connection.Upload(fmt.Sprintf("../../test/data/mails/log%v.txt", mailNum), mailbox, nil))
+		}
+	}
+
+	model, err := classifier.NewModel([]string{"Youth4work", "WebSummit"}, true, filepath.Join(t.TempDir(), "model.json"))
+	require.NoError(err)
+
+	// ACTUAL TESTS BELOW
+
+	learned, err := model.Train(&acc.Connection, false)
+	require.NoError(err)
+	require.Equal(7, learned)
+	require.Equal(map[string]int{"Youth4work": 3, "WebSummit": 4}, model.Messages())
+	require.False(model.Due(time.Hour))
+
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log12.txt", "INBOX", nil))
+	msgs, err := acc.Connection.SearchAndFetch("INBOX", nil, nil)
+	require.NoError(err)
+	require.Len(msgs, 1)
+
+	mailbox, probability, err := model.Classify(msgs[0])
+	require.NoError(err)
+	require.Equal("WebSummit", mailbox)
+	require.Greater(probability, 0.9)
+
+	// Only new messages are learned incrementally
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log4.txt", "Youth4work", nil))
+	learned, err = model.Train(&acc.Connection, false)
+	require.NoError(err)
+	require.Equal(1, learned)
+	require.Equal(map[string]int{"Youth4work": 4, "WebSummit": 4}, model.Messages())
+
+	learned, err = model.Train(&acc.Connection, false)
+	require.NoError(err)
+	require.Zero(learned)
+
+	// Full training starts from scratch
+	learned, err = model.Train(&acc.Connection, true)
+	require.NoError(err)
+	require.Equal(8, learned)
+	require.Equal(map[string]int{"Youth4work": 4, "WebSummit": 4}, model.Messages())
+
+	// Missing mailboxes are reported
+	missing, err := classifier.NewModel([]string{"Youth4work", "does-not-exist"}, false, "")
+	require.NoError(err)
+	_, err = missing.Train(&acc.Connection, false)
+	require.Error(err)
+
+	// Failed trainings aren't retried right away
+	require.False(missing.Due(time.Hour))
+	require.True(missing.Due(0))
+}
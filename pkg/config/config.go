@@ -1,21 +1,32 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"github.com/arnisoph/postisto/pkg/classifier"
 	"github.com/arnisoph/postisto/pkg/filter"
 	"github.com/arnisoph/postisto/pkg/log"
 	"github.com/arnisoph/postisto/pkg/server"
+	"github.com/arnisoph/postisto/pkg/sieve"
 	"github.com/imdario/mergo"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	Accounts map[string]Account                  `yaml:"accounts"`
-	Filters  map[string]map[string]filter.Filter `yaml:"filters"`
+	Accounts      map[string]Account          `yaml:"accounts"`
+	Filters       map[string]filter.FilterSet `yaml:"filters"`
+	SharedFilters map[string]filter.FilterSet `yaml:"shared_filters"` // filter sets that accounts can include by name
+	Macros        filter.Macros               `yaml:"macros"`         // named rule fragments that rules refer to with {macro: name}
+	Lists         map[string]string           `yaml:"lists"`          // list name => path of a text or vCard file
+	Programs      map[string]*filter.Program  `yaml:"programs"`       // program name => executable that program conditions run
+
+	addressLists map[string]*AddressList
 }
 
 type Account struct {
@@ -23,6 +34,38 @@ type Account struct {
 	Connection      server.Connection `yaml:"connection"`
 	InputMailbox    *string           `yaml:"input"`
 	FallbackMailbox *string           `yaml:"fallback"`
+	ManageSieve     *sieve.Connection `yaml:"managesieve"`
+	AuthServIDs     []string          `yaml:"trusted_authserv_ids"` // authserv-ids of the own mail servers whose Authentication-Results headers are trusted
+	Threads         *Threads          `yaml:"threads"`
+	SharedFilters   []string          `yaml:"shared_filters"` // names of the shared filter sets to include, the account's own filters override them
+	Classifier      *Classifier       `yaml:"classifier"`
+	Model           *classifier.Model `yaml:"-"` // loaded from the model file of the classifier config, nil if no classifier is configured
+	Duplicates      *Duplicates       `yaml:"duplicates"`
+}
+
+// Threads configures where replies look for the messages they refer to, see thread conditions and the move_to_thread command.
+type Threads struct {
+	Mailboxes []string `yaml:"mailboxes"` // searched mailboxes, * matches any characters like in Projects/*
+	Cache     string   `yaml:"cache"`     // path of the file that caches the mailboxes of Message-IDs, kept in memory only if empty
+}
+
+// Classifier configures the mailboxes that classifier conditions learn from
+type Classifier struct {
+	Mailboxes []string      `yaml:"mailboxes"` // mailboxes whose messages are learned, they are what the classifier predicts
+	Model     string        `yaml:"model"`     // path of the file that stores the model, kept in memory only if empty
+	Bodies    bool          `yaml:"bodies"`    // learn the text of the message bodies as well, which requires fetching them
+	Retrain   time.Duration `yaml:"retrain"`   // interval to learn the messages that were added to the mailboxes since, e.g. 24h. Disabled if 0.
+}
+
+// Duplicates configures how duplicate conditions and the dedupe command find earlier copies of a message
+type Duplicates struct {
+	Key       string        `yaml:"key"`       // "message-id" (default) or "hash" to compare a hash of the headers and optionally the body text
+	Headers   []string      `yaml:"headers"`   // headers that are hashed with key hash, default from, to, cc, subject and date
+	Body      bool          `yaml:"body"`      // hash the body text as well with key hash, which requires fetching it
+	Mailboxes []string      `yaml:"mailboxes"` // mailboxes searched besides the input mailbox, * matches any characters like in Lists/*
+	Window    time.Duration `yaml:"window"`    // copies that arrived further apart aren't duplicates, default 168h
+	Store     string        `yaml:"store"`     // path of the file that stores the keys of the messages per mailbox, kept in memory only if empty
+	Target    string        `yaml:"target"`    // mailbox that dedupe: move moves the extra copies to, default Duplicates
 }
 
 func NewConfig() *Config {
@@ -44,6 +87,9 @@ func NewConfigFromFile(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	// Problems with the types of values are collected so that all of them can be fixed at once
+	var problems []string
+
 	for _, file := range configFiles {
 		log.Debugw("Parsing config YAML file", "file", file)
 
@@ -58,12 +104,61 @@ func NewConfigFromFile(configPath string) (*Config, error) {
 		// YAML to Config struct
 		err = yaml.Unmarshal(yamlFile, &fileCfg)
 
-		if err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			log.Errorw("Failed to parse YAML file", err, "file", file)
+			problems = append(problems, filePositions(file, typeErr.Errors)...)
+			continue
+		} else if err != nil {
 			log.Errorw("Failed to parse YAML file", err, "file", file)
 			return nil, err
 		}
 		log.Debugw("Successfully parsed YAML file", "file", file, "parsedFile", string(yamlFile))
 
+		// Problems with filters are reported with the file they are defined in
+		for _, filterSets := range []map[string]filter.FilterSet{fileCfg.Filters, fileCfg.SharedFilters} {
+			for _, filters := range filterSets {
+				for filterName, filterConfig := range filters {
+					filterConfig.Position.File = file
+					filters[filterName] = filterConfig
+				}
+			}
+		}
+
+		// List paths are relative to the file they are configured in
+		for listName, listPath := range fileCfg.Lists {
+			if listPath != "" && !filepath.IsAbs(listPath) {
+				fileCfg.Lists[listName] = filepath.Join(filepath.Dir(file), listPath)
+			}
+		}
+
+		// Program paths like ./check.sh are relative to the file they are configured in, bare names are looked up in PATH
+		for _, program := range fileCfg.Programs {
+			if program != nil && len(program.Command) > 0 && strings.ContainsRune(program.Command[0], os.PathSeparator) && !filepath.IsAbs(program.Command[0]) {
+				program.Command[0] = filepath.Join(filepath.Dir(file), program.Command[0])
+			}
+		}
+
+		// Filters of the same name override each other, which changes the filter order unnoticed
+		for accName, filters := range fileCfg.Filters {
+			for filterName := range filters {
+				if _, ok := cfg.Filters[accName][filterName]; ok {
+					log.Infow("Warning: filter is defined in several files, the last definition wins", "account", accName, "filter", filterName, "file", file)
+				}
+			}
+		}
+
+		for name := range fileCfg.SharedFilters {
+			if _, ok := cfg.SharedFilters[name]; ok {
+				log.Infow("Warning: shared filters are defined in several files, the last definition wins", "shared_filters", name, "file", file)
+			}
+		}
+
+		for name := range fileCfg.Macros {
+			if _, ok := cfg.Macros[name]; ok {
+				log.Infow("Warning: macro is defined in several files, the last definition wins", "macro", name, "file", file)
+			}
+		}
+
 		// Merge configs from files
 		if err := mergo.Merge(cfg, fileCfg, mergo.WithOverride, mergo.WithTypeCheck); err != nil {
 			log.Errorw("Failed to merge YAML file", err, "file", file)
@@ -71,6 +166,10 @@ func NewConfigFromFile(configPath string) (*Config, error) {
 		}
 	}
 
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%v", strings.Join(problems, "\n"))
+	}
+
 	log.Debugw("Successfully parsed all YAML files, checking for validity now", "cfg", cfg)
 	newCfg, err := cfg.validate(passwords)
 	if err != nil {
@@ -83,8 +182,13 @@ func NewConfigFromFile(configPath string) (*Config, error) {
 
 func (cfg Config) validate(passwords map[string]string) (*Config, error) {
 	valCfg := Config{
-		Accounts: map[string]Account{},
-		Filters:  map[string]map[string]filter.Filter{},
+		Accounts:      map[string]Account{},
+		Filters:       map[string]filter.FilterSet{},
+		SharedFilters: cfg.SharedFilters,
+		Macros:        cfg.Macros,
+		Lists:         map[string]string{},
+		Programs:      map[string]*filter.Program{},
+		addressLists:  map[string]*AddressList{},
 	}
 
 	// Accounts
@@ -92,7 +196,42 @@ func (cfg Config) validate(passwords map[string]string) (*Config, error) {
 		log.Info("Warning: no accounts configured")
 	}
 
+	threads := map[string]*server.ThreadIndex{}
+	models := map[string]*classifier.Model{}
+	duplicates := map[string]*server.DuplicateIndex{}
 	for accName, acc := range cfg.Accounts {
+		// Filters of disabled accounts are validated as well
+		if acc.Threads != nil {
+			index, err := server.NewThreadIndex(acc.Threads.Mailboxes, acc.Threads.Cache)
+			if err != nil {
+				return nil, fmt.Errorf("invalid threads config of account %q: %v", accName, err)
+			}
+
+			threads[accName] = index
+		}
+
+		if acc.Classifier != nil {
+			if acc.Classifier.Retrain < 0 {
+				return nil, fmt.Errorf("invalid classifier config of account %q: retrain interval must not be negative", accName)
+			}
+
+			model, err := classifier.NewModel(acc.Classifier.Mailboxes, acc.Classifier.Bodies, acc.Classifier.Model)
+			if err != nil {
+				return nil, fmt.Errorf("invalid classifier config of account %q: %v", accName, err)
+			}
+
+			models[accName] = model
+		}
+
+		if acc.Duplicates != nil {
+			index, err := newDuplicateIndex(*acc.Duplicates)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duplicates config of account %q: %v", accName, err)
+			}
+
+			duplicates[accName] = index
+		}
+
 		if !acc.Enable {
 			continue
 		}
@@ -101,6 +240,8 @@ func (cfg Config) validate(passwords map[string]string) (*Config, error) {
 			Connection:      acc.Connection,
 			InputMailbox:    acc.InputMailbox,
 			FallbackMailbox: acc.FallbackMailbox,
+			AuthServIDs:     acc.AuthServIDs,
+			SharedFilters:   acc.SharedFilters,
 		}
 		// Connection
 		if strings.TrimSpace(acc.Connection.Server) == "" {
@@ -123,19 +264,340 @@ func (cfg Config) validate(passwords map[string]string) (*Config, error) {
 			*newAcc.FallbackMailbox = "INBOX"
 		}
 
+		// ManageSieve uses the server, credentials and TLS settings of the IMAP connection unless they are set explicitly
+		if acc.ManageSieve != nil {
+			manageSieve := *acc.ManageSieve
+			if manageSieve.Server == "" {
+				manageSieve.Server = newAcc.Connection.Server
+			}
+
+			if manageSieve.Username == "" {
+				manageSieve.Username = newAcc.Connection.Username
+				manageSieve.Password = newAcc.Connection.Password
+			}
+
+			if manageSieve.TLSVerify == nil {
+				manageSieve.TLSVerify = newAcc.Connection.TLSVerify
+			}
+
+			if manageSieve.TLSCACertFile == "" {
+				manageSieve.TLSCACertFile = newAcc.Connection.TLSCACertFile
+			}
+
+			newAcc.ManageSieve = &manageSieve
+		}
+
+		if acc.Threads != nil {
+			newAcc.Threads = acc.Threads
+			newAcc.Connection.Threads = threads[accName]
+		}
+
+		if acc.Classifier != nil {
+			newAcc.Classifier = acc.Classifier
+			newAcc.Model = models[accName]
+		}
+
+		if acc.Duplicates != nil {
+			newAcc.Duplicates = acc.Duplicates
+			newAcc.Connection.Duplicates = duplicates[accName]
+		}
+
 		valCfg.Accounts[accName] = newAcc
 	}
 
+	// Lists
+	lists := filter.AddressLists{}
+	for listName, listPath := range cfg.Lists {
+		if strings.TrimSpace(listPath) == "" {
+			return nil, fmt.Errorf("path of list %q not configured", listName)
+		}
+
+		list, err := LoadAddressList(listPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load list %q: %v", listName, err)
+		}
+
+		valCfg.Lists[listName] = listPath
+		valCfg.addressLists[listName] = list
+		lists[listName] = list
+	}
+
+	// Programs
+	for programName, program := range cfg.Programs {
+		if program == nil {
+			return nil, fmt.Errorf("invalid program %q: command not configured", programName)
+		}
+
+		if err := program.Init(); err != nil {
+			return nil, fmt.Errorf("invalid program %q: %v", programName, err)
+		}
+
+		valCfg.Programs[programName] = program
+	}
+
 	// Filters
-	valCfg.Filters = cfg.Filters
+	accountFilters, origins, err := cfg.accountFilters()
+	if err != nil {
+		return nil, err
+	}
 
-	if len(valCfg.Filters) == 0 {
+	if len(accountFilters) == 0 {
 		log.Info("Warning: no filters configured")
 	}
 
+	var problems filterProblems
+	for accName, filters := range accountFilters {
+		valCfg.Filters[accName] = filter.FilterSet{}
+
+		for filterName, filterConfig := range filters {
+			// Filters of shared filter sets name their origin since the account doesn't define them itself
+			name := fmt.Sprintf("%q", filterName)
+			if origin, ok := origins[accName][filterName]; ok {
+				name = fmt.Sprintf("%q (shared filters %q)", filterName, origin)
+			}
+
+			// Macros are expanded once so that the sieve export and traces see the actual conditions
+			expanded, err := cfg.Macros.Expand(filterConfig.RuleSet)
+			if err != nil {
+				problems.add(filterConfig.Position, err, "invalid rules in filter %v of account %q: %v", name, accName, err)
+				continue
+			}
+
+			usesMacros := cfg.Macros.UsedBy(filterConfig.RuleSet)
+			if usesMacros {
+				filterConfig.RuleSet = expanded
+			}
+
+			// Compile rule sets once so that they don't need to be parsed again for every message
+			opts := filter.CompileOptions{Lists: lists, AuthServIDs: cfg.Accounts[accName].AuthServIDs, Threads: threads[accName], Classifier: models[accName], Programs: valCfg.Programs, Account: accName, Duplicates: duplicates[accName]}
+			if err := filterConfig.CompileWithOptions(opts); err != nil {
+				if usesMacros {
+					problems.add(filterConfig.Position, err, "invalid rules in filter %v of account %q: %v\nrules after expanding macros:\n%v", name, accName, err, formatRuleSet(expanded))
+					continue
+				}
+
+				problems.add(filterConfig.Position, err, "invalid rules in filter %v of account %q: %v", name, accName, err)
+				continue
+			}
+
+			if filterConfig.Commands.MoveToThread && threads[accName] == nil {
+				problems.add(filterConfig.Position, nil, "invalid commands in filter %v of account %q: move_to_thread requires threads to be configured for the account", name, accName)
+				continue
+			}
+
+			if filterConfig.Commands.Dedupe != "" && duplicates[accName] == nil {
+				problems.add(filterConfig.Position, nil, "invalid commands in filter %v of account %q: dedupe requires duplicates to be configured for the account", name, accName)
+				continue
+			}
+
+			valCfg.Filters[accName][filterName] = filterConfig
+		}
+
+		for _, names := range valCfg.Filters[accName].AmbiguousNames() {
+			log.Infow("Warning: filters share the same priority and are ordered by their names. Set distinct priorities to make the order explicit.", "account", accName, "filters", names)
+		}
+	}
+
+	if len(problems) > 0 {
+		problems.sort()
+		return nil, problems
+	}
+
 	return &valCfg, nil
 }
 
+// newDuplicateIndex creates the duplicate index of an account with the defaults for everything the config doesn't set
+func newDuplicateIndex(cfg Duplicates) (*server.DuplicateIndex, error) {
+	switch cfg.Key {
+	case "", "message-id":
+		if len(cfg.Headers) > 0 || cfg.Body {
+			return nil, fmt.Errorf("headers and body are only hashed with key hash")
+		}
+	case "hash":
+		if len(cfg.Headers) == 0 {
+			cfg.Headers = server.DefaultDuplicateHeaders
+		}
+	default:
+		return nil, fmt.Errorf("key %q is unsupported, expected message-id or hash", cfg.Key)
+	}
+
+	index, err := server.NewDuplicateIndex(cfg.Mailboxes, cfg.Headers, cfg.Body, cfg.Window, cfg.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	index.Target = cfg.Target
+	if index.Target == "" {
+		index.Target = "Duplicates"
+	}
+
+	return index, nil
+}
+
+// filterProblems collects the problems of all filters so that they can be reported at once, ordered by file and line
+type filterProblems []filterProblem
+
+type filterProblem struct {
+	pos filter.Position
+	msg string
+}
+
+// add records a problem at the position of the filter, or at the position of the rule if err is a *filter.RuleError
+func (problems *filterProblems) add(pos filter.Position, err error, format string, args ...interface{}) {
+	var ruleErr *filter.RuleError
+	if errors.As(err, &ruleErr) {
+		pos = pos.RuleLine(ruleErr.Rule)
+	}
+
+	*problems = append(*problems, filterProblem{pos: pos, msg: fmt.Sprintf(format, args...)})
+}
+
+// sort orders the problems by file and line
+func (problems filterProblems) sort() {
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].pos.File != problems[j].pos.File {
+			return problems[i].pos.File < problems[j].pos.File
+		}
+
+		if problems[i].pos.Line != problems[j].pos.Line {
+			return problems[i].pos.Line < problems[j].pos.Line
+		}
+
+		return problems[i].msg < problems[j].msg
+	})
+}
+
+func (problems filterProblems) Error() string {
+	var msgs []string
+	for _, problem := range problems {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", problem.pos, problem.msg))
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// filePositions turns the "line N: problem" errors of the YAML decoder into "file:N: problem"
+func filePositions(file string, errs []string) []string {
+	var problems []string
+
+	for _, err := range errs {
+		var line int
+		if _, scanErr := fmt.Sscanf(err, "line %d:", &line); scanErr == nil {
+			_, problem, _ := strings.Cut(err, ": ")
+			err = fmt.Sprintf("%v:%v: %v", file, line, problem)
+		} else {
+			err = fmt.Sprintf("%v: %v", file, err)
+		}
+
+		problems = append(problems, err)
+	}
+
+	return problems
+}
+
+// accountFilters combines the shared filter sets that each account includes with its own filters. An own filter with the name of a shared one overrides it:
+// the commands, rules and priority that it sets replace those of the shared filter, the others are inherited. The origins map included filters to their shared filter set.
+func (cfg Config) accountFilters() (map[string]filter.FilterSet, map[string]map[string]string, error) {
+	filters := map[string]filter.FilterSet{}
+	origins := map[string]map[string]string{}
+	included := map[string]bool{}
+
+	for accName, acc := range cfg.Accounts {
+		for _, setName := range acc.SharedFilters {
+			sharedFilters, ok := cfg.SharedFilters[setName]
+			if !ok {
+				return nil, nil, fmt.Errorf("account %q includes shared filters %q which aren't defined", accName, setName)
+			}
+
+			included[setName] = true
+			if filters[accName] == nil {
+				filters[accName] = filter.FilterSet{}
+				origins[accName] = map[string]string{}
+			}
+
+			for filterName, sharedFilter := range sharedFilters {
+				if origin, ok := origins[accName][filterName]; ok {
+					log.Infow("Warning: filter is defined in several shared filter sets of the account, the last one wins", "account", accName, "filter", filterName, "shared_filters", []string{origin, setName})
+				}
+
+				filters[accName][filterName] = sharedFilter
+				origins[accName][filterName] = setName
+			}
+		}
+	}
+
+	for setName := range cfg.SharedFilters {
+		if !included[setName] {
+			log.Infow("Warning: shared filters aren't included by any account", "shared_filters", setName)
+		}
+	}
+
+	for accName, ownFilters := range cfg.Filters {
+		if filters[accName] == nil {
+			filters[accName] = filter.FilterSet{}
+		}
+
+		for filterName, ownFilter := range ownFilters {
+			sharedFilter, ok := filters[accName][filterName]
+			if !ok {
+				filters[accName][filterName] = ownFilter
+				continue
+			}
+
+			if ownFilter.Commands.IsEmpty() {
+				ownFilter.Commands = sharedFilter.Commands
+			}
+
+			if ownFilter.RuleSet == nil {
+				ownFilter.RuleSet = sharedFilter.RuleSet
+				// problems with the inherited rules are reported at the overriding filter
+				ownFilter.Position.RuleLines = nil
+			}
+
+			if ownFilter.Priority == nil {
+				ownFilter.Priority = sharedFilter.Priority
+			}
+
+			filters[accName][filterName] = ownFilter
+			delete(origins[accName], filterName)
+		}
+	}
+
+	return filters, origins, nil
+}
+
+// formatRuleSet formats a rule set as YAML for error messages
+func formatRuleSet(ruleSet filter.RuleSet) string {
+	out, err := yaml.Marshal(ruleSet)
+	if err != nil {
+		return fmt.Sprint(ruleSet)
+	}
+
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+// ReloadLists reloads all address lists whose files changed since they were loaded. Lists that fail to reload keep their previous entries.
+func (cfg *Config) ReloadLists() error {
+	for listName, list := range cfg.addressLists {
+		reloaded, err := list.Reload()
+		if err != nil {
+			return fmt.Errorf("failed to reload list %q: %v", listName, err)
+		}
+
+		if reloaded {
+			log.Infow("Reloaded changed address list", "list", listName, "path", cfg.Lists[listName], "entries", list.Len())
+		}
+	}
+
+	return nil
+}
+
+// AddressList returns the loaded address list with the given name.
+func (cfg *Config) AddressList(name string) (*AddressList, bool) {
+	list, ok := cfg.addressLists[name]
+	return list, ok
+}
+
 func walkConfigPath(configPath string) ([]string, map[string]string, error) {
 
 	var configFiles []string
@@ -1,11 +1,19 @@
 package config_test
 
 import (
+	"fmt"
 	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	"github.com/arnisoph/postisto/pkg/sieve"
+	"github.com/emersion/go-imap"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewConfigFromFile(t *testing.T) {
@@ -23,6 +31,10 @@ func TestNewConfigFromFile(t *testing.T) {
 	require.NoError(err)
 	require.Equal("imap.server.de", cfg.Accounts["test"].Connection.Server)
 
+	// ManageSieve defaults to the IMAP connection
+	require.Equal(&sieve.Connection{Server: "imap.server.de", Username: "imap@account.de", Password: "secure_pwd", ScriptName: "sorting"}, cfg.Accounts["test"].ManageSieve)
+	require.Nil(cfg.Accounts["readenv1"].ManageSieve)
+
 	// NewConfigFromFile full config dir
 	require.DirExists("../../test/data/configs/valid/")
 	cfg, err = config.NewConfigFromFile("../../test/data/configs/valid/")
@@ -67,7 +79,181 @@ func TestNewConfigFromFile(t *testing.T) {
 	require.NoError(os.Chmod("../../test/data/configs/invalid-unreadable-dir/dir/foo.yaml", 0644))
 	require.EqualError(err, "open ../../test/data/configs/invalid-unreadable-dir/dir/foo.yaml: permission denied")
 
+	// Fail to compile rule sets
+	_, err = config.NewConfigFromFile("../../test/data/configs/invalid/TestParserRuleSet/comparison_with_bad_regex_(and).yaml")
+	require.EqualError(err, "../../test/data/configs/invalid/TestParserRuleSet/comparison_with_bad_regex_(and).yaml:6: invalid rules in filter \"comparison with bad regex (and)\" of account \"test\": rule #1: header \"to\": pattern \"!^\\\\ü^@example.com\": error parsing regexp: invalid escape sequence: `\\ü`")
+
 	// Empty Configs
 	_, err = config.NewConfigFromFile("../../test/data/configs/invalid-empty-configs.yml")
 	require.NoError(err)
 }
+
+func TestAddressLists(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	// Lists are loaded relative to the config file
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestListConditions.yaml")
+	require.NoError(err)
+	require.Equal(filepath.Join("../../test/data/configs/valid/test", "lists/vip.txt"), cfg.Lists["vip"])
+
+	vip, ok := cfg.AddressList("vip")
+	require.True(ok)
+	require.Equal(4, vip.Len())
+	require.True(vip.Contains("jane.doe@example.org"))
+	require.True(vip.Contains("x@sub.important.example"))
+	require.False(vip.Contains("important.example"))
+
+	vendors, ok := cfg.AddressList("vendors")
+	require.True(ok)
+	require.Equal(3, vendors.Len())
+	require.True(vendors.Contains("sales@another-vendor.example"))
+
+	// Lists are reloaded once they change
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "allow.txt")
+	require.NoError(ioutil.WriteFile(listPath, []byte("a@example.com\n"), 0600))
+
+	list, err := config.LoadAddressList(listPath)
+	require.NoError(err)
+	require.True(list.Contains("a@example.com"))
+
+	reloaded, err := list.Reload()
+	require.NoError(err)
+	require.False(reloaded)
+
+	require.NoError(ioutil.WriteFile(listPath, []byte("b@example.com\nexample.net\n"), 0600))
+	require.NoError(os.Chtimes(listPath, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	reloaded, err = list.Reload()
+	require.NoError(err)
+	require.True(reloaded)
+	require.False(list.Contains("a@example.com"))
+	require.True(list.Contains("b@example.com"))
+	require.True(list.Contains("c@example.net"))
+
+	// Broken lists keep their previous entries
+	require.NoError(os.Remove(listPath))
+	_, err = list.Reload()
+	require.Error(err)
+	require.True(list.Contains("b@example.com"))
+
+	// Invalid lists
+	badListPath := filepath.Join(dir, "bad.txt")
+	require.NoError(ioutil.WriteFile(badListPath, []byte("a@example.com\nJane Doe <jane@example.com>\n"), 0600))
+	_, err = config.LoadAddressList(badListPath)
+	require.EqualError(err, badListPath+`:2: "Jane Doe <jane@example.com>" is neither an address nor a domain`)
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	require.NoError(ioutil.WriteFile(cfgPath, []byte("lists:\n  vip: does-not-exist.txt\n"), 0600))
+	_, err = config.NewConfigFromFile(cfgPath)
+	require.EqualError(err, `failed to load list "vip": stat `+filepath.Join(dir, "does-not-exist.txt")+`: no such file or directory`)
+
+	require.NoError(ioutil.WriteFile(cfgPath, []byte("filters:\n  test:\n    vip:\n      rules:\n      - and:\n        - from: {in_list: vip}\n"), 0600))
+	_, err = config.NewConfigFromFile(cfgPath)
+	require.EqualError(err, cfgPath+`:5: invalid rules in filter "vip" of account "test": rule #1: header "from": list "vip" is not configured`)
+}
+
+func TestSharedFilters(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestSharedFilters.yaml")
+	require.NoError(err)
+
+	// Accounts include the shared filter sets
+	require.Equal([]string{"newsletters", "shops"}, cfg.Filters["private"].Names())
+	require.Equal([]string{"boss", "invitations", "newsletters", "shops"}, cfg.Filters["work"].Names())
+
+	// Own filters override shared ones and inherit what they don't set
+	require.Equal(filter.Commands{Move: "Newsletters"}, cfg.Filters["private"]["newsletters"].Commands)
+	require.Equal(filter.Commands{Move: "Work/Newsletters"}, cfg.Filters["work"]["newsletters"].Commands)
+	require.Equal(cfg.Filters["private"]["newsletters"].RuleSet, cfg.Filters["work"]["newsletters"].RuleSet)
+	require.Equal(0, *cfg.Filters["work"]["newsletters"].Priority)
+
+	// Macros are expanded
+	require.Equal(filter.RuleSet{{"and": []map[string]interface{}{
+		{"or": []map[string]interface{}{{"exists": "list-unsubscribe"}, {"from:localpart": map[string]interface{}{"prefix": "newsletter"}}}},
+		{"not": []map[string]interface{}{{"from:domain": "example.org"}}},
+	}}}, cfg.Filters["private"]["newsletters"].RuleSet)
+
+	msg := server.NewMessage(&imap.Message{}, server.MessageHeaders{"list-unsubscribe": "<mailto:unsubscribe@example.com>", "from": "news@example.com"})
+	matched, err := cfg.Filters["private"]["newsletters"].Match(msg)
+	require.NoError(err)
+	require.True(matched)
+
+	// Validation errors show the origin of filters and the expanded rules
+	invalidTests := []struct {
+		file string
+		line int // errors of filters start with the file and line
+		err  string
+	}{
+		{
+			file: "bad_macro_condition.yaml",
+			line: 21,
+			err: `invalid rules in filter "large newsletters" (shared filters "common") of account "test": rule #1: condition "size": invalid value for comparison "gt": "huge" is not a valid size
+rules after expanding macros:
+- and:
+    - exists: list-id
+    - and:
+        - size:
+            gt: huge`,
+		},
+		{
+			file: "macro_cycle.yaml",
+			line: 22,
+			err:  `invalid rules in filter "cycle" of account "test": rule #1: macro "a": macro "a" refers to itself: a -> b -> a`,
+		},
+		{
+			file: "undefined_shared_filters.yaml",
+			err:  `account "test" includes shared filters "common" which aren't defined`,
+		},
+	}
+
+	for _, test := range invalidTests {
+		path := filepath.Join("../../test/data/configs/invalid/TestSharedFilters", test.file)
+		if test.line > 0 {
+			test.err = fmt.Sprintf("%v:%v: %v", path, test.line, test.err)
+		}
+
+		_, err := config.NewConfigFromFile(path)
+		require.EqualError(err, test.err, test.file)
+	}
+}
+
+func TestFilterSchema(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	// Unknown keys and values of the wrong type are reported for all files at once
+	dir := "../../test/data/configs/invalid/TestFilterSchema/types"
+	_, err := config.NewConfigFromFile(dir)
+	require.EqualError(err, strings.Join([]string{
+		dir + `/filters.yaml:6: filter "typo": unknown command "add_flag", expected one of move, move_to_thread, add_flags, remove_flags, replace_all_flags, dedupe`,
+		dir + `/filters.yaml:13: filter "number": command "move" requires a mailbox name, quote 2024 like '2024'`,
+		dir + `/filters.yaml:18: filter "wrong-types": continue has to be true or false, not "sometimes"`,
+		dir + `/filters.yaml:19: filter "wrong-types": priority has to be an integer, not "first"`,
+		dir + `/filters.yaml:21: filter "wrong-types": command "move_to_thread" has to be true or false, not "yes please"`,
+		dir + `/filters.yaml:22: filter "wrong-types": command "remove_flags" requires a list of flags like ['\Seen', '$Label1']`,
+		dir + `/filters.yaml:23: filter "wrong-types": command "dedupe" has to be one of delete, flag, move, not "remove"`,
+		dir + `/filters.yaml:28: filter "unknown-key": unknown key "comands", expected one of commands, rules, continue, priority`,
+		dir + `/ordered.yaml:7: filter "flags": command "replace_all_flags": flags have to be strings, quote 42 like '42'`,
+	}, "\n"))
+
+	// Problems with rules and commands of all filters are ordered by their lines
+	path := "../../test/data/configs/invalid/TestFilterSchema/rules.yaml"
+	_, err = config.NewConfigFromFile(path)
+	require.EqualError(err, strings.Join([]string{
+		path + `:9: invalid rules in filter "second" of account "rules": rule #2: header "subject": match mode "fuzzy" is unsupported`,
+		path + `:12: invalid commands in filter "first" of account "rules": move_to_thread requires threads to be configured for the account`,
+		path + `:18: invalid commands in filter "third" of account "rules": dedupe requires duplicates to be configured for the account`,
+	}, "\n"))
+
+	// Filters remember where they are defined
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestSharedFilters.yaml")
+	require.NoError(err)
+	require.Equal("../../test/data/configs/valid/test/TestSharedFilters.yaml", cfg.Filters["work"]["boss"].Position.File)
+	require.Equal(59, cfg.Filters["work"]["boss"].Position.Line)
+}
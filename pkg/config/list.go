@@ -0,0 +1,182 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AddressList is an indexed list of addresses and domains loaded from a file. Plain text files contain one address or domain per line, vCard files (.vcf) are searched for EMAIL properties.
+// Entries without a local part like "example.com" or "@example.com" match all addresses of the domain and its subdomains.
+type AddressList struct {
+	path string
+
+	mu        sync.RWMutex
+	modTime   time.Time
+	size      int64
+	addresses map[string]struct{}
+	domains   map[string]struct{}
+}
+
+// LoadAddressList loads and indexes the list file at path.
+func LoadAddressList(path string) (*AddressList, error) {
+	list := &AddressList{path: path}
+
+	if _, err := list.Reload(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Reload loads the list file again if it changed since it was loaded the last time. It reports whether the list was reloaded.
+func (list *AddressList) Reload() (bool, error) {
+	stat, err := os.Stat(list.path)
+	if err != nil {
+		return false, err
+	}
+
+	list.mu.RLock()
+	unchanged := list.addresses != nil && stat.ModTime().Equal(list.modTime) && stat.Size() == list.size
+	list.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	log.Debugw("Loading address list", "path", list.path)
+
+	addresses, domains, err := readAddressList(list.path)
+	if err != nil {
+		return false, err
+	}
+
+	list.mu.Lock()
+	list.modTime = stat.ModTime()
+	list.size = stat.Size()
+	list.addresses = addresses
+	list.domains = domains
+	list.mu.Unlock()
+
+	log.Debugw("Successfully loaded address list", "path", list.path, "addresses", len(addresses), "domains", len(domains))
+	return true, nil
+}
+
+// Contains reports whether the lowercased address, its domain or one of its parent domains is part of the list.
+func (list *AddressList) Contains(address string) bool {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	if _, ok := list.addresses[address]; ok {
+		return true
+	}
+
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return false
+	}
+
+	// mail.example.com => mail.example.com, example.com, com
+	for domain := address[i+1:]; domain != ""; {
+		if _, ok := list.domains[domain]; ok {
+			return true
+		}
+
+		j := strings.Index(domain, ".")
+		if j < 0 {
+			break
+		}
+		domain = domain[j+1:]
+	}
+
+	return false
+}
+
+// Len returns the number of addresses and domains in the list.
+func (list *AddressList) Len() int {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	return len(list.addresses) + len(list.domains)
+}
+
+func readAddressList(path string) (map[string]struct{}, map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	isVCard := strings.EqualFold(filepath.Ext(path), ".vcf")
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if isVCard {
+			if email, ok := parseVCardEmail(line); ok {
+				entries = append(entries, email)
+			}
+			continue
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.ContainsAny(line, " \t,;<>") {
+			return nil, nil, fmt.Errorf("%v:%v: %q is neither an address nor a domain", path, lineNum, line)
+		}
+
+		entries = append(entries, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	addresses := map[string]struct{}{}
+	domains := map[string]struct{}{}
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+
+		switch i := strings.LastIndex(entry, "@"); {
+		case i < 0:
+			domains[entry] = struct{}{}
+		case i == 0:
+			domains[entry[1:]] = struct{}{}
+		default:
+			addresses[entry] = struct{}{}
+		}
+	}
+
+	return addresses, domains, nil
+}
+
+// parseVCardEmail returns the value of EMAIL properties like "EMAIL;TYPE=work:jane@example.com" or "item1.EMAIL:jane@example.com".
+// Folded lines aren't unfolded since addresses don't contain whitespace.
+func parseVCardEmail(line string) (string, bool) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", false
+	}
+
+	name := strings.ToLower(strings.SplitN(line[:i], ";", 2)[0])
+	if j := strings.LastIndex(name, "."); j >= 0 {
+		// strip property group
+		name = name[j+1:]
+	}
+
+	if name != "email" {
+		return "", false
+	}
+
+	email := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[i+1:]), "mailto:"))
+	return email, email != ""
+}
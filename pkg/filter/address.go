@@ -0,0 +1,117 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
+)
+
+// Address parts, following the Sieve address test (RFC 5228)
+const (
+	addressPartAddress    = "address"
+	addressPartLocalPart  = "localpart"
+	addressPartDomain     = "domain"
+	addressPartSubdomains = "subdomains" // domain or any of its parent domains
+	addressPartName       = "name"
+)
+
+type addressMatcher struct {
+	name     string
+	part     string
+	patterns []compiledPattern
+}
+
+// isAddressCondition reports whether a condition key targets a part of an address header like "from:domain"
+func isAddressCondition(key string) bool {
+	return strings.Contains(key, ":")
+}
+
+// compileAddressCondition compiles conditions like {"from:domain": "example.com"}. Unlike header patterns, plain strings have to match exactly.
+func compileAddressCondition(key string, patternValues interface{}) (matcher, error) {
+	fields := strings.SplitN(key, ":", 2)
+	condition := addressMatcher{name: fields[0], part: fields[1]}
+
+	if condition.name == "" {
+		return nil, fmt.Errorf("header name is missing")
+	}
+
+	switch condition.part {
+	case addressPartAddress, addressPartLocalPart, addressPartDomain, addressPartSubdomains, addressPartName:
+	default:
+		return nil, fmt.Errorf("address part %q is unsupported", condition.part)
+	}
+
+	parsedValues, err := parsePatternValues(patternValues)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range parsedValues {
+		switch p.mode {
+		case MatchModeAuto:
+			p.mode = MatchModeExact
+		case MatchModeNumeric:
+			return nil, fmt.Errorf("numeric comparisons are unsupported")
+		}
+
+		// parent domains include the top-level domain, so a value like "com" would match every .com address
+		if condition.part == addressPartSubdomains && p.mode == MatchModeExact && !strings.Contains(strings.Trim(p.value, "."), ".") {
+			return nil, fmt.Errorf("subdomains requires a domain with at least two labels like example.com, not %q", p.value)
+		}
+
+		compiled, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", p.value, err)
+		}
+
+		condition.patterns = append(condition.patterns, compiled)
+	}
+
+	return condition, nil
+}
+
+// address matches if any address of the header has a part matching any pattern
+func (condition addressMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition(condition.name + ":" + condition.part)
+
+	for _, addr := range msg.AddressList(condition.name) {
+		for _, value := range condition.values(addr) {
+			for _, p := range condition.patterns {
+				if p.match(value) {
+					addCaptures(p, value, captures)
+					trace.decide(p.String(), value)
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (condition addressMatcher) values(addr server.Address) []string {
+	switch condition.part {
+	case addressPartLocalPart:
+		return []string{addr.LocalPart()}
+	case addressPartDomain:
+		return []string{addr.Domain()}
+	case addressPartSubdomains:
+		// mail.example.com => mail.example.com, example.com, com
+		var domains []string
+		for domain := addr.Domain(); domain != ""; {
+			domains = append(domains, domain)
+
+			i := strings.Index(domain, ".")
+			if i < 0 {
+				break
+			}
+			domain = domain[i+1:]
+		}
+
+		return domains
+	case addressPartName:
+		return []string{addr.Name}
+	default:
+		return []string{addr.Address}
+	}
+}
@@ -0,0 +1,88 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAddressConditions(t *testing.T) {
+	require := require.New(t)
+
+	vendorMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "example.com support <support@mail.example.com>"})
+	vendorMsg.Addresses = map[string][]server.Address{
+		"from": {{Name: "example.com support", Address: "support@mail.example.com"}},
+		"to":   {{Name: "", Address: "me@example.org"}, {Name: "boss", Address: "boss+work@example.org"}},
+	}
+
+	// display name pretending to be example.com
+	phishingMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "example.com support <support@evil.test>"})
+	phishingMsg.Addresses = map[string][]server.Address{
+		"from": {{Name: "example.com support", Address: "support@evil.test"}},
+	}
+
+	// addresses are parsed from headers if the message wasn't fetched from a server
+	headersOnlyMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "Rachit <rachit.jain@youth4work.com>", "cc": []string{"foo <a@b.c>, baz <d@e.f>", "x@example.com"}})
+	unparsableMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "invalid-address"})
+
+	// ACTUAL TESTS BELOW
+
+	addressConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+	}{
+		{filterName: "domain", msg: vendorMsg, matchExpected: false},
+		{filterName: "domain", msg: phishingMsg, matchExpected: false},
+		{filterName: "subdomains", msg: vendorMsg, matchExpected: true},
+		{filterName: "subdomains", msg: phishingMsg, matchExpected: false},
+		{filterName: "subdomains", msg: unparsableMsg, matchExpected: false},
+		{filterName: "domain glob", msg: vendorMsg, matchExpected: true},
+		{filterName: "localpart", msg: vendorMsg, matchExpected: true},
+		{filterName: "localpart", msg: headersOnlyMsg, matchExpected: false},
+		{filterName: "address", msg: vendorMsg, matchExpected: false},
+		{filterName: "address", msg: headersOnlyMsg, matchExpected: true},
+		{filterName: "name", msg: vendorMsg, matchExpected: true},
+		{filterName: "name", msg: phishingMsg, matchExpected: true},
+		{filterName: "name but not domain", msg: vendorMsg, matchExpected: false},
+		{filterName: "name but not domain", msg: phishingMsg, matchExpected: true},
+		{filterName: "any recipient", msg: vendorMsg, matchExpected: true},
+		{filterName: "any recipient", msg: headersOnlyMsg, matchExpected: false},
+		{filterName: "cc list from headers", msg: headersOnlyMsg, matchExpected: true},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestAddressConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+
+	for i, test := range addressConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed", i+1, test.filterName)
+	}
+
+	// Invalid address conditions
+	invalidAddressConditionTests := []struct {
+		key  string
+		spec interface{}
+		err  string
+	}{
+		{key: "from:host", spec: "example.com", err: `rule #1: address "from:host": address part "host" is unsupported`},
+		{key: ":domain", spec: "example.com", err: `rule #1: address ":domain": header name is missing`},
+		{key: "from:subdomains", spec: "com", err: `rule #1: address "from:subdomains": subdomains requires a domain with at least two labels like example.com, not "com"`},
+		{key: "from:subdomains", spec: map[string]interface{}{"exact": ".com."}, err: `rule #1: address "from:subdomains": subdomains requires a domain with at least two labels like example.com, not ".com."`},
+		{key: "from:domain", spec: map[string]interface{}{"gt": 3}, err: `rule #1: address "from:domain": numeric comparisons are unsupported`},
+		{key: "from:localpart", spec: map[string]interface{}{"regex": "(a"}, err: "rule #1: address \"from:localpart\": pattern \"(a\": error parsing regexp: missing closing ): `(?i)(a`"},
+	}
+
+	for _, test := range invalidAddressConditionTests {
+		_, err := filter.CompileRuleSet(filter.RuleSet{{"and": []map[string]interface{}{{test.key: test.spec}}}})
+		require.EqualError(err, test.err)
+	}
+}
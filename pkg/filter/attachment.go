@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
+)
+
+type attachmentMatcher struct {
+	spec      string
+	filenames []compiledPattern
+	types     []compiledPattern
+	size      comparisons
+	count     comparisons
+}
+
+var attachmentSpecOptions = []string{"filename", "type", "size", "count"}
+
+// compileAttachmentCondition compiles conditions like {type: application/pdf}, {filename: '*.ics'} or {type: image/*, count: {gt: 3}}.
+// Plain filename and type patterns are globs. Without count at least one attachment has to match all other options.
+func compileAttachmentCondition(patternValues interface{}) (matcher, error) {
+	spec, ok := patternValues.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("attachment requires options like {type: application/pdf}")
+	}
+
+	condition := attachmentMatcher{spec: fmt.Sprint(spec)}
+
+	for key, val := range spec {
+		key = strings.ToLower(key)
+
+		if !contains(attachmentSpecOptions, key) {
+			return nil, fmt.Errorf("attachment option %q is unsupported", key)
+		}
+
+		var err error
+
+		switch key {
+		case "filename":
+			condition.filenames, err = compileGlobPatterns(val)
+		case "type":
+			condition.types, err = compileGlobPatterns(val)
+		case "size":
+			condition.size, err = compileAttachmentComparisons(key, val, ParseSize)
+		case "count":
+			condition.count, err = compileAttachmentComparisons(key, val, parseNumber)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("attachment option %q: %v", key, err)
+		}
+	}
+
+	return condition, nil
+}
+
+func compileAttachmentComparisons(key string, val interface{}, parseValue func(interface{}) (float64, error)) (comparisons, error) {
+	spec, ok := val.(map[string]interface{})
+	if !ok || !isComparisonSpec(spec) {
+		return nil, fmt.Errorf("%v requires comparisons like {gt: 3}", key)
+	}
+
+	return parseComparisons(spec, parseValue)
+}
+
+// compileGlobPatterns compiles pattern values where plain strings are globs instead of auto mode patterns
+func compileGlobPatterns(val interface{}) ([]compiledPattern, error) {
+	parsedValues, err := parsePatternValues(val)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []compiledPattern
+	for _, p := range parsedValues {
+		switch p.mode {
+		case MatchModeAuto:
+			p.mode = MatchModeGlob
+		case MatchModeNumeric:
+			return nil, fmt.Errorf("numeric comparisons are unsupported")
+		}
+
+		compiled, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", p.value, err)
+		}
+
+		patterns = append(patterns, compiled)
+	}
+
+	return patterns, nil
+}
+
+// attachment matches against the attachments listed in the BODYSTRUCTURE of the message
+func (condition attachmentMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("attachment")
+
+	var matchingFilenames []string
+	for _, attachment := range msg.Attachments() {
+		if condition.matchAttachment(attachment) {
+			matchingFilenames = append(matchingFilenames, attachment.Filename)
+		}
+	}
+
+	count := len(matchingFilenames)
+	trace.decide(condition.spec, strings.Join(matchingFilenames, ", "))
+
+	if condition.count == nil {
+		return count > 0, nil
+	}
+
+	return condition.count.match(float64(count)), nil
+}
+
+func (condition attachmentMatcher) matchAttachment(attachment *server.MessagePart) bool {
+	if condition.filenames != nil && !matchAny(condition.filenames, strings.ToLower(attachment.Filename)) {
+		return false
+	}
+
+	if condition.types != nil && !matchAny(condition.types, attachment.MIMEType) {
+		return false
+	}
+
+	if condition.size != nil && !condition.size.match(float64(attachment.Size)) {
+		return false
+	}
+
+	return true
+}
+
+func matchAny(patterns []compiledPattern, s string) bool {
+	for _, p := range patterns {
+		if p.match(s) {
+			return true
+		}
+	}
+
+	return false
+}
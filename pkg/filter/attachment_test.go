@@ -0,0 +1,90 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAttachmentConditions(t *testing.T) {
+	require := require.New(t)
+
+	textPart := &imapUtil.BodyStructure{MIMEType: "text", MIMESubType: "plain", Size: 120}
+	newAttachment := func(mimeType, mimeSubType, filename string, size uint32) *imapUtil.BodyStructure {
+		return &imapUtil.BodyStructure{MIMEType: mimeType, MIMESubType: mimeSubType, Disposition: "attachment", DispositionParams: map[string]string{"filename": filename}, Size: size}
+	}
+
+	invoiceMsg := server.NewMessage(&imapUtil.Message{BodyStructure: &imapUtil.BodyStructure{MIMEType: "multipart", MIMESubType: "mixed", Parts: []*imapUtil.BodyStructure{
+		textPart,
+		newAttachment("application", "pdf", "Invoice-2024.PDF", 200*1024),
+	}}}, server.MessageHeaders{})
+
+	photosMsg := server.NewMessage(&imapUtil.Message{BodyStructure: &imapUtil.BodyStructure{MIMEType: "multipart", MIMESubType: "mixed", Parts: []*imapUtil.BodyStructure{
+		textPart,
+		newAttachment("image", "jpeg", "1.jpg", 3*1024*1024),
+		newAttachment("image", "jpeg", "2.jpg", 3*1024*1024),
+		newAttachment("image", "png", "3.png", 1024),
+		newAttachment("text", "calendar", "invite.ics", 2048),
+	}}}, server.MessageHeaders{})
+
+	plainMsg := server.NewMessage(&imapUtil.Message{BodyStructure: textPart}, server.MessageHeaders{})
+	unknownStructureMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{})
+
+	// ACTUAL TESTS BELOW
+
+	attachmentConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+	}{
+		{filterName: "has pdf attachment", msg: invoiceMsg, matchExpected: true},
+		{filterName: "has pdf attachment", msg: photosMsg, matchExpected: false},
+		{filterName: "has pdf attachment", msg: plainMsg, matchExpected: false},
+		{filterName: "has pdf attachment", msg: unknownStructureMsg, matchExpected: false},
+		{filterName: "has calendar invite", msg: photosMsg, matchExpected: true},
+		{filterName: "has calendar invite", msg: invoiceMsg, matchExpected: false},
+		{filterName: "invoice filename regex", msg: invoiceMsg, matchExpected: true},
+		{filterName: "more than 3 attachments", msg: photosMsg, matchExpected: true},
+		{filterName: "more than 3 attachments", msg: invoiceMsg, matchExpected: false},
+		{filterName: "large images", msg: photosMsg, matchExpected: true},
+		{filterName: "large images", msg: invoiceMsg, matchExpected: false},
+		{filterName: "more than 2 large images", msg: photosMsg, matchExpected: false},
+		{filterName: "has any attachment", msg: invoiceMsg, matchExpected: true},
+		{filterName: "has any attachment", msg: plainMsg, matchExpected: false},
+		{filterName: "no attachments", msg: plainMsg, matchExpected: true},
+		{filterName: "no attachments", msg: photosMsg, matchExpected: false},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestAttachmentConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+
+	for i, test := range attachmentConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed", i+1, test.filterName)
+	}
+
+	// Invalid attachment conditions
+	invalidAttachmentConditionTests := []struct {
+		spec interface{}
+		err  string
+	}{
+		{spec: "application/pdf", err: `rule #1: condition "attachment": attachment requires options like {type: application/pdf}`},
+		{spec: map[string]interface{}{"mimetype": "application/pdf"}, err: `rule #1: condition "attachment": attachment option "mimetype" is unsupported`},
+		{spec: map[string]interface{}{"count": 3}, err: `rule #1: condition "attachment": attachment option "count": count requires comparisons like {gt: 3}`},
+		{spec: map[string]interface{}{"size": map[string]interface{}{"gt": "huge"}}, err: `rule #1: condition "attachment": attachment option "size": invalid value for comparison "gt": "huge" is not a valid size`},
+		{spec: map[string]interface{}{"filename": map[string]interface{}{"regex": "(.pdf"}}, err: "rule #1: condition \"attachment\": attachment option \"filename\": pattern \"(.pdf\": error parsing regexp: missing closing ): `(?i)(.pdf`"},
+	}
+
+	for _, test := range invalidAttachmentConditionTests {
+		_, err := filter.CompileRuleSet(filter.RuleSet{{"and": []map[string]interface{}{{"attachment": test.spec}}}})
+		require.EqualError(err, test.err)
+	}
+}
@@ -0,0 +1,124 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
+)
+
+type authMatcher struct {
+	method      string
+	spec        string
+	results     []compiledPattern
+	domains     []compiledPattern
+	authServIDs []string
+}
+
+// compileAuthCondition compiles conditions like {dmarc: fail} or {dkim: {result: pass, domain: paypal.com}}.
+// Only results added by one of the trusted authserv-ids are considered since everybody can add Authentication-Results headers to a message.
+func compileAuthCondition(method string, patternValues interface{}, authServIDs []string) (matcher, error) {
+	if len(authServIDs) == 0 {
+		return nil, fmt.Errorf("authentication results can only be trusted if trusted_authserv_ids are configured for the account")
+	}
+
+	condition := authMatcher{method: method, spec: fmt.Sprint(patternValues)}
+	for _, id := range authServIDs {
+		condition.authServIDs = append(condition.authServIDs, strings.ToLower(id))
+	}
+
+	var err error
+	spec, ok := patternValues.(map[string]interface{})
+	if !ok {
+		// plain results like fail or [fail, softfail]
+		if condition.results, err = compileExactPatterns(patternValues); err != nil {
+			return nil, err
+		}
+
+		return condition, nil
+	}
+
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("%v requires a result or options like {result: pass, domain: example.com}", method)
+	}
+
+	for key, val := range spec {
+		switch strings.ToLower(key) {
+		case "result":
+			condition.results, err = compileExactPatterns(val)
+		case "domain":
+			if method == "arc" {
+				return nil, fmt.Errorf("%v option %q is unsupported", method, key)
+			}
+
+			condition.domains, err = compileExactPatterns(val)
+		default:
+			return nil, fmt.Errorf("%v option %q is unsupported", method, key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%v option %q: %v", method, key, err)
+		}
+	}
+
+	return condition, nil
+}
+
+// compileExactPatterns compiles patterns where plain values have to match exactly
+func compileExactPatterns(patternValues interface{}) ([]compiledPattern, error) {
+	parsedValues, err := parsePatternValues(patternValues)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []compiledPattern
+	for _, p := range parsedValues {
+		switch p.mode {
+		case MatchModeAuto:
+			p.mode = MatchModeExact
+		case MatchModeNumeric:
+			return nil, fmt.Errorf("numeric comparisons are unsupported")
+		}
+
+		compiled, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", p.value, err)
+		}
+
+		patterns = append(patterns, compiled)
+	}
+
+	return patterns, nil
+}
+
+// auth matches if any trusted result of the method matches. Messages without a trusted result for the method have the result "none".
+func (condition authMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition(condition.method)
+
+	results := msg.TrustedAuthResults(condition.method, condition.authServIDs)
+	if len(results) == 0 {
+		results = append(results, server.AuthResult{Method: condition.method, Result: "none"})
+	}
+
+	var found []string
+	for _, result := range results {
+		domain := result.Domain()
+		if domain != "" {
+			found = append(found, fmt.Sprintf("%v for %v", result.Result, domain))
+		} else {
+			found = append(found, result.Result)
+		}
+
+		// options that aren't given match any result or domain
+		resultMatched := len(condition.results) == 0 || matchAny(condition.results, result.Result)
+		domainMatched := len(condition.domains) == 0 || matchAny(condition.domains, domain)
+
+		if resultMatched && domainMatched {
+			trace.decide(condition.spec, found[len(found)-1])
+			return true, nil
+		}
+	}
+
+	trace.decide(condition.spec, strings.Join(found, ", "))
+
+	return false, nil
+}
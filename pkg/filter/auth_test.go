@@ -0,0 +1,81 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAuthConditions(t *testing.T) {
+	require := require.New(t)
+
+	newMsg := func(headers server.MessageHeaders) *server.Message {
+		return server.NewMessage(&imapUtil.Message{}, headers)
+	}
+
+	// ACTUAL TESTS BELOW
+
+	authConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+	}{
+		{filterName: "paypal phishing", msg: newMsg(server.MessageHeaders{"from": "service@paypal.com", "authentication-results": "mx.example.com; dmarc=fail header.from=paypal.com"}), matchExpected: true},
+		{filterName: "paypal phishing", msg: newMsg(server.MessageHeaders{"from": "service@paypal.com", "authentication-results": "mx.example.com; dmarc=pass header.from=paypal.com"}), matchExpected: false},
+		{filterName: "paypal phishing", msg: newMsg(server.MessageHeaders{"from": "service@paypal.com", "authentication-results": "mx.evil.test; dmarc=fail header.from=paypal.com"}), matchExpected: false},
+		{filterName: "paypal phishing", msg: newMsg(server.MessageHeaders{"from": "service@paypal.com", "authentication-results": []string{"mx.evil.test; dmarc=pass", "mx2.example.com; dmarc=fail"}}), matchExpected: true},
+		{filterName: "paypal phishing", msg: newMsg(server.MessageHeaders{"from": "friend@example.net", "authentication-results": "mx.example.com; dmarc=fail header.from=example.net"}), matchExpected: false},
+		{filterName: "dkim pass for paypal", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dkim=fail header.d=paypal.com; dkim=pass header.d=mailer.example"}), matchExpected: false},
+		{filterName: "dkim pass for paypal", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dkim=fail header.d=mailer.example; dkim=pass header.d=paypal.com"}), matchExpected: true},
+		{filterName: "dkim pass for paypal", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dkim=pass header.i=service@paypal.com"}), matchExpected: true},
+		{filterName: "dkim pass for paypal", msg: newMsg(server.MessageHeaders{"authentication-results": []string{"mx.example.com; dkim=fail header.d=paypal.com", "mx.example.com; dkim=pass header.d=paypal.com; dmarc=pass"}}), matchExpected: false},
+		{filterName: "paypal phishing", msg: newMsg(server.MessageHeaders{"from": "service@paypal.com", "authentication-results": []string{"mx.example.com; dmarc=fail header.from=paypal.com", "mx.example.com; dkim=pass header.d=paypal.com; dmarc=pass"}}), matchExpected: true},
+		{filterName: "paypal phishing", msg: newMsg(server.MessageHeaders{"from": "service@paypal.com", "authentication-results": []string{"mx.example.com; spf=pass smtp.mailfrom=paypal.com; dkim=pass header.d=paypal.com", "mx.example.com; dmarc=fail header.from=paypal.com"}}), matchExpected: false},
+		{filterName: "dmarc missing", msg: newMsg(server.MessageHeaders{"authentication-results": []string{"mx.example.com; spf=pass smtp.mailfrom=paypal.com; dkim=pass header.d=paypal.com", "mx.example.com; dmarc=pass header.from=paypal.com"}}), matchExpected: true},
+		{filterName: "spf failed", msg: newMsg(server.MessageHeaders{"received-spf": []string{"fail receiver=mx.example.com; envelope-from=user@example.com", "pass receiver=mx.example.com; envelope-from=user@example.com"}}), matchExpected: true},
+		{filterName: "spf failed", msg: newMsg(server.MessageHeaders{"received-spf": "softfail (domain of transitioning user@example.com does not designate 192.0.2.1 as permitted sender) receiver=mx.example.com; envelope-from=user@example.com"}), matchExpected: true},
+		{filterName: "spf failed", msg: newMsg(server.MessageHeaders{"received-spf": "fail receiver=mx.evil.test; envelope-from=user@example.com"}), matchExpected: false},
+		{filterName: "spf failed", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; spf=fail smtp.mailfrom=user@example.com"}), matchExpected: true},
+		{filterName: "dmarc missing", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dkim=pass header.d=paypal.com"}), matchExpected: true},
+		{filterName: "dmarc missing", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.evil.test; dmarc=pass"}), matchExpected: true},
+		{filterName: "dmarc missing", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dmarc=none header.from=example.net"}), matchExpected: true},
+		{filterName: "dmarc missing", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dmarc=pass"}), matchExpected: false},
+		{filterName: "dkim signed by subdomain", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dkim=pass header.d=news.example.org"}), matchExpected: true},
+		{filterName: "dkim signed by subdomain", msg: newMsg(server.MessageHeaders{"authentication-results": "mx.example.com; dkim=pass header.d=example.org"}), matchExpected: false},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestAuthConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["auth"]
+
+	for i, test := range authConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed: headers=%v", i+1, test.filterName, test.msg.Headers)
+	}
+
+	// Invalid auth conditions
+	trusted := filter.CompileOptions{AuthServIDs: []string{"mx.example.com"}}
+	invalidAuthConditionTests := []struct {
+		condition map[string]interface{}
+		opts      filter.CompileOptions
+		err       string
+	}{
+		{condition: map[string]interface{}{"dmarc": "fail"}, err: `rule #1: condition "dmarc": authentication results can only be trusted if trusted_authserv_ids are configured for the account`},
+		{condition: map[string]interface{}{"dkim": map[string]interface{}{}}, opts: trusted, err: `rule #1: condition "dkim": dkim requires a result or options like {result: pass, domain: example.com}`},
+		{condition: map[string]interface{}{"dkim": map[string]interface{}{"selector": "s1"}}, opts: trusted, err: `rule #1: condition "dkim": dkim option "selector" is unsupported`},
+		{condition: map[string]interface{}{"arc": map[string]interface{}{"domain": "example.com"}}, opts: trusted, err: `rule #1: condition "arc": arc option "domain" is unsupported`},
+		{condition: map[string]interface{}{"spf": map[string]interface{}{"result": map[string]interface{}{"gt": 1}}}, opts: trusted, err: `rule #1: condition "spf": spf option "result": numeric comparisons are unsupported`},
+	}
+
+	for _, test := range invalidAuthConditionTests {
+		_, err := filter.CompileRuleSetWithOptions(filter.RuleSet{{"and": []map[string]interface{}{test.condition}}}, test.opts)
+		require.EqualError(err, test.err)
+	}
+}
@@ -0,0 +1,50 @@
+package filter
+
+import (
+	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
+)
+
+type bodyMatcher struct {
+	patterns []compiledPattern
+}
+
+func compileBodyCondition(patternValues interface{}) (matcher, error) {
+	parsedValues, err := parsePatternValues(patternValues)
+	if err != nil {
+		return nil, err
+	}
+
+	condition := bodyMatcher{}
+	for _, p := range parsedValues {
+		compiled, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+
+		condition.patterns = append(condition.patterns, compiled)
+	}
+
+	return condition, nil
+}
+
+// body matches against the decoded text parts of the message which are fetched lazily
+func (condition bodyMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("body")
+
+	text, err := msg.Text()
+	if err != nil {
+		return false, err
+	}
+
+	lowerText := strings.ToLower(text)
+	for _, p := range condition.patterns {
+		if p.match(lowerText) {
+			addCaptures(p, text, captures)
+			trace.decide(p.String(), "")
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,56 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBodyConditions(t *testing.T) {
+	require := require.New(t)
+
+	newsletter := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "news@example.com"})
+	newsletter.SetText("Your Order #12345 has been shipped.\nClick here to UNSUBSCRIBE.")
+
+	// messages without text and server connection fail as soon as their body is needed
+	unfetchable := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "foo@example.com"})
+	unfetchableOther := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "bar@example.com"})
+
+	// ACTUAL TESTS BELOW
+
+	bodyConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+		err           string
+	}{
+		{filterName: "body contains unsubscribe", msg: newsletter, matchExpected: true},
+		{filterName: "body order number", msg: newsletter, matchExpected: true},
+		{filterName: "failing exact body pattern", msg: newsletter, matchExpected: false},
+		{filterName: "body is evaluated last", msg: newsletter, matchExpected: false},
+		{filterName: "body is evaluated last", msg: unfetchableOther, matchExpected: false},
+		{filterName: "body is evaluated last", msg: unfetchable, err: "message text can't be fetched without a server connection"},
+		{filterName: "body is skipped if or matches", msg: unfetchable, matchExpected: true},
+		{filterName: "body contains unsubscribe", msg: unfetchable, err: "message text can't be fetched without a server connection"},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestBodyConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+
+	for i, test := range bodyConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		if test.err != "" {
+			require.EqualError(err, test.err, "Test #%v (%q) failed", i+1, test.filterName)
+			continue
+		}
+
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed", i+1, test.filterName)
+	}
+}
@@ -0,0 +1,100 @@
+package filter
+
+// capturer is implemented by conditions with regular expressions whose named captures like (?P<project>[a-z]+) can be used in move templates.
+// The captures are recorded while the conditions match.
+type capturer interface {
+	// captureNames returns the names of all named captures of the condition
+	captureNames() []string
+}
+
+func (ruleSetMatcher *RuleSetMatcher) captureNames() []string {
+	var names []string
+
+	for _, rule := range ruleSetMatcher.rules {
+		if c, ok := rule.(capturer); ok {
+			names = append(names, c.captureNames()...)
+		}
+	}
+
+	return names
+}
+
+func (group groupMatcher) captureNames() []string {
+	var names []string
+
+	// conditions of not groups never match when the group does
+	if group.op == "not" {
+		return nil
+	}
+
+	for _, condition := range group.conditions {
+		if c, ok := condition.(capturer); ok {
+			names = append(names, c.captureNames()...)
+		}
+	}
+
+	return names
+}
+
+func (condition headerMatcher) captureNames() []string {
+	return patternCaptureNames(condition.patterns)
+}
+
+func (condition addressMatcher) captureNames() []string {
+	return patternCaptureNames(condition.patterns)
+}
+
+func (condition bodyMatcher) captureNames() []string {
+	return patternCaptureNames(condition.patterns)
+}
+
+func patternCaptureNames(patterns []compiledPattern) []string {
+	var names []string
+
+	for _, p := range patterns {
+		if p.regEx == nil {
+			continue
+		}
+
+		for _, name := range p.regEx.SubexpNames() {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// captureScope returns the captures of a condition that are only kept once the condition is known to match, or nil if captures aren't recorded
+func captureScope(captures map[string]string) map[string]string {
+	if captures == nil {
+		return nil
+	}
+
+	return map[string]string{}
+}
+
+func mergeCaptures(into map[string]string, captures map[string]string) {
+	for name, value := range captures {
+		into[name] = value
+	}
+}
+
+// addCaptures adds the named captures of a matching pattern. The regular expressions are case-insensitive, so captures keep the case of the value.
+func addCaptures(p compiledPattern, value string, captures map[string]string) {
+	if captures == nil || p.regEx == nil {
+		return
+	}
+
+	submatches := p.regEx.FindStringSubmatch(value)
+	if submatches == nil {
+		return
+	}
+
+	for i, name := range p.regEx.SubexpNames() {
+		if name != "" {
+			captures[name] = submatches[i]
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/classifier"
+	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
+)
+
+// defaultClassifierThreshold is the probability that the predicted mailbox needs at least unless the condition sets a threshold
+const defaultClassifierThreshold = 0.9
+
+type classifierMatcher struct {
+	mailbox   string
+	threshold float64
+	model     *classifier.Model
+}
+
+// compileClassifierCondition compiles conditions like {classifier: Newsletters} or {classifier: {mailbox: Newsletters, threshold: 0.8}}.
+// They match if the classifier of the account predicts the mailbox for the message with at least the threshold probability.
+func compileClassifierCondition(patternValues interface{}, model *classifier.Model) (matcher, error) {
+	if model == nil {
+		return nil, fmt.Errorf("classifier conditions require a classifier configured for the account")
+	}
+
+	condition := classifierMatcher{threshold: defaultClassifierThreshold, model: model}
+
+	switch spec := patternValues.(type) {
+	case string:
+		condition.mailbox = spec
+	case map[string]interface{}:
+		for key, val := range spec {
+			switch strings.ToLower(key) {
+			case "mailbox":
+				mailbox, ok := val.(string)
+				if !ok {
+					return nil, fmt.Errorf("classifier option %q requires a mailbox name", key)
+				}
+
+				condition.mailbox = mailbox
+			case "threshold":
+				threshold, err := parseNumber(val)
+				if err != nil || threshold <= 0 || threshold > 1 {
+					return nil, fmt.Errorf("classifier option %q requires a probability greater than 0 and at most 1, not %v", key, val)
+				}
+
+				condition.threshold = threshold
+			default:
+				return nil, fmt.Errorf("classifier option %q is unsupported", key)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("classifier requires a mailbox name or options like {mailbox: Newsletters, threshold: 0.8}")
+	}
+
+	if condition.mailbox == "" {
+		return nil, fmt.Errorf("classifier requires a mailbox name or options like {mailbox: Newsletters, threshold: 0.8}")
+	}
+
+	if !contains(model.Mailboxes, condition.mailbox) {
+		return nil, fmt.Errorf("mailbox %q isn't one of the mailboxes the classifier learns from", condition.mailbox)
+	}
+
+	return condition, nil
+}
+
+// classifier predicts the mailbox of the message from what it learned
+func (condition classifierMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("classifier")
+
+	mailbox, probability, err := condition.model.Classify(msg)
+	if err != nil {
+		return false, err
+	}
+
+	trace.decide(fmt.Sprintf("%v >= %v", condition.mailbox, condition.threshold), fmt.Sprintf("%v %.3f", mailbox, probability))
+
+	return mailbox == condition.mailbox && probability >= condition.threshold, nil
+}
@@ -0,0 +1,95 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/classifier"
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestClassifierConditions(t *testing.T) {
+	require := require.New(t)
+
+	newMsg := func(from string, subject string) *server.Message {
+		return server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": from, "subject": subject})
+	}
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestClassifierConditions.yaml")
+	require.NoError(err)
+
+	acc := cfg.Accounts["classifier"]
+	require.Equal(24*time.Hour, acc.Classifier.Retrain)
+	require.Equal([]string{"Newsletters", "Work"}, acc.Model.Mailboxes)
+
+	// Nothing matches before the classifier learned anything
+	msg := newMsg("news@shop.example.com", "Weekly deals")
+	for filterName := range cfg.Filters["classifier"] {
+		matched, err := cfg.Filters["classifier"][filterName].Match(msg)
+		require.NoError(err)
+		require.False(matched, "filter %q", filterName)
+	}
+
+	for _, training := range []struct {
+		mailbox string
+		msg     *server.Message
+	}{
+		{mailbox: "Newsletters", msg: newMsg("news@shop.example.com", "Weekly deals on shoes")},
+		{mailbox: "Newsletters", msg: newMsg("news@shop.example.com", "Deals of the week")},
+		{mailbox: "Work", msg: newMsg("jane@corp.example.net", "Budget review meeting")},
+		{mailbox: "Work", msg: newMsg("john@corp.example.net", "Quarterly planning")},
+	} {
+		require.NoError(acc.Model.Learn(training.mailbox, training.msg))
+	}
+
+	classifierTests := []struct {
+		msg      *server.Message
+		expected map[string]bool
+	}{
+		{msg: msg, expected: map[string]bool{"newsletters": true, "probably work": false}},
+		{msg: newMsg("jane@corp.example.net", "Budget planning"), expected: map[string]bool{"newsletters": false, "probably work": true}},
+		{msg: newMsg("someone@example.com", "Hello"), expected: map[string]bool{"newsletters": false}},
+	}
+
+	for i, test := range classifierTests {
+		for filterName, matchExpected := range test.expected {
+			matched, err := cfg.Filters["classifier"][filterName].Match(test.msg)
+			require.NoError(err)
+			require.Equal(matchExpected, matched, "Test #%v: filter %q", i+1, filterName)
+		}
+	}
+
+	// The trace shows the prediction
+	trace, err := cfg.Filters["classifier"]["newsletters"].Explain(msg)
+	require.NoError(err)
+	require.True(trace.Matched)
+	require.Contains(trace.Path(), "classifier")
+
+	// Invalid classifier conditions
+	model, err := classifier.NewModel([]string{"Newsletters", "Work"}, false, "")
+	require.NoError(err)
+
+	invalidClassifierConditionTests := []struct {
+		spec  interface{}
+		model *classifier.Model
+		err   string
+	}{
+		{spec: "Newsletters", err: `rule #1: condition "classifier": classifier conditions require a classifier configured for the account`},
+		{spec: true, model: model, err: `rule #1: condition "classifier": classifier requires a mailbox name or options like {mailbox: Newsletters, threshold: 0.8}`},
+		{spec: map[string]interface{}{"threshold": 0.8}, model: model, err: `rule #1: condition "classifier": classifier requires a mailbox name or options like {mailbox: Newsletters, threshold: 0.8}`},
+		{spec: "Spam", model: model, err: `rule #1: condition "classifier": mailbox "Spam" isn't one of the mailboxes the classifier learns from`},
+		{spec: map[string]interface{}{"mailbox": "Work", "threshold": 1.5}, model: model, err: `rule #1: condition "classifier": classifier option "threshold" requires a probability greater than 0 and at most 1, not 1.5`},
+		{spec: map[string]interface{}{"mailbox": "Work", "confidence": 0.5}, model: model, err: `rule #1: condition "classifier": classifier option "confidence" is unsupported`},
+	}
+
+	for i, test := range invalidClassifierConditionTests {
+		ruleSet := filter.RuleSet{{"and": []map[string]interface{}{{"classifier": test.spec}}}}
+		_, err := filter.CompileRuleSetWithOptions(ruleSet, filter.CompileOptions{Classifier: test.model})
+		require.EqualError(err, test.err, "Test #%v", i+1)
+	}
+}
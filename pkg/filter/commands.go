@@ -2,6 +2,7 @@ package filter
 
 import (
 	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
 )
 
 //type UnknownCommandTypeError struct {
@@ -20,38 +21,132 @@ import (
 //	return fmt.Sprintf("Bad command target %q", err.targetName)
 //}
 
-func RunCommands(srv *server.Connection, from string, uid uint32, cmds FilterOps) error {
-	var err error
+// Commands are the actions that are applied to the messages a filter matches.
+type Commands struct {
+	Move            string   // target mailbox, may contain templates like Lists/{{ header 'list-id' | listname }}
+	MoveToThread    bool     // move to the mailbox of the message the message replies to instead, if it's found
+	AddFlags        []string // flags to add
+	RemoveFlags     []string // flags to remove
+	ReplaceAllFlags []string // flags that replace all flags, nil unless set. An empty list removes all flags.
+	Dedupe          string   // delete, flag or move the message if it's an extra copy of an earlier message, see DedupeActions
+}
+
+// DedupeActions are what the dedupe command can do with extra copies of a message
+var DedupeActions = []string{"delete", "flag", "move"}
+
+// IsEmpty reports whether there is nothing to do
+func (cmds Commands) IsEmpty() bool {
+	return cmds.Move == "" && !cmds.MoveToThread && cmds.AddFlags == nil && cmds.RemoveFlags == nil && cmds.ReplaceAllFlags == nil && cmds.Dedupe == ""
+}
+
+// RunCommands applies the commands to a message. The message is deleted if the dedupe action is delete, which requires a server that supports UIDPLUS
+// so that only this message is expunged. resolveDedupe only asks for it if the server does, the other dedupe actions are applied as moves and flags.
+func RunCommands(srv *server.Connection, from string, uid uint32, cmds Commands) error {
 	uids := []uint32{uid}
 
-	if cmds["move"] != nil {
-		if err := srv.Move(uids, from, cmds["move"].(string)); err != nil {
-			return err
-		}
+	if cmds.Dedupe == "delete" {
+		return srv.ExpungeMsgs(from, uids)
 	}
 
 	to := from
-	if cmds["move"] != nil {
-		to = cmds["move"].(string)
+	if cmds.Move != "" {
+		if err := srv.Move(uids, from, cmds.Move); err != nil {
+			return err
+		}
+
+		to = cmds.Move
 	}
 
-	if cmds["add_flags"] != nil {
-		if err := srv.SetFlags(to, uids, "+FLAGS", cmds["add_flags"].([]interface{}), false); err != nil {
+	if len(cmds.AddFlags) > 0 {
+		if err := srv.SetFlags(to, uids, "+FLAGS", flagValues(cmds.AddFlags), false); err != nil {
 			return err
 		}
 	}
 
-	if cmds["remove_flags"] != nil {
-		if err := srv.SetFlags(to, uids, "-FLAGS", cmds["remove_flags"].([]interface{}), false); err != nil {
+	if len(cmds.RemoveFlags) > 0 {
+		if err := srv.SetFlags(to, uids, "-FLAGS", flagValues(cmds.RemoveFlags), false); err != nil {
 			return err
 		}
 	}
 
-	if cmds["replace_all_flags"] != nil {
-		if err := srv.SetFlags(to, uids, "FLAGS", cmds["replace_all_flags"].([]interface{}), false); err != nil {
+	if cmds.ReplaceAllFlags != nil {
+		if err := srv.SetFlags(to, uids, "FLAGS", flagValues(cmds.ReplaceAllFlags), false); err != nil {
 			return err
 		}
 	}
 
-	return err
+	return nil
+}
+
+// MergeCommands merges the commands of several matching filters in order. A later move, move_to_thread or dedupe overrides an earlier one and flags add up.
+// Once a filter replaces all flags, the flags added or removed by later filters are applied to that list instead.
+func MergeCommands(cmdsList ...Commands) Commands {
+	merged := Commands{}
+
+	for _, cmds := range cmdsList {
+		if cmds.Move != "" || cmds.MoveToThread {
+			// move_to_thread falls back to the move of the same filter if the thread isn't found
+			merged.Move = cmds.Move
+			merged.MoveToThread = cmds.MoveToThread
+		}
+
+		if cmds.Dedupe != "" {
+			merged.Dedupe = cmds.Dedupe
+		}
+
+		switch {
+		case cmds.ReplaceAllFlags != nil:
+			// replacing is applied after adding and removing, so it wins within a filter
+			merged.ReplaceAllFlags = mergeFlags(nil, cmds.ReplaceAllFlags, nil)
+			merged.AddFlags = nil
+			merged.RemoveFlags = nil
+		case merged.ReplaceAllFlags != nil:
+			merged.ReplaceAllFlags = mergeFlags(merged.ReplaceAllFlags, cmds.AddFlags, cmds.RemoveFlags)
+		default:
+			// a flag added later isn't removed anymore and vice versa
+			addFlags := mergeFlags(mergeFlags(nil, merged.AddFlags, cmds.RemoveFlags), cmds.AddFlags, nil)
+			removeFlags := mergeFlags(mergeFlags(nil, merged.RemoveFlags, cmds.AddFlags), cmds.RemoveFlags, nil)
+
+			merged.AddFlags, merged.RemoveFlags = nil, nil
+			if len(addFlags) > 0 {
+				merged.AddFlags = addFlags
+			}
+
+			if len(removeFlags) > 0 {
+				merged.RemoveFlags = removeFlags
+			}
+		}
+	}
+
+	return merged
+}
+
+// mergeFlags appends the added flags to the flags and drops the removed ones. IMAP flags are case-insensitive.
+func mergeFlags(flags []string, added []string, removed []string) []string {
+	merged := []string{}
+	skip := map[string]bool{}
+
+	for _, flag := range removed {
+		skip[strings.ToLower(flag)] = true
+	}
+
+	for _, flag := range append(append([]string{}, flags...), added...) {
+		if skip[strings.ToLower(flag)] {
+			continue
+		}
+
+		skip[strings.ToLower(flag)] = true
+		merged = append(merged, flag)
+	}
+
+	return merged
+}
+
+func flagValues(flags []string) []interface{} {
+	values := make([]interface{}, 0, len(flags))
+	for _, flag := range flags {
+		values = append(values, flag)
+	}
+
+	return values
 }
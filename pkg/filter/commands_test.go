@@ -33,10 +33,11 @@ func TestApplyCommands(t *testing.T) {
 	require.NoError(err)
 
 	// Apply commands
-	cmds := make(filter.FilterOps)
-	cmds["move"] = "MyTarget"
-	cmds["add_flags"] = []interface{}{"add_foobar", "Bar", "$MailFlagBit0", server.FlaggedFlag}
-	cmds["remove_flags"] = []interface{}{"set_foobar", "bar"}
+	cmds := filter.Commands{
+		Move:        "MyTarget",
+		AddFlags:    []string{"add_foobar", "Bar", "$MailFlagBit0", server.FlaggedFlag},
+		RemoveFlags: []string{"set_foobar", "bar"},
+	}
 
 	// Message 1
 	require.Nil(filter.RunCommands(&acc.Connection, "INBOX", testMails[0].RawMessage.Uid, cmds))
@@ -45,7 +46,7 @@ func TestApplyCommands(t *testing.T) {
 	require.ElementsMatch([]string{"add_foobar", "$mailflagbit0", server.FlaggedFlag}, flags)
 
 	// Message 2: replace all flags
-	cmds["replace_all_flags"] = []interface{}{"42", "bar", "oO", "$MailFlagBit0", server.FlaggedFlag}
+	cmds.ReplaceAllFlags = []string{"42", "bar", "oO", "$MailFlagBit0", server.FlaggedFlag}
 	require.Nil(filter.RunCommands(&acc.Connection, "INBOX", testMails[1].RawMessage.Uid, cmds))
 	flags, err = acc.Connection.GetFlags("MyTarget", testMails[1].RawMessage.Uid)
 	require.NoError(err)
@@ -60,7 +61,7 @@ func TestApplyCommands(t *testing.T) {
 	require.NoError(err)
 
 	// Apply cmd to this new mail 3 too
-	cmds["replace_all_flags"] = []interface{}{"completly", "different"}
+	cmds.ReplaceAllFlags = []string{"completly", "different"}
 	require.Nil(filter.RunCommands(&acc.Connection, "INBOX", testMails[0].RawMessage.Uid, cmds))
 	flags, err = acc.Connection.GetFlags("MyTarget", testMails[0].RawMessage.Uid)
 	require.NoError(err)
@@ -76,3 +77,70 @@ func TestApplyCommands(t *testing.T) {
 	require.NoError(err)
 	require.ElementsMatch([]uint32{1, 2, 3}, uids)
 }
+
+func TestMergeCommands(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	mergeTests := []struct {
+		cmds     []filter.Commands
+		expected filter.Commands
+	}{
+		{ // #1 single filter stays as it is
+			cmds:     []filter.Commands{{Move: "Projects/X", AddFlags: []string{"foo"}}},
+			expected: filter.Commands{Move: "Projects/X", AddFlags: []string{"foo"}},
+		},
+		{ // #2 flags from one filter, move from another
+			cmds:     []filter.Commands{{AddFlags: []string{server.FlaggedFlag}}, {Move: "Projects/X"}},
+			expected: filter.Commands{Move: "Projects/X", AddFlags: []string{server.FlaggedFlag}},
+		},
+		{ // #3 later moves override earlier ones
+			cmds:     []filter.Commands{{Move: "A"}, {Move: "B"}},
+			expected: filter.Commands{Move: "B"},
+		},
+		{ // #4 flags add up, later commands win
+			cmds: []filter.Commands{
+				{AddFlags: []string{"foo", "bar"}, RemoveFlags: []string{"baz"}},
+				{AddFlags: []string{"BAZ", "qux"}, RemoveFlags: []string{"foo"}},
+			},
+			expected: filter.Commands{AddFlags: []string{"bar", "BAZ", "qux"}, RemoveFlags: []string{"foo"}},
+		},
+		{ // #5 replacing all flags drops earlier flag changes
+			cmds:     []filter.Commands{{AddFlags: []string{"foo"}}, {ReplaceAllFlags: []string{"bar"}, AddFlags: []string{"ignored"}}},
+			expected: filter.Commands{ReplaceAllFlags: []string{"bar"}},
+		},
+		{ // #6 later flag changes are applied to the replaced flags
+			cmds:     []filter.Commands{{ReplaceAllFlags: []string{"bar", "baz"}}, {AddFlags: []string{"foo"}, RemoveFlags: []string{"bar"}}},
+			expected: filter.Commands{ReplaceAllFlags: []string{"baz", "foo"}},
+		},
+		{ // #7 nothing to do
+			cmds:     []filter.Commands{{}, {}},
+			expected: filter.Commands{},
+		},
+		{ // #8 move_to_thread keeps the move of the same filter as fallback
+			cmds:     []filter.Commands{{Move: "A"}, {MoveToThread: true, Move: "B"}},
+			expected: filter.Commands{MoveToThread: true, Move: "B"},
+		},
+		{ // #9 a later move overrides move_to_thread and vice versa
+			cmds:     []filter.Commands{{MoveToThread: true, Move: "A"}, {Move: "B"}},
+			expected: filter.Commands{Move: "B"},
+		},
+		{ // #10
+			cmds:     []filter.Commands{{Move: "A"}, {MoveToThread: true}},
+			expected: filter.Commands{MoveToThread: true},
+		},
+		{ // #11 an empty list removes all flags
+			cmds:     []filter.Commands{{AddFlags: []string{"foo"}}, {ReplaceAllFlags: []string{}}},
+			expected: filter.Commands{ReplaceAllFlags: []string{}},
+		},
+		{ // #12 a later dedupe overrides an earlier one, the other commands are kept
+			cmds:     []filter.Commands{{Dedupe: "flag", Move: "A"}, {AddFlags: []string{"foo"}}, {Dedupe: "delete"}},
+			expected: filter.Commands{Move: "A", AddFlags: []string{"foo"}, Dedupe: "delete"},
+		},
+	}
+
+	for i, test := range mergeTests {
+		require.Equal(test.expected, filter.MergeCommands(test.cmds...), "Test #%v failed", i+1)
+	}
+}
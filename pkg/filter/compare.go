@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Numeric comparison operators
+const (
+	compareGreater      = "gt"
+	compareGreaterEqual = "ge"
+	compareLess         = "lt"
+	compareLessEqual    = "le"
+	compareEqual        = "eq"
+)
+
+type comparison struct {
+	op    string
+	value float64
+}
+
+// comparisons match if all of them hold, e.g. {gt: 5, le: 10}
+type comparisons []comparison
+
+func isComparisonOperator(op string) bool {
+	switch strings.ToLower(op) {
+	case compareGreater, compareGreaterEqual, compareLess, compareLessEqual, compareEqual:
+		return true
+	}
+
+	return false
+}
+
+// isComparisonSpec reports whether a pattern map uses numeric comparison operators.
+func isComparisonSpec(spec map[string]interface{}) bool {
+	for key := range spec {
+		if isComparisonOperator(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseComparisons(spec map[string]interface{}, parseValue func(interface{}) (float64, error)) (comparisons, error) {
+	var cmps comparisons
+
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("no comparison given")
+	}
+
+	// sort for deterministic error messages
+	keys := make([]string, 0, len(spec))
+	for key := range spec {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		op := strings.ToLower(key)
+		if !isComparisonOperator(op) {
+			return nil, fmt.Errorf("match mode %q can't be combined with numeric comparisons", op)
+		}
+
+		value, err := parseValue(spec[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for comparison %q: %v", op, err)
+		}
+
+		cmps = append(cmps, comparison{op: op, value: value})
+	}
+
+	return cmps, nil
+}
+
+func (cmps comparisons) match(f float64) bool {
+	for _, cmp := range cmps {
+		var ok bool
+
+		switch cmp.op {
+		case compareGreater:
+			ok = f > cmp.value
+		case compareGreaterEqual:
+			ok = f >= cmp.value
+		case compareLess:
+			ok = f < cmp.value
+		case compareLessEqual:
+			ok = f <= cmp.value
+		case compareEqual:
+			ok = f == cmp.value
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("%q is not a number", n)
+		}
+
+		return f, nil
+	default:
+		return 0, fmt.Errorf("unsupported number type %v", reflect.TypeOf(v))
+	}
+}
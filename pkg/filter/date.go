@@ -0,0 +1,264 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date sources of a date condition
+const (
+	dateSourceHeader       = "header"
+	dateSourceInternalDate = "internaldate"
+)
+
+type dateMatcher struct {
+	spec      string
+	source    string
+	location  *time.Location
+	olderThan time.Duration
+	newerThan time.Duration
+	between   []int // minutes since midnight: from, to
+	weekdays  map[time.Weekday]bool
+}
+
+var dateSpecOptions = []string{"source", "timezone", "older_than", "newer_than", "between", "weekdays"}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// isDateSpec reports whether a pattern map of the date header describes a date condition like {older_than: 30d} instead of a header pattern.
+func isDateSpec(spec map[string]interface{}) bool {
+	for key := range spec {
+		if contains(dateSpecOptions, strings.ToLower(key)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileDateCondition(spec map[string]interface{}) (matcher, error) {
+	condition := dateMatcher{spec: fmt.Sprint(spec), source: dateSourceHeader, location: time.Local}
+
+	for key, val := range spec {
+		key = strings.ToLower(key)
+
+		if !contains(dateSpecOptions, key) {
+			return nil, fmt.Errorf("date option %q is unsupported", key)
+		}
+
+		var err error
+
+		switch key {
+		case "source":
+			source, ok := val.(string)
+			if !ok || (strings.ToLower(source) != dateSourceHeader && strings.ToLower(source) != dateSourceInternalDate) {
+				return nil, fmt.Errorf("date source must be either %q or %q", dateSourceHeader, dateSourceInternalDate)
+			}
+
+			condition.source = strings.ToLower(source)
+		case "timezone":
+			name, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported timezone type %v", reflect.TypeOf(val))
+			}
+
+			if condition.location, err = time.LoadLocation(name); err != nil {
+				return nil, err
+			}
+		case "older_than":
+			if condition.olderThan, err = parseAge(val); err != nil {
+				return nil, fmt.Errorf("older_than: %v", err)
+			}
+		case "newer_than":
+			if condition.newerThan, err = parseAge(val); err != nil {
+				return nil, fmt.Errorf("newer_than: %v", err)
+			}
+		case "between":
+			if condition.between, err = parseTimeOfDayRange(val); err != nil {
+				return nil, fmt.Errorf("between: %v", err)
+			}
+		case "weekdays":
+			if condition.weekdays, err = parseWeekdays(val); err != nil {
+				return nil, fmt.Errorf("weekdays: %v", err)
+			}
+		}
+	}
+
+	return condition, nil
+}
+
+// All configured date constraints need to hold. Messages without a valid date never match.
+func (condition dateMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("date")
+
+	date := msg.Date
+	if condition.source == dateSourceInternalDate {
+		date = msg.InternalDate
+	}
+
+	if !date.IsZero() {
+		trace.decide(condition.spec, date.In(condition.location).Format(time.RFC3339))
+	}
+
+	if date.IsZero() {
+		return false, nil
+	}
+
+	date = date.In(condition.location)
+	age := time.Since(date)
+
+	if condition.olderThan > 0 && age <= condition.olderThan {
+		return false, nil
+	}
+
+	if condition.newerThan > 0 && age >= condition.newerThan {
+		return false, nil
+	}
+
+	if condition.between != nil {
+		minutes := date.Hour()*60 + date.Minute()
+		from, to := condition.between[0], condition.between[1]
+
+		if from <= to && (minutes < from || minutes >= to) {
+			return false, nil
+		}
+
+		// time range wraps around midnight like 22:00-06:00
+		if from > to && minutes < from && minutes >= to {
+			return false, nil
+		}
+	}
+
+	if condition.weekdays != nil && !condition.weekdays[date.Weekday()] {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// parseAge parses Go durations like 36h as well as days (30d) and weeks (2w).
+func parseAge(val interface{}) (time.Duration, error) {
+	s, ok := val.(string)
+	if !ok {
+		return 0, fmt.Errorf("unsupported duration type %v", reflect.TypeOf(val))
+	}
+
+	s = strings.TrimSpace(strings.ToLower(s))
+
+	var age time.Duration
+	var err error
+
+	switch {
+	case strings.HasSuffix(s, "d"), strings.HasSuffix(s, "w"):
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+
+		age = time.Duration(n) * 24 * time.Hour
+		if strings.HasSuffix(s, "w") {
+			age *= 7
+		}
+	default:
+		if age, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+
+	if age <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+
+	return age, nil
+}
+
+func parseTimeOfDayRange(val interface{}) ([]int, error) {
+	values, err := parseStringList(val)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) != 2 {
+		return nil, fmt.Errorf("expected a start and an end time like [22:00, 06:00]")
+	}
+
+	var minutes []int
+	for _, v := range values {
+		t, err := time.Parse("15:04", strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time of day %q", v)
+		}
+
+		minutes = append(minutes, t.Hour()*60+t.Minute())
+	}
+
+	return minutes, nil
+}
+
+func parseWeekdays(val interface{}) (map[time.Weekday]bool, error) {
+	values, err := parseStringList(val)
+	if err != nil {
+		return nil, err
+	}
+
+	weekdays := map[time.Weekday]bool{}
+	for _, v := range values {
+		weekday, ok := weekdayNames[strings.ToLower(strings.TrimSpace(v))]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q", v)
+		}
+
+		weekdays[weekday] = true
+	}
+
+	if len(weekdays) == 0 {
+		return nil, fmt.Errorf("no weekdays given")
+	}
+
+	return weekdays, nil
+}
+
+func parseStringList(val interface{}) ([]string, error) {
+	var values []string
+
+	switch v := val.(type) {
+	case string:
+		values = append(values, v)
+	case []string:
+		values = v
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported value type %v", reflect.TypeOf(item))
+			}
+
+			values = append(values, s)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value type %v", reflect.TypeOf(val))
+	}
+
+	return values, nil
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
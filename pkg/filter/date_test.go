@@ -0,0 +1,86 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDateConditions(t *testing.T) {
+	require := require.New(t)
+
+	newTestMessage := func(date time.Time, internalDate time.Time) *server.Message {
+		headers := server.MessageHeaders{"date": strings.ToLower(date.String())}
+		if date.IsZero() {
+			headers = server.MessageHeaders{}
+		}
+
+		return server.NewMessage(&imapUtil.Message{Envelope: &imapUtil.Envelope{Date: date}, InternalDate: internalDate}, headers)
+	}
+
+	oldFriday := newTestMessage(time.Date(2015, 6, 26, 7, 43, 20, 0, time.UTC), time.Now().Add(-time.Hour))
+	oldSaturdayNight := newTestMessage(time.Date(2020, 1, 4, 23, 30, 0, 0, time.UTC), time.Date(2020, 1, 4, 23, 31, 0, 0, time.UTC))
+	recent := newTestMessage(time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	undated := newTestMessage(time.Time{}, time.Time{})
+
+	// ACTUAL TESTS BELOW
+
+	dateConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+	}{
+		{filterName: "older than 30 days", msg: oldFriday, matchExpected: true},
+		{filterName: "older than 30 days", msg: recent, matchExpected: false},
+		{filterName: "older than 30 days", msg: undated, matchExpected: false},
+		{filterName: "newer than 2 hours by internaldate", msg: oldFriday, matchExpected: true},
+		{filterName: "newer than 2 hours by internaldate", msg: oldSaturdayNight, matchExpected: false},
+		{filterName: "sent at night", msg: oldSaturdayNight, matchExpected: true},
+		{filterName: "sent at night", msg: oldFriday, matchExpected: false},
+		{filterName: "sent after midnight in berlin", msg: oldSaturdayNight, matchExpected: true},
+		{filterName: "sent after midnight in berlin", msg: oldFriday, matchExpected: false},
+		{filterName: "sent on a weekend", msg: oldSaturdayNight, matchExpected: true},
+		{filterName: "sent on a weekend", msg: oldFriday, matchExpected: false},
+		{filterName: "not sent on a weekend", msg: oldFriday, matchExpected: true},
+		{filterName: "date header pattern", msg: oldFriday, matchExpected: true},
+		{filterName: "date header pattern", msg: oldSaturdayNight, matchExpected: false},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestDateConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+
+	for i, test := range dateConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed: date=%v internalDate=%v", i+1, test.filterName, test.msg.Date, test.msg.InternalDate)
+	}
+
+	// Invalid date conditions
+	invalidDateConditionTests := []struct {
+		spec map[string]interface{}
+		err  string
+	}{
+		{spec: map[string]interface{}{"older_than": "soon"}, err: `rule #1: condition "date": older_than: time: invalid duration "soon"`},
+		{spec: map[string]interface{}{"newer_than": "-3d"}, err: `rule #1: condition "date": newer_than: duration "-3d" must be positive`},
+		{spec: map[string]interface{}{"older_than": "3d", "timezone": "Mars/Olympus_Mons"}, err: `rule #1: condition "date": unknown time zone Mars/Olympus_Mons`},
+		{spec: map[string]interface{}{"weekdays": []interface{}{"sat", "funday"}}, err: `rule #1: condition "date": weekdays: unknown weekday "funday"`},
+		{spec: map[string]interface{}{"between": []interface{}{"22:00"}}, err: `rule #1: condition "date": between: expected a start and an end time like [22:00, 06:00]`},
+		{spec: map[string]interface{}{"between": []interface{}{"22:00", "25:00"}}, err: `rule #1: condition "date": between: invalid time of day "25:00"`},
+		{spec: map[string]interface{}{"source": "arrival"}, err: `rule #1: condition "date": date source must be either "header" or "internaldate"`},
+		{spec: map[string]interface{}{"older_than": "3d", "regex": "2015"}, err: `rule #1: condition "date": date option "regex" is unsupported`},
+	}
+
+	for _, test := range invalidDateConditionTests {
+		_, err := filter.CompileRuleSet(filter.RuleSet{{"and": []map[string]interface{}{{"date": test.spec}}}})
+		require.EqualError(err, test.err)
+	}
+}
@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	"github.com/arnisoph/postisto/pkg/server"
+)
+
+type duplicateMatcher struct {
+	found      bool
+	duplicates *server.DuplicateIndex
+}
+
+// compileDuplicateCondition compiles conditions like {duplicate: true} or {duplicate: false}.
+// They match if an earlier copy of the message is found in its mailbox or the mailboxes searched for duplicates.
+func compileDuplicateCondition(patternValues interface{}, duplicates *server.DuplicateIndex) (matcher, error) {
+	if duplicates == nil {
+		return nil, fmt.Errorf("duplicates can only be looked up if duplicates are configured for the account")
+	}
+
+	found, ok := patternValues.(bool)
+	if !ok {
+		return nil, fmt.Errorf("duplicate requires true or false")
+	}
+
+	return duplicateMatcher{found: found, duplicates: duplicates}, nil
+}
+
+// duplicate looks up an earlier copy of the message
+func (condition duplicateMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("duplicate")
+
+	original, err := condition.duplicates.Lookup(msg)
+	if err != nil {
+		return false, err
+	}
+
+	value := ""
+	if original != nil {
+		value = fmt.Sprintf("%v uid %v", original.Mailbox, original.UID)
+	}
+
+	trace.decide(fmt.Sprint(condition.found), value)
+
+	return (original != nil) == condition.found, nil
+}
+
+// resolveDedupe applies the dedupe action if the message is an extra copy of an earlier message and drops it otherwise, so that
+// only the other commands are run. Deleting drops the other commands, flagging and moving are merged with them. Duplicates are flagged
+// instead of deleted if the server doesn't support UIDPLUS, so that a single message doesn't stop the filter engine.
+func resolveDedupe(srv *server.Connection, msg *server.Message, cmds Commands) (Commands, error) {
+	if cmds.Dedupe == "" {
+		return cmds, nil
+	}
+
+	action := cmds.Dedupe
+	cmds.Dedupe = ""
+
+	if srv.Duplicates == nil {
+		return Commands{}, fmt.Errorf("dedupe requires duplicates to be configured for the account")
+	}
+
+	original, err := srv.Duplicates.Lookup(msg)
+	if err != nil {
+		return Commands{}, err
+	}
+
+	if original == nil {
+		log.Debugw("Message isn't a duplicate, skipping dedupe", "uid", msg.RawMessage.Uid)
+		return cmds, nil
+	}
+
+	log.Infow("Message is a duplicate, applying dedupe action", "uid", msg.RawMessage.Uid, "action", action, "original_mailbox", original.Mailbox, "original_uid", original.UID)
+
+	switch action {
+	case "delete":
+		uidPlus, err := srv.SupportsUIDPlus()
+		if err != nil {
+			return Commands{}, err
+		}
+
+		if uidPlus {
+			return Commands{Dedupe: action}, nil
+		}
+
+		log.Infow("Warning: server doesn't support UIDPLUS, flagging the duplicate instead of deleting it", "uid", msg.RawMessage.Uid, "server", srv.Server)
+		return MergeCommands(cmds, Commands{AddFlags: []string{server.DuplicateFlag}}), nil
+	case "flag":
+		return MergeCommands(cmds, Commands{AddFlags: []string{server.DuplicateFlag}}), nil
+	case "move":
+		return MergeCommands(cmds, Commands{Move: srv.Duplicates.Target}), nil
+	}
+
+	return Commands{}, fmt.Errorf("dedupe action %q is unsupported", action)
+}
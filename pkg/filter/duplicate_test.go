@@ -0,0 +1,133 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	"github.com/arnisoph/postisto/test/integration"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDuplicateConditions(t *testing.T) {
+	require := require.New(t)
+
+	duplicates, err := server.NewDuplicateIndex(nil, nil, false, 0, "")
+	require.NoError(err)
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestDuplicateConditions.yaml")
+	require.NoError(err)
+
+	index := cfg.Accounts["duplicates"].Connection.Duplicates
+	require.Equal([]string{"Lists/*"}, index.Mailboxes)
+	require.Equal([]string{"from", "subject"}, index.Headers)
+	require.Equal(48*time.Hour, index.Window)
+	require.Equal("Dupes", index.Target)
+	require.Len(cfg.Filters["duplicates"], 3)
+	require.Equal("flag", cfg.Filters["duplicates"]["flag copies"].Commands.Dedupe)
+
+	// Duplicates are looked up on the server
+	msg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "jane <jane@example.com>", "subject": "hello"})
+	_, err = cfg.Filters["duplicates"]["cross-posts"].Match(msg)
+	require.EqualError(err, "duplicates can't be looked up without a server connection")
+
+	// Defaults
+	cfg, err = config.NewConfigFromFile("../../test/data/configs/valid/test/TestDuplicateDefaults.yaml")
+	require.NoError(err)
+
+	index = cfg.Accounts["duplicates"].Connection.Duplicates
+	require.Empty(index.Headers)
+	require.Equal(server.DefaultDuplicateWindow, index.Window)
+	require.Equal("Duplicates", index.Target)
+
+	// Invalid duplicate conditions
+	invalidDuplicateConditionTests := []struct {
+		spec       interface{}
+		duplicates *server.DuplicateIndex
+		err        string
+	}{
+		{spec: true, err: `rule #1: condition "duplicate": duplicates can only be looked up if duplicates are configured for the account`},
+		{spec: "message-id", duplicates: duplicates, err: `rule #1: condition "duplicate": duplicate requires true or false`},
+	}
+
+	for i, test := range invalidDuplicateConditionTests {
+		ruleSet := filter.RuleSet{{"and": []map[string]interface{}{{"duplicate": test.spec}}}}
+		_, err := filter.CompileRuleSetWithOptions(ruleSet, filter.CompileOptions{Duplicates: test.duplicates})
+		require.EqualError(err, test.err, "Test #%v", i+1)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	require := require.New(t)
+
+	testContainer := integration.NewTestContainer()
+	acc := integration.NewAccount(t, testContainer.IP, "", "test", testContainer.Imap, true, false, true, nil, testContainer.Redis)
+
+	require.NoError(acc.Connection.Connect())
+	defer func() {
+		require.Nil(acc.Connection.Disconnect())
+	}()
+
+	storePath := filepath.Join(t.TempDir(), "duplicates.json")
+	duplicates, err := server.NewDuplicateIndex([]string{"Lists-*"}, nil, false, 0, storePath)
+	require.NoError(err)
+	duplicates.Target = "Duplicates"
+	acc.Connection.Duplicates = duplicates
+
+	// log6 was filed already and arrives again, log1 arrives three times and log2 once
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log6.txt", "Lists-WebSummit", nil))
+	for _, file := range []string{"log1.txt", "log6.txt", "log1.txt", "log2.txt", "log1.txt"} {
+		require.NoError(acc.Connection.Upload(filepath.Join("../../test/data/mails", file), *acc.InputMailbox, nil))
+	}
+
+	dedupe := filter.Filter{
+		Commands: filter.Commands{Dedupe: "delete"},
+		RuleSet:  filter.RuleSet{{"and": []map[string]interface{}{{"duplicate": true}}}},
+	}
+	require.NoError(dedupe.CompileWithOptions(filter.CompileOptions{Duplicates: duplicates}))
+
+	// ACTUAL TESTS BELOW
+
+	require.NoError(filter.EvaluateFilterSetsOnMsgs(&acc.Connection, *acc.InputMailbox, []string{imapUtil.SeenFlag, imapUtil.FlaggedFlag}, *acc.FallbackMailbox, filter.FilterSet{"dedupe": dedupe}))
+
+	// Only the first copy of log1 and log2 are left and flagged by the fallback
+	uids, err := acc.Connection.Search(*acc.InputMailbox, nil, nil)
+	require.NoError(err)
+	require.ElementsMatch([]uint32{1, 4}, uids)
+
+	uids, err = acc.Connection.Search("Lists-WebSummit", nil, nil)
+	require.NoError(err)
+	require.Len(uids, 1)
+
+	// The keys of the indexed messages are stored
+	data, err := os.ReadFile(storePath)
+	require.NoError(err)
+	require.Contains(string(data), `"key":"message-id"`)
+	require.Contains(string(data), "72ea803c0b6343e6860e74e31af8437f.mai@jagbros.in")
+
+	// Copies arriving later are flagged or moved
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log2.txt", *acc.InputMailbox, nil))
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log1.txt", *acc.InputMailbox, nil))
+
+	dedupe.Commands = filter.Commands{Dedupe: "flag", AddFlags: []string{"$Copy"}}
+	require.NoError(filter.EvaluateFilterSetsOnMsgs(&acc.Connection, *acc.InputMailbox, []string{imapUtil.SeenFlag, imapUtil.FlaggedFlag}, *acc.FallbackMailbox, filter.FilterSet{"dedupe": dedupe}))
+
+	uids, err = acc.Connection.Search(*acc.InputMailbox, []string{server.DuplicateFlag, "$Copy"}, nil)
+	require.NoError(err)
+	require.Len(uids, 2)
+
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log1.txt", *acc.InputMailbox, nil))
+
+	dedupe.Commands = filter.Commands{Dedupe: "move"}
+	require.NoError(filter.EvaluateFilterSetsOnMsgs(&acc.Connection, *acc.InputMailbox, []string{imapUtil.SeenFlag, imapUtil.FlaggedFlag, server.DuplicateFlag}, *acc.FallbackMailbox, filter.FilterSet{"dedupe": dedupe}))
+
+	uids, err = acc.Connection.Search("Duplicates", nil, nil)
+	require.NoError(err)
+	require.Len(uids, 1)
+}
@@ -7,31 +7,191 @@ import (
 	"sort"
 )
 
-//func (filterSet FilterSet) Names() []string {
-//	keys := make([]string, len(filterSet))
-//
-//	var i uint64
-//	for key, _ := range filterSet {
-//		keys[i] = key
-//		i++
-//	}
-//
-//	return keys
-//}
+// FilterSet contains the filters of an account by name. In YAML it is either a map or an ordered list of filters with a name each.
+type FilterSet map[string]Filter
 
 type Filter struct {
-	Commands FilterOps `yaml:"commands,flow"`
-	RuleSet  RuleSet   `yaml:"rules"`
+	Commands Commands `yaml:"commands,flow"`
+	RuleSet  RuleSet  `yaml:"rules"`
+	Continue bool     `yaml:"continue,omitempty"` // evaluate the following filters after a match instead of stopping
+	Priority *int     `yaml:"priority,omitempty"` // filters with lower priority are evaluated first, the default is 0
+	Position Position `yaml:"-"`
+
+	matcher      *RuleSetMatcher
+	moveTemplate *moveTemplate
+}
+
+// Names returns the filter names in evaluation order: by priority first, then by name.
+func (filterSet FilterSet) Names() []string {
+	names := make([]string, 0, len(filterSet))
+	for name := range filterSet {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := filterSet[names[i]].priority(), filterSet[names[j]].priority()
+		if pi != pj {
+			return pi < pj
+		}
+
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+// DeletesDuplicates returns whether any filter deletes extra copies of messages with dedupe: delete, which requires a server that supports UIDPLUS.
+func (filterSet FilterSet) DeletesDuplicates() bool {
+	for _, filterConfig := range filterSet {
+		if filterConfig.Commands.Dedupe == "delete" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AmbiguousNames returns groups of filters that share a priority which was set explicitly for at least one of them. They are only ordered by their names.
+func (filterSet FilterSet) AmbiguousNames() [][]string {
+	var ambiguous [][]string
+	var group []string
+	explicit := false
+
+	names := filterSet.Names()
+	for i, name := range names {
+		group = append(group, name)
+		explicit = explicit || filterSet[name].Priority != nil
+
+		if i+1 < len(names) && filterSet[names[i+1]].priority() == filterSet[name].priority() {
+			continue
+		}
+
+		if len(group) > 1 && explicit {
+			ambiguous = append(ambiguous, group)
+		}
+
+		group = nil
+		explicit = false
+	}
+
+	return ambiguous
+}
+
+func (filter Filter) priority() int {
+	if filter.Priority == nil {
+		return 0
+	}
+
+	return *filter.Priority
 }
-type FilterOps map[string]interface{}
+
 type RuleSet []Rule
 type Rule map[string][]map[string]interface{}
 
+// Compile pre-compiles the rule set of the filter so that it isn't parsed again for every message.
+func (filter *Filter) Compile() error {
+	return filter.CompileWithOptions(CompileOptions{})
+}
+
+// CompileWithOptions works like Compile but takes the account specific settings that some conditions depend on.
+func (filter *Filter) CompileWithOptions(opts CompileOptions) error {
+	matcher, err := CompileRuleSetWithOptions(filter.RuleSet, opts)
+	if err != nil {
+		return err
+	}
+
+	filter.matcher = matcher
+
+	// Move targets with templates are checked right away so that typos don't show up only once a message matches
+	filter.moveTemplate = nil
+	if isTemplate(filter.Commands.Move) {
+		if filter.moveTemplate, err = compileMoveTemplate(filter.Commands.Move, matcher); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compileMoveTemplate(move string, matcher *RuleSetMatcher) (*moveTemplate, error) {
+	tmpl, err := parseMoveTemplate(move)
+	if err != nil {
+		return nil, fmt.Errorf("command \"move\": %v", err)
+	}
+
+	captureNames := matcher.captureNames()
+	for _, name := range tmpl.captureNames() {
+		if !contains(captureNames, name) {
+			return nil, fmt.Errorf("command \"move\": %q isn't a named capture like (?P<%v>...) of a regular expression in the rules", name, name)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// RenderCommands returns the commands of the filter for a matching message with the templates of the move target filled in.
+// The captures are the ones recorded while the filter matched the message, see MatchWithCaptures and Trace.Captures.
+// Template values are sanitised for the hierarchy delimiter of the server, so that they can't create deeper mailboxes.
+func (filter Filter) RenderCommands(msg *server.Message, captures map[string]string, delimiter string) (Commands, error) {
+	if filter.matcher == nil {
+		if err := filter.Compile(); err != nil {
+			return Commands{}, err
+		}
+	}
+
+	if filter.moveTemplate == nil {
+		return filter.Commands, nil
+	}
+
+	cmds := filter.Commands
+	cmds.Move = filter.moveTemplate.render(msg, captures, delimiter)
+
+	return cmds, nil
+}
+
+// Match evaluates the filter's rule set against the message. Filters that haven't been compiled yet are compiled on the fly.
+func (filter Filter) Match(msg *server.Message) (bool, error) {
+	if filter.matcher == nil {
+		if err := filter.Compile(); err != nil {
+			return false, err
+		}
+	}
+
+	return filter.matcher.Match(msg)
+}
+
+// MatchWithCaptures works like Match but also returns the named captures of the regular expressions in the matching rule for RenderCommands.
+func (filter Filter) MatchWithCaptures(msg *server.Message) (bool, map[string]string, error) {
+	if filter.matcher == nil {
+		if err := filter.Compile(); err != nil {
+			return false, nil, err
+		}
+	}
+
+	return filter.matcher.MatchWithCaptures(msg)
+}
+
+// Explain works like Match but also returns a trace of the evaluation. The trace is named after the filter by the caller.
+func (filter Filter) Explain(msg *server.Message) (*Trace, error) {
+	if filter.matcher == nil {
+		if err := filter.Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return filter.matcher.Explain(msg)
+}
+
+// hasTemplates reports whether the commands of the filter need to be rendered for each message
+func (filter Filter) hasTemplates() bool {
+	return isTemplate(filter.Commands.Move)
+}
+
 func GetUnsortedMsgs(srv *server.Connection, mailbox string, withoutFlags []string) ([]*server.Message, error) {
 	return srv.SearchAndFetch(mailbox, nil, withoutFlags)
 }
 
-func EvaluateFilterSetsOnMsgs(srv *server.Connection, inputMailbox string, inputWithoutFlags []string, fallbackMailbox string, filterSet map[string]Filter) error {
+func EvaluateFilterSetsOnMsgs(srv *server.Connection, inputMailbox string, inputWithoutFlags []string, fallbackMailbox string, filterSet FilterSet) error {
 
 	var remainingMsgs []*server.Message
 	msgs, err := GetUnsortedMsgs(srv, inputMailbox, inputWithoutFlags)
@@ -39,25 +199,38 @@ func EvaluateFilterSetsOnMsgs(srv *server.Connection, inputMailbox string, input
 		return err
 	}
 
+	keys := filterSet.Names()
+
 	for _, msg := range msgs {
 		var matched bool
+		var matchedFilters []string
+		var matchedCmds []Commands
 
 		log.Infow("Found new message in input mailbox to sort", "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId)
 
 		log.Debugw("Starting to filter message", "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId)
 
-		// sort filter map by key
-		keys := make([]string, 0, len(filterSet))
-		for k := range filterSet {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-
 		for _, filterName := range keys {
 			filterConfig := filterSet[filterName]
+			var captures map[string]string
 
-			log.Debugw(fmt.Sprintf("Evaluate filter %q against message headers", filterName), "uid", msg.RawMessage.Uid, "ruleSet", filterConfig.RuleSet)
-			matched, err = ParseRuleSet(filterConfig.RuleSet, msg.Headers)
+			if log.DebugEnabled() {
+				// Explain why the filter matched or not. This is more expensive, so only do it when it gets logged.
+				var trace *Trace
+				trace, err = filterConfig.Explain(msg)
+				if err != nil {
+					return err
+				}
+
+				trace.Filter = filterName
+				matched = trace.Matched
+				captures = trace.Captures
+				log.Debugw(fmt.Sprintf("Evaluated filter %q against message", filterName), "uid", msg.RawMessage.Uid, "matched", matched, "path", trace.Path(), "trace", trace)
+			} else if filterConfig.hasTemplates() {
+				matched, captures, err = filterConfig.MatchWithCaptures(msg)
+			} else {
+				matched, err = filterConfig.Match(msg)
+			}
 
 			if err != nil {
 				return err
@@ -67,22 +240,68 @@ func EvaluateFilterSetsOnMsgs(srv *server.Connection, inputMailbox string, input
 				continue
 			}
 
-			log.Infow("IT'S A MATCH! Apply commands to message via IMAP..", "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId, "cmd", filterConfig.Commands)
-			err = RunCommands(srv, inputMailbox, msg.RawMessage.Uid, filterConfig.Commands)
-			if err != nil {
-				log.Errorw("Failed to run command on matched message", err, "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId, "cmd", filterConfig.Commands)
-				return err
+			cmds := filterConfig.Commands
+			if filterConfig.hasTemplates() {
+				var delimiter string
+				if delimiter, err = srv.Delimiter(); err != nil {
+					return err
+				}
+
+				if cmds, err = filterConfig.RenderCommands(msg, captures, delimiter); err != nil {
+					return err
+				}
+			}
+
+			matchedFilters = append(matchedFilters, filterName)
+			matchedCmds = append(matchedCmds, cmds)
+
+			if !filterConfig.Continue {
+				break
 			}
 
-			break
+			log.Debugw(fmt.Sprintf("Filter %q matched, continuing with the next filters", filterName), "uid", msg.RawMessage.Uid)
 		}
 
-		if !matched {
+		matched = len(matchedFilters) > 0
+		if matched {
+			cmds := MergeCommands(matchedCmds...)
+			if cmds, err = resolveThreadMove(srv, msg, cmds); err != nil {
+				return err
+			}
+
+			if cmds, err = resolveDedupe(srv, msg, cmds); err != nil {
+				return err
+			}
+
+			log.Infow("IT'S A MATCH! Apply commands to message via IMAP..", "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId, "filters", matchedFilters, "cmd", cmds)
+			err = RunCommands(srv, inputMailbox, msg.RawMessage.Uid, cmds)
+			if err != nil {
+				log.Errorw("Failed to run command on matched message", err, "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId, "cmd", cmds)
+				return err
+			}
+
+			// Later replies to the message can be filed next to it without searching
+			if srv.Threads != nil && cmds.Move != "" {
+				srv.Threads.Add(msg.RawMessage.Envelope.MessageId, cmds.Move)
+			}
+		} else {
 			log.Debugw("No filter matched to this message, scheduling fallback action (flag/move)", "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId, "headers", msg.Headers)
 			remainingMsgs = append(remainingMsgs, msg)
 		}
 	}
 
+	if srv.Threads != nil {
+		if err := srv.Threads.Save(); err != nil {
+			log.Errorw("Failed to save thread cache", err)
+		}
+	}
+
+	if srv.Duplicates != nil {
+		if err := srv.Duplicates.Save(); err != nil {
+			log.Errorw("Failed to save duplicate store", err)
+		}
+	}
+
 	for _, msg := range remainingMsgs {
 		if fallbackMailbox == inputMailbox || fallbackMailbox == "" {
 			log.Infow("No filter matched to this message. Flagging the message now.", "uid", msg.RawMessage.Uid, "message_id", msg.RawMessage.Envelope.MessageId, "flags", []interface{}{server.FlaggedFlag})
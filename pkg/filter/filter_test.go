@@ -120,6 +120,12 @@ func TestEvaluateFilterSetsOnMails(t *testing.T) {
 				{name: "Trash", num: 3, flags: []string{imap.SeenFlag}},
 			},
 		},
+		{ // #10
+			mailsToUpload: []int{1, 2, 3},
+			targets: []targetStruct{
+				{name: "MyTarget", num: 3, flags: []string{imap.SeenFlag}},
+			},
+		},
 	}
 
 	for testNum, test := range tests {
@@ -247,3 +253,54 @@ func TestEvaluateFilterSetsOnMails(t *testing.T) {
 		require.Nil(acc.Connection.Disconnect(), debugInfo)
 	}
 }
+
+func TestFilterSet_Names(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestFilterSet_Names.yaml")
+	require.NoError(err)
+
+	// Explicit priorities, ties are broken by name
+	filters := cfg.Filters["priorities"]
+	require.Equal([]string{"b-first", "c-default", "f-default", "d-tie", "e-tie", "a-last"}, filters.Names())
+	require.Equal([][]string{{"d-tie", "e-tie"}}, filters.AmbiguousNames())
+
+	// Ordered list form
+	filters = cfg.Filters["ordered"]
+	require.Equal([]string{"zz-first", "explicit", "mm-second", "aa-third"}, filters.Names())
+	require.Equal([][]string{{"explicit", "mm-second"}}, filters.AmbiguousNames())
+	require.Equal("Third", filters["aa-third"].Commands.Move)
+
+	// Without any priorities filters are ordered by name like before
+	filters = filter.FilterSet{"b": {}, "a": {}, "c": {}}
+	require.Equal([]string{"a", "b", "c"}, filters.Names())
+	require.Empty(filters.AmbiguousNames())
+
+	// Invalid lists
+	_, err = config.NewConfigFromFile("../../test/data/configs/invalid/TestFilterSet_Names/duplicate-names.yaml")
+	require.EqualError(err, "../../test/data/configs/invalid/TestFilterSet_Names/duplicate-names.yaml:5: filter \"first\" is defined more than once")
+
+	_, err = config.NewConfigFromFile("../../test/data/configs/invalid/TestFilterSet_Names/missing-name.yaml")
+	require.EqualError(err, "../../test/data/configs/invalid/TestFilterSet_Names/missing-name.yaml:5: filter #2 has no name")
+}
+
+func TestFilterSet_DeletesDuplicates(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	deletesDuplicatesTests := []struct {
+		filters  filter.FilterSet
+		expected bool
+	}{
+		{filters: filter.FilterSet{}, expected: false},
+		{filters: filter.FilterSet{"a": {Commands: filter.Commands{Move: "A"}}, "b": {Commands: filter.Commands{Dedupe: "flag"}}}, expected: false},
+		{filters: filter.FilterSet{"a": {Commands: filter.Commands{Move: "A"}}, "b": {Commands: filter.Commands{Dedupe: "delete"}}}, expected: true},
+	}
+
+	for i, test := range deletesDuplicatesTests {
+		require.Equal(test.expected, test.filters.DeletesDuplicates(), "Test #%v", i+1)
+	}
+}
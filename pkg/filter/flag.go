@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
+)
+
+type flagMatcher struct {
+	keywordsOnly bool
+	patterns     []compiledPattern
+}
+
+// compileFlagCondition compiles conditions like {flag: '\Flagged'} or {keyword: '$Junk'}. Flags are case-insensitive and plain strings have to match exactly.
+func compileFlagCondition(patternValues interface{}, keywordsOnly bool) (matcher, error) {
+	parsedValues, err := parsePatternValues(patternValues)
+	if err != nil {
+		return nil, err
+	}
+
+	condition := flagMatcher{keywordsOnly: keywordsOnly}
+	for _, p := range parsedValues {
+		switch p.mode {
+		case MatchModeAuto:
+			p.mode = MatchModeExact
+		case MatchModeNumeric:
+			return nil, fmt.Errorf("numeric comparisons are unsupported")
+		}
+
+		if keywordsOnly && p.mode == MatchModeExact && strings.HasPrefix(p.value, `\`) {
+			return nil, fmt.Errorf("%q is a system flag, not a keyword", p.value)
+		}
+
+		compiled, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", p.value, err)
+		}
+
+		condition.patterns = append(condition.patterns, compiled)
+	}
+
+	return condition, nil
+}
+
+// flag matches if the message has any flag matching any pattern
+func (condition flagMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	if condition.keywordsOnly {
+		trace.condition("keyword")
+	} else {
+		trace.condition("flag")
+	}
+
+	for _, flag := range msg.Flags {
+		if condition.keywordsOnly && strings.HasPrefix(flag, `\`) {
+			continue
+		}
+
+		for _, p := range condition.patterns {
+			if p.match(strings.ToLower(flag)) {
+				trace.decide(p.String(), flag)
+				return true, nil
+			}
+		}
+	}
+
+	trace.decide("", strings.Join(msg.Flags, " "))
+
+	return false, nil
+}
@@ -0,0 +1,66 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFlagConditions(t *testing.T) {
+	require := require.New(t)
+
+	flaggedMsg := server.NewMessage(&imapUtil.Message{Flags: []string{imapUtil.SeenFlag, imapUtil.FlaggedFlag}}, server.MessageHeaders{})
+	junkMsg := server.NewMessage(&imapUtil.Message{Flags: []string{"$Junk", "$label1"}}, server.MessageHeaders{})
+	unflaggedMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{})
+
+	// ACTUAL TESTS BELOW
+
+	flagConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+	}{
+		{filterName: "is flagged", msg: flaggedMsg, matchExpected: true},
+		{filterName: "is flagged", msg: junkMsg, matchExpected: false},
+		{filterName: "is flagged", msg: unflaggedMsg, matchExpected: false},
+		{filterName: "is unseen", msg: flaggedMsg, matchExpected: false},
+		{filterName: "is unseen", msg: unflaggedMsg, matchExpected: true},
+		{filterName: "has keyword junk", msg: junkMsg, matchExpected: true},
+		{filterName: "has keyword junk", msg: flaggedMsg, matchExpected: false},
+		{filterName: "has any label keyword", msg: junkMsg, matchExpected: true},
+		{filterName: "keywords ignore system flags", msg: flaggedMsg, matchExpected: false},
+		{filterName: "keywords ignore system flags", msg: junkMsg, matchExpected: true},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestFlagConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+
+	for i, test := range flagConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed: flags=%v", i+1, test.filterName, test.msg.Flags)
+	}
+
+	// Invalid flag conditions
+	invalidFlagConditionTests := []struct {
+		key  string
+		spec interface{}
+		err  string
+	}{
+		{key: "keyword", spec: `\Seen`, err: `rule #1: condition "keyword": "\\Seen" is a system flag, not a keyword`},
+		{key: "flag", spec: map[string]interface{}{"ge": 1}, err: `rule #1: condition "flag": numeric comparisons are unsupported`},
+		{key: "flag", spec: true, err: `rule #1: condition "flag": unsupported value type bool`},
+	}
+
+	for _, test := range invalidFlagConditionTests {
+		_, err := filter.CompileRuleSet(filter.RuleSet{{"and": []map[string]interface{}{{test.key: test.spec}}}})
+		require.EqualError(err, test.err)
+	}
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+)
+
+// AddressList is a named list of addresses and domains like an address book or an allow/deny file.
+type AddressList interface {
+	// Contains reports whether the lowercased address or its domain is part of the list
+	Contains(address string) bool
+}
+
+// AddressLists are the address lists that rules can refer to by name.
+type AddressLists map[string]AddressList
+
+type listMatcher struct {
+	name     string
+	listName string
+	list     AddressList
+}
+
+// isListSpec reports whether a pattern map is a list lookup like {in_list: vip} instead of a header pattern.
+func isListSpec(patternValues interface{}) bool {
+	spec, ok := patternValues.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	_, ok = spec["in_list"]
+	return ok
+}
+
+func compileListCondition(name string, patternValues interface{}, lists AddressLists) (matcher, error) {
+	spec := patternValues.(map[string]interface{})
+	if len(spec) != 1 {
+		return nil, fmt.Errorf("in_list can't be combined with other match modes")
+	}
+
+	listName, ok := spec["in_list"].(string)
+	if !ok {
+		return nil, fmt.Errorf("in_list requires a list name")
+	}
+
+	list, ok := lists[listName]
+	if !ok {
+		return nil, fmt.Errorf("list %q is not configured", listName)
+	}
+
+	return listMatcher{name: name, listName: listName, list: list}, nil
+}
+
+// in_list matches if any address of the header is part of the list
+func (condition listMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition(condition.name)
+
+	for _, addr := range msg.AddressList(condition.name) {
+		if addr.Address != "" && condition.list.Contains(addr.Address) {
+			trace.decide("in_list: "+condition.listName, addr.Address)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
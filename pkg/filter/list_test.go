@@ -0,0 +1,68 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestListConditions(t *testing.T) {
+	require := require.New(t)
+
+	newMsg := func(headers server.MessageHeaders) *server.Message {
+		return server.NewMessage(&imapUtil.Message{}, headers)
+	}
+
+	// ACTUAL TESTS BELOW
+
+	listConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+	}{
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "the boss <boss@example.com>"}), matchExpected: true},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "jane <jane.doe@example.org>"}), matchExpected: true},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "intern <intern@example.com>"}), matchExpected: false},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "boss@example.com.evil.test"}), matchExpected: false},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "someone@important.example"}), matchExpected: true},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "someone@mail.partner.example"}), matchExpected: true},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "someone@notpartner.example"}), matchExpected: false},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"from": "boss@example.com support <support@evil.test>"}), matchExpected: false},
+		{filterName: "from vip", msg: newMsg(server.MessageHeaders{"to": "boss@example.com"}), matchExpected: false},
+		{filterName: "vendor in cc", msg: newMsg(server.MessageHeaders{"from": "me@example.com", "cc": "a@b.c, billing@vendor.example"}), matchExpected: true},
+		{filterName: "vendor in cc", msg: newMsg(server.MessageHeaders{"from": "sales@another-vendor.example"}), matchExpected: true},
+		{filterName: "vendor in cc", msg: newMsg(server.MessageHeaders{"from": "not-an-address@vendor.example"}), matchExpected: false},
+		{filterName: "vendor but not vip", msg: newMsg(server.MessageHeaders{"from": "support@vendor.example"}), matchExpected: true},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestListConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+
+	for i, test := range listConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed: headers=%v", i+1, test.filterName, test.msg.Headers)
+	}
+
+	// Invalid list conditions
+	invalidListConditionTests := []struct {
+		spec interface{}
+		err  string
+	}{
+		{spec: map[string]interface{}{"in_list": "unknown"}, err: `rule #1: header "from": list "unknown" is not configured`},
+		{spec: map[string]interface{}{"in_list": 42}, err: `rule #1: header "from": in_list requires a list name`},
+		{spec: map[string]interface{}{"in_list": "vip", "regex": ".*"}, err: `rule #1: header "from": in_list can't be combined with other match modes`},
+	}
+
+	for _, test := range invalidListConditionTests {
+		_, err := filter.CompileRuleSet(filter.RuleSet{{"and": []map[string]interface{}{{"from": test.spec}}}})
+		require.EqualError(err, test.err)
+	}
+}
@@ -0,0 +1,143 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Macros are named rule fragments like {or: [{exists: list-unsubscribe}, {from:localpart: newsletter}]}.
+// Rules refer to them with the condition {macro: name}, macros may refer to other macros.
+type Macros map[string]Rule
+
+// Expand returns a copy of the rule set in which all macro references are replaced by the groups they stand for.
+func (macros Macros) Expand(ruleSet RuleSet) (RuleSet, error) {
+	var expanded RuleSet
+
+	for i, rule := range ruleSet {
+		expandedRule := Rule{}
+
+		for op, conditions := range rule {
+			expandedConditions, err := macros.expandConditions(conditions, nil)
+			if err != nil {
+				return nil, &RuleError{Rule: i + 1, Err: err}
+			}
+
+			expandedRule[op] = expandedConditions
+		}
+
+		expanded = append(expanded, expandedRule)
+	}
+
+	return expanded, nil
+}
+
+// UsedBy reports whether the rule set refers to any macro
+func (macros Macros) UsedBy(ruleSet RuleSet) bool {
+	for _, rule := range ruleSet {
+		for _, conditions := range rule {
+			if usesMacros(conditions) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// expandConditions expands the macros of a group's conditions. stack holds the names of the macros being expanded to detect cycles.
+func (macros Macros) expandConditions(conditions []map[string]interface{}, stack []string) ([]map[string]interface{}, error) {
+	var expanded []map[string]interface{}
+
+	for _, condition := range conditions {
+		expandedCondition := map[string]interface{}{}
+		var macroGroups []map[string]interface{}
+
+		for key, val := range condition {
+			switch {
+			case strings.ToLower(key) == "macro":
+				group, err := macros.expandMacro(val, stack)
+				if err != nil {
+					return nil, err
+				}
+
+				// each macro becomes a group of its own so that it can't collide with the other conditions
+				macroGroups = append(macroGroups, group)
+			case IsGroupOperator(strings.ToLower(key)):
+				nested, err := parseGroupPatterns(val)
+				if err != nil {
+					// reported with more context when the rule set is compiled
+					expandedCondition[key] = val
+					continue
+				}
+
+				if expandedCondition[key], err = macros.expandConditions(nested, stack); err != nil {
+					return nil, err
+				}
+			default:
+				expandedCondition[key] = val
+			}
+		}
+
+		if len(expandedCondition) > 0 {
+			expanded = append(expanded, expandedCondition)
+		}
+
+		expanded = append(expanded, macroGroups...)
+	}
+
+	return expanded, nil
+}
+
+func (macros Macros) expandMacro(val interface{}, stack []string) (map[string]interface{}, error) {
+	name, ok := val.(string)
+	if !ok {
+		return nil, fmt.Errorf("macro requires a macro name, not %v", val)
+	}
+
+	for i, parent := range stack {
+		if parent == name {
+			return nil, fmt.Errorf("macro %q refers to itself: %v", name, strings.Join(append(stack[i:], name), " -> "))
+		}
+	}
+
+	macro, ok := macros[name]
+	if !ok {
+		return nil, fmt.Errorf("macro %q is not defined", name)
+	}
+
+	if len(macro) != 1 {
+		return nil, fmt.Errorf("macro %q needs exactly one group operator like and, or or not", name)
+	}
+
+	group := map[string]interface{}{}
+	for op, conditions := range macro {
+		expanded, err := macros.expandConditions(conditions, append(stack, name))
+		if err != nil {
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("macro %q: %v", name, err)
+			}
+
+			return nil, err
+		}
+
+		group[op] = expanded
+	}
+
+	return group, nil
+}
+
+func usesMacros(conditions []map[string]interface{}) bool {
+	for _, condition := range conditions {
+		for key, val := range condition {
+			if strings.ToLower(key) == "macro" {
+				return true
+			}
+
+			if nested, err := parseGroupPatterns(val); err == nil && IsGroupOperator(strings.ToLower(key)) && usesMacros(nested) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
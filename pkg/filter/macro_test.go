@@ -0,0 +1,79 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMacros(t *testing.T) {
+	require := require.New(t)
+
+	macros := filter.Macros{
+		"list":      {"or": []map[string]interface{}{{"exists": "list-id"}, {"exists": "list-unsubscribe"}}},
+		"large":     {"and": []map[string]interface{}{{"size": map[string]interface{}{"gt": "5M"}}}},
+		"big list":  {"and": []map[string]interface{}{{"macro": "list"}, {"macro": "large"}}},
+		"two ops":   {"and": []map[string]interface{}{{"exists": "x"}}, "or": []map[string]interface{}{{"exists": "y"}}},
+		"self":      {"and": []map[string]interface{}{{"not": []interface{}{map[string]interface{}{"macro": "self"}}}}},
+		"undefined": {"and": []map[string]interface{}{{"macro": "nope"}}},
+	}
+	list := map[string]interface{}{"or": []map[string]interface{}{{"exists": "list-id"}, {"exists": "list-unsubscribe"}}}
+	large := map[string]interface{}{"and": []map[string]interface{}{{"size": map[string]interface{}{"gt": "5M"}}}}
+
+	// ACTUAL TESTS BELOW
+
+	expandTests := []struct {
+		ruleSet  filter.RuleSet
+		expanded filter.RuleSet
+		err      string
+	}{
+		{ // #1 rules without macros stay as they are
+			ruleSet:  filter.RuleSet{{"and": []map[string]interface{}{{"subject": "x"}}}},
+			expanded: filter.RuleSet{{"and": []map[string]interface{}{{"subject": "x"}}}},
+		},
+		{ // #2 macros become groups of their own next to the other conditions of the same pattern
+			ruleSet:  filter.RuleSet{{"and": []map[string]interface{}{{"subject": "x", "macro": "list"}}}},
+			expanded: filter.RuleSet{{"and": []map[string]interface{}{{"subject": "x"}, list}}},
+		},
+		{ // #3 nested groups and macros referring to macros
+			ruleSet:  filter.RuleSet{{"or": []map[string]interface{}{{"not": []interface{}{map[string]interface{}{"macro": "big list"}}}}}},
+			expanded: filter.RuleSet{{"or": []map[string]interface{}{{"not": []map[string]interface{}{{"and": []map[string]interface{}{list, large}}}}}}},
+		},
+		{ // #4
+			ruleSet: filter.RuleSet{{"and": []map[string]interface{}{{"macro": "nope"}}}},
+			err:     `rule #1: macro "nope" is not defined`,
+		},
+		{ // #5
+			ruleSet: filter.RuleSet{{"and": []map[string]interface{}{{"subject": "x"}}}, {"and": []map[string]interface{}{{"macro": "undefined"}}}},
+			err:     `rule #2: macro "undefined": macro "nope" is not defined`,
+		},
+		{ // #6
+			ruleSet: filter.RuleSet{{"and": []map[string]interface{}{{"macro": []interface{}{"list"}}}}},
+			err:     `rule #1: macro requires a macro name, not [list]`,
+		},
+		{ // #7
+			ruleSet: filter.RuleSet{{"and": []map[string]interface{}{{"macro": "two ops"}}}},
+			err:     `rule #1: macro "two ops" needs exactly one group operator like and, or or not`,
+		},
+		{ // #8
+			ruleSet: filter.RuleSet{{"and": []map[string]interface{}{{"macro": "self"}}}},
+			err:     `rule #1: macro "self": macro "self" refers to itself: self -> self`,
+		},
+	}
+
+	for i, test := range expandTests {
+		expanded, err := macros.Expand(test.ruleSet)
+		if test.err != "" {
+			require.EqualError(err, test.err, "Test #%v", i+1)
+			continue
+		}
+
+		require.NoError(err, "Test #%v", i+1)
+		require.Equal(test.expanded, expanded, "Test #%v", i+1)
+		require.Equal(i > 0, macros.UsedBy(test.ruleSet), "Test #%v", i+1)
+	}
+
+	// Macros that weren't expanded can't be compiled
+	_, err := filter.CompileRuleSet(filter.RuleSet{{"and": []map[string]interface{}{{"macro": "list"}}}})
+	require.EqualError(err, `rule #1: condition "macro": macros are only expanded when loading the config`)
+}
@@ -0,0 +1,171 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	"github.com/arnisoph/postisto/pkg/server"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultProgramTimeout is how long a program may run unless its config sets a timeout
+const DefaultProgramTimeout = 10 * time.Second
+
+// Program is an executable that program conditions pipe messages to. It decides by its exit code (0 matches, 1 doesn't) or by a JSON answer
+// like {"match": true, "reason": "known customer"} on stdout. Any other exit code, a timeout or an invalid answer is a failure.
+type Program struct {
+	Command []string      `yaml:"command"`  // executable and its arguments, not run by a shell
+	Input   string        `yaml:"input"`    // "headers" (default) or "message" to pipe the whole RFC822 message including attachments
+	Timeout time.Duration `yaml:"timeout"`  // the program is killed if it runs longer, default 10s
+	OnError string        `yaml:"on_error"` // "no_match" (default) or "match", what a failure of the program decides
+
+	initialized bool
+}
+
+// programAnswer is the JSON answer a program can print instead of deciding by exit code
+type programAnswer struct {
+	Match  *bool  `json:"match"`
+	Reason string `json:"reason"`
+}
+
+// Init checks the program config and sets the defaults. It has to be called before the program is run.
+func (program *Program) Init() error {
+	if len(program.Command) == 0 || strings.TrimSpace(program.Command[0]) == "" {
+		return fmt.Errorf("command not configured")
+	}
+
+	switch program.Input {
+	case "":
+		program.Input = "headers"
+	case "headers", "message":
+	default:
+		return fmt.Errorf("input %q is unsupported, expected headers or message", program.Input)
+	}
+
+	if program.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	} else if program.Timeout == 0 {
+		program.Timeout = DefaultProgramTimeout
+	}
+
+	switch program.OnError {
+	case "":
+		program.OnError = "no_match"
+	case "no_match", "match":
+	default:
+		return fmt.Errorf("on_error %q is unsupported, expected no_match or match", program.OnError)
+	}
+
+	program.initialized = true
+	return nil
+}
+
+// Run pipes the input to the program and returns its decision. The environment carries the account and the mailbox of the message as
+// POSTISTO_ACCOUNT and POSTISTO_MAILBOX. The reason is the one of a JSON answer or describes the exit code.
+func (program *Program) Run(input []byte, account string, mailbox string) (bool, string, error) {
+	if !program.initialized {
+		return false, "", fmt.Errorf("program isn't initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), program.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, program.Command[0], program.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), "POSTISTO_ACCOUNT="+account, "POSTISTO_MAILBOX="+mailbox)
+	cmd.WaitDelay = time.Second // don't wait for child processes that keep stdout open after the program was killed
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, "", fmt.Errorf("timed out after %v", program.Timeout)
+	}
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return false, "", err
+		}
+
+		exitCode = exitErr.ExitCode()
+	}
+
+	if exitCode != 0 && exitCode != 1 {
+		return false, "", fmt.Errorf("exited with code %v: %v", exitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	// A JSON answer overrides the exit code
+	if answer := bytes.TrimSpace(stdout.Bytes()); bytes.HasPrefix(answer, []byte("{")) {
+		var parsed programAnswer
+		if err := json.Unmarshal(answer, &parsed); err != nil {
+			return false, "", fmt.Errorf("failed to parse answer %q: %v", answer, err)
+		}
+
+		if parsed.Match == nil {
+			return false, "", fmt.Errorf("answer %q has no match field", answer)
+		}
+
+		return *parsed.Match, parsed.Reason, nil
+	}
+
+	return exitCode == 0, fmt.Sprintf("exit code %v", exitCode), nil
+}
+
+type programMatcher struct {
+	name    string
+	program *Program
+	account string
+}
+
+// compileProgramCondition compiles conditions like {program: crm-customer} that run a program configured under programs
+func compileProgramCondition(patternValues interface{}, programs map[string]*Program, account string) (matcher, error) {
+	name, ok := patternValues.(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("program requires the name of a configured program")
+	}
+
+	program, ok := programs[name]
+	if !ok {
+		return nil, fmt.Errorf("program %q isn't configured", name)
+	}
+
+	return programMatcher{name: name, program: program, account: account}, nil
+}
+
+// program pipes the header or the whole message to the program and lets it decide. A failing program doesn't stop the filter engine, it's
+// logged and decides as configured by on_error.
+func (condition programMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("program")
+
+	var input []byte
+	var err error
+	if condition.program.Input == "message" {
+		input, err = msg.RFC822()
+	} else {
+		input, err = msg.RawHeader()
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	matched, reason, err := condition.program.Run(input, condition.account, msg.Mailbox())
+	if err != nil {
+		matched = condition.program.OnError == "match"
+		reason = fmt.Sprintf("failed: %v", err)
+		log.Errorw("Program failed, deciding by on_error", err, "program", condition.name, "on_error", condition.program.OnError, "account", condition.account, "mailbox", msg.Mailbox())
+	}
+
+	trace.decide(condition.name, reason)
+
+	return matched, nil
+}
@@ -0,0 +1,116 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProgramConditions(t *testing.T) {
+	require := require.New(t)
+
+	newMsg := func(file string) *server.Message {
+		source, err := os.ReadFile(file)
+		require.NoError(err)
+
+		msg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{})
+		msg.SetRFC822(source)
+		return msg
+	}
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestProgramConditions.yaml")
+	require.NoError(err)
+
+	require.Equal("headers", cfg.Programs["youth4work"].Input)
+	require.Equal(filter.DefaultProgramTimeout, cfg.Programs["youth4work"].Timeout)
+	require.Equal("no_match", cfg.Programs["youth4work"].OnError)
+	require.Equal(5*time.Second, cfg.Programs["html-body"].Timeout)
+	require.Equal("match", cfg.Programs["broken"].OnError)
+
+	filters := cfg.Filters["programs"]
+
+	programTests := []struct {
+		msg      *server.Message
+		expected map[string]bool
+	}{
+		{msg: newMsg("../../test/data/mails/log1.txt"), expected: map[string]bool{"youth4work": true, "html": true, "account": true}},
+		{msg: newMsg("../../test/data/mails/log6.txt"), expected: map[string]bool{"youth4work": false, "html": false, "account": true}},
+	}
+
+	for i, test := range programTests {
+		for filterName, matchExpected := range test.expected {
+			matched, err := filters[filterName].Match(test.msg)
+			require.NoError(err, "Test #%v: filter %q", i+1, filterName)
+			require.Equal(matchExpected, matched, "Test #%v: filter %q", i+1, filterName)
+		}
+	}
+
+	// Only the header is piped unless the program asks for the whole message
+	headerOnly := newMsg("../../test/data/mails/log1.txt")
+	header, err := headerOnly.RawHeader()
+	require.NoError(err)
+	require.NotContains(string(header), "cellspacing")
+	require.Contains(string(header), "From: \"Youth4work\" <admin@youth4work.com>")
+
+	// The JSON answer and the environment show up in the trace
+	trace, err := filters["account"].Explain(headerOnly)
+	require.NoError(err)
+	require.True(trace.Matched)
+	require.Equal(&filter.TraceNode{Condition: "program", Matched: true, Pattern: "account", Value: "account programs"}, trace.Decision())
+
+	// Programs that time out or fail don't stop the filter engine, on_error decides instead
+	trace, err = filters["slow"].Explain(headerOnly)
+	require.NoError(err)
+	require.False(trace.Matched)
+	require.Equal(&filter.TraceNode{Condition: "program", Matched: false, Pattern: "slow", Value: "failed: timed out after 100ms"}, trace.Decision())
+
+	trace, err = filters["broken"].Explain(headerOnly)
+	require.NoError(err)
+	require.True(trace.Matched)
+	require.Equal(&filter.TraceNode{Condition: "program", Matched: true, Pattern: "broken", Value: "failed: exited with code 3: failed"}, trace.Decision())
+
+	// Messages without a header section can't be piped
+	_, err = filters["youth4work"].Match(server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{}))
+	require.EqualError(err, "message header wasn't fetched")
+
+	// Invalid program conditions
+	programs := map[string]*filter.Program{"crm": {Command: []string{"true"}}}
+	require.NoError(programs["crm"].Init())
+
+	invalidProgramConditionTests := []struct {
+		spec interface{}
+		err  string
+	}{
+		{spec: true, err: `rule #1: condition "program": program requires the name of a configured program`},
+		{spec: "", err: `rule #1: condition "program": program requires the name of a configured program`},
+		{spec: "erp", err: `rule #1: condition "program": program "erp" isn't configured`},
+	}
+
+	for i, test := range invalidProgramConditionTests {
+		ruleSet := filter.RuleSet{{"and": []map[string]interface{}{{"program": test.spec}}}}
+		_, err := filter.CompileRuleSetWithOptions(ruleSet, filter.CompileOptions{Programs: programs})
+		require.EqualError(err, test.err, "Test #%v", i+1)
+	}
+
+	// Invalid program configs
+	invalidProgramTests := []struct {
+		program filter.Program
+		err     string
+	}{
+		{program: filter.Program{}, err: "command not configured"},
+		{program: filter.Program{Command: []string{"true"}, Input: "body"}, err: `input "body" is unsupported, expected headers or message`},
+		{program: filter.Program{Command: []string{"true"}, Timeout: -time.Second}, err: "timeout must not be negative"},
+		{program: filter.Program{Command: []string{"true"}, OnError: "ignore"}, err: `on_error "ignore" is unsupported, expected no_match or match`},
+	}
+
+	for i, test := range invalidProgramTests {
+		require.EqualError(test.program.Init(), test.err, "Test #%v", i+1)
+	}
+}
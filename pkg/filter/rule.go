@@ -2,17 +2,112 @@ package filter
 
 import (
 	"fmt"
+	"github.com/arnisoph/postisto/pkg/classifier"
 	"github.com/arnisoph/postisto/pkg/server"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 )
 
+// RuleSetMatcher is the pre-compiled form of a RuleSet. It matches if any of its rules match.
+type RuleSetMatcher struct {
+	rules []matcher
+}
+
+type matcher interface {
+	// match evaluates the condition against the message. The named captures of matching regular expressions are added to captures
+	// and details about the decision are recorded in trace, unless they are nil.
+	match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error)
+}
+
+type groupMatcher struct {
+	op         string
+	conditions []matcher
+}
+
+type headerMatcher struct {
+	name     string
+	patterns []compiledPattern
+}
+
+type headerExistsMatcher struct {
+	names   []string
+	missing bool
+}
+
+// CompileOptions are the account specific settings that some conditions depend on.
+type CompileOptions struct {
+	Lists       AddressLists           // address lists for in_list conditions
+	AuthServIDs []string               // authserv-ids of the own mail servers whose authentication results are trusted
+	Threads     *server.ThreadIndex    // looks up the mailboxes of thread parents for thread conditions
+	Classifier  *classifier.Model      // predicts the mailbox of messages for classifier conditions
+	Programs    map[string]*Program    // programs that program conditions run, by name
+	Duplicates  *server.DuplicateIndex // looks up earlier copies of messages for duplicate conditions
+	Account     string                 // name of the account, passed to programs
+}
+
+// RuleError is a problem with a rule of a rule set. Rules are numbered from 1.
+type RuleError struct {
+	Rule int
+	Err  error
+}
+
+func (err *RuleError) Error() string {
+	return fmt.Sprintf("rule #%v: %v", err.Rule, err.Err)
+}
+
+func (err *RuleError) Unwrap() error {
+	return err.Err
+}
+
+type compiledPattern struct {
+	pattern
+	regEx *regexp.Regexp
+}
+
+// ParseRuleSet compiles the rule set and evaluates it against the message headers right away. Use CompileRuleSet for rule sets that are evaluated more than once.
 func ParseRuleSet(ruleSet RuleSet, headers server.MessageHeaders) (bool, error) {
+	ruleSetMatcher, err := CompileRuleSet(ruleSet)
+	if err != nil {
+		return false, err
+	}
+
+	return ruleSetMatcher.Match(&server.Message{Headers: headers})
+}
+
+// CompileRuleSet checks the whole rule tree for unsupported operators, empty groups and bad patterns and compiles it into a RuleSetMatcher.
+func CompileRuleSet(ruleSet RuleSet) (*RuleSetMatcher, error) {
+	return CompileRuleSetWithOptions(ruleSet, CompileOptions{})
+}
+
+// CompileRuleSetWithOptions works like CompileRuleSet but takes the account specific settings that some conditions depend on.
+func CompileRuleSetWithOptions(ruleSet RuleSet, opts CompileOptions) (*RuleSetMatcher, error) {
+	ruleSetMatcher := &RuleSetMatcher{}
+
+	for i, rule := range ruleSet {
+		if len(rule) != 1 {
+			return nil, &RuleError{Rule: i + 1, Err: fmt.Errorf("rule must have exactly one operator, got %v", len(rule))}
+		}
+
+		for op, patterns := range rule {
+			compiledRule, err := compileGroup(op, patterns, opts)
+			if err != nil {
+				return nil, &RuleError{Rule: i + 1, Err: err}
+			}
+
+			ruleSetMatcher.rules = append(ruleSetMatcher.rules, compiledRule)
+		}
+	}
+
+	return ruleSetMatcher, nil
+}
+
+func (ruleSetMatcher *RuleSetMatcher) Match(msg *server.Message) (bool, error) {
 	var err error
 
-	for _, rule := range ruleSet {
-		matched, err := parseRuleAgainstHeaders(rule, headers)
+	for _, rule := range ruleSetMatcher.rules {
+		matched, err := rule.match(msg, nil, nil)
 		if err != nil {
 			return false, err
 		}
@@ -25,149 +120,613 @@ func ParseRuleSet(ruleSet RuleSet, headers server.MessageHeaders) (bool, error)
 	return false, err
 }
 
-func parseRuleAgainstHeaders(rule Rule, headers server.MessageHeaders) (bool, error) {
-	var err error
+// MatchWithCaptures works like Match but also returns the named captures of the regular expressions in the matching rule.
+func (ruleSetMatcher *RuleSetMatcher) MatchWithCaptures(msg *server.Message) (bool, map[string]string, error) {
+	for _, rule := range ruleSetMatcher.rules {
+		captures := map[string]string{}
 
-	for op, patterns := range rule {
-		op = strings.ToLower(op)
+		matched, err := rule.match(msg, captures, nil)
+		if err != nil {
+			return false, nil, err
+		}
 
-		switch op {
-		case "or":
-			for _, pattern := range patterns {
-				for patternHeaderName, patternValues := range pattern {
-					patternHeaderName := strings.ToLower(patternHeaderName)
+		if matched {
+			return true, captures, nil
+		}
+	}
 
-					if _, keyInMap := headers[patternHeaderName]; !keyInMap {
-						continue
-					}
+	return false, map[string]string{}, nil
+}
 
-					if matched, err := checkRulePattern(patternValues, headers[patternHeaderName]); err != nil {
-						return false, err
-					} else if matched {
-						return true, nil
-					}
-				}
+// Explain works like Match but also returns a trace of the evaluation. Rules after the matching one aren't evaluated.
+func (ruleSetMatcher *RuleSetMatcher) Explain(msg *server.Message) (*Trace, error) {
+	trace := &Trace{}
+
+	for i, rule := range ruleSetMatcher.rules {
+		node := &TraceNode{}
+		trace.Rules = append(trace.Rules, node)
+
+		captures := map[string]string{}
+
+		matched, err := evaluate(rule, msg, captures, node)
+		if err != nil {
+			return trace, err
+		}
+
+		if matched {
+			trace.Matched = true
+			trace.Rule = i + 1
+			if len(captures) > 0 {
+				trace.Captures = captures
 			}
-		case "and":
-			var patternMatched bool
+			break
+		}
+	}
 
-			for _, pattern := range patterns {
-				for patternHeaderName, patternValues := range pattern {
-					patternHeaderName := strings.ToLower(patternHeaderName)
+	return trace, nil
+}
 
-					if _, keyInMap := headers[patternHeaderName]; !keyInMap {
-						return false, nil
-					}
+// evaluate runs a condition and records its result in the trace node
+func evaluate(condition matcher, msg *server.Message, captures map[string]string, node *TraceNode) (bool, error) {
+	matched, err := condition.match(msg, captures, node)
+	node.result(matched)
 
-					if matched, err := checkRulePattern(patternValues, headers[patternHeaderName]); err != nil {
-						return false, err
-					} else if !matched {
-						return false, nil
-					} else if matched {
-						patternMatched = true
-					}
-				}
+	return matched, err
+}
+
+func compileGroup(op string, patterns []map[string]interface{}, opts CompileOptions) (matcher, error) {
+	op = strings.ToLower(op)
+
+	if !IsGroupOperator(op) {
+		return nil, fmt.Errorf("rule operator %q is unsupported", op)
+	}
+
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("rule operator %q has no patterns", op)
+	}
+
+	group := groupMatcher{op: op}
+
+	for _, pattern := range patterns {
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("rule operator %q contains an empty pattern", op)
+		}
+
+		for patternHeaderName, patternValues := range pattern {
+			condition, err := compileCondition(patternHeaderName, patternValues, opts)
+			if err != nil {
+				return nil, err
 			}
 
-			return patternMatched, nil
-		default:
-			return false, fmt.Errorf("rule operator %q is unsupported", op)
+			group.conditions = append(group.conditions, condition)
 		}
 	}
 
-	return false, err
+	// Conditions that need to fetch more data from the server are evaluated last so that they can be skipped if the result is already clear
+	sort.SliceStable(group.conditions, func(i, j int) bool {
+		return !needsFetch(group.conditions[i]) && needsFetch(group.conditions[j])
+	})
+
+	return group, nil
 }
 
-func checkRulePattern(patternValues interface{}, headers interface{}) (bool, error) {
+// needsFetch reports whether a condition needs more than the data fetched for every message, like fetching parts or searching the server
+func needsFetch(condition matcher) bool {
+	switch c := condition.(type) {
+	case bodyMatcher, programMatcher, threadMatcher, duplicateMatcher:
+		return true
+	case classifierMatcher:
+		return c.model.Bodies
+	case groupMatcher:
+		for _, subCondition := range c.conditions {
+			if needsFetch(subCondition) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func compileCondition(patternHeaderName string, patternValues interface{}, opts CompileOptions) (matcher, error) {
+	if IsGroupOperator(patternHeaderName) {
+		// nested group like {"not": [{"subject": "invoice"}]}
+		subPatterns, err := parseGroupPatterns(patternValues)
+		if err != nil {
+			return nil, err
+		}
+
+		return compileGroup(patternHeaderName, subPatterns, opts)
+	}
+
+	patternHeaderName = strings.ToLower(patternHeaderName)
+
+	if isListSpec(patternValues) {
+		condition, err := compileListCondition(patternHeaderName, patternValues, opts.Lists)
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	}
+
+	if isAddressCondition(patternHeaderName) {
+		condition, err := compileAddressCondition(patternHeaderName, patternValues)
+		if err != nil {
+			return nil, fmt.Errorf("address %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	}
+
+	switch patternHeaderName {
+	case "exists", "missing":
+		names, err := parseHeaderNames(patternValues)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return headerExistsMatcher{names: names, missing: patternHeaderName == "missing"}, nil
+	case "body":
+		condition, err := compileBodyCondition(patternValues)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "attachment":
+		condition, err := compileAttachmentCondition(patternValues)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "flag", "keyword":
+		condition, err := compileFlagCondition(patternValues, patternHeaderName == "keyword")
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "macro":
+		return nil, fmt.Errorf("condition %q: macros are only expanded when loading the config", patternHeaderName)
+	case "thread":
+		condition, err := compileThreadCondition(patternValues, opts.Threads)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "duplicate":
+		condition, err := compileDuplicateCondition(patternValues, opts.Duplicates)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "classifier":
+		condition, err := compileClassifierCondition(patternValues, opts.Classifier)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "program":
+		condition, err := compileProgramCondition(patternValues, opts.Programs, opts.Account)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "dkim", "spf", "dmarc", "arc":
+		condition, err := compileAuthCondition(patternHeaderName, patternValues, opts.AuthServIDs)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "size":
+		condition, err := compileSizeCondition(patternValues)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+		}
+
+		return condition, nil
+	case "date":
+		if spec, ok := patternValues.(map[string]interface{}); ok && isDateSpec(spec) {
+			condition, err := compileDateCondition(spec)
+			if err != nil {
+				return nil, fmt.Errorf("condition %q: %v", patternHeaderName, err)
+			}
+
+			return condition, nil
+		}
+	}
+
 	parsedValues, err := parsePatternValues(patternValues)
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("header %q: %v", patternHeaderName, err)
 	}
 
-	for _, patternValue := range parsedValues {
-		var headerList []string
+	condition := headerMatcher{name: patternHeaderName}
+	for _, p := range parsedValues {
+		compiled, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("header %q: pattern %q: %v", patternHeaderName, p.value, err)
+		}
 
-		switch h := headers.(type) {
-		case string:
-			headerList = append(headerList, h)
-		case []string:
-			headerList = h
-		default:
-			return false, fmt.Errorf("unsupported header type %q", reflect.TypeOf(headers))
+		condition.patterns = append(condition.patterns, compiled)
+	}
+
+	return condition, nil
+}
+
+func (group groupMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition(group.op)
+
+	switch group.op {
+	case "or":
+		// only the captures of the matching condition are kept
+		for _, condition := range group.conditions {
+			conditionCaptures := captureScope(captures)
+
+			if matched, err := evaluate(condition, msg, conditionCaptures, trace.child()); err != nil {
+				return false, err
+			} else if matched {
+				mergeCaptures(captures, conditionCaptures)
+				return true, nil
+			}
 		}
+	case "and":
+		groupCaptures := captureScope(captures)
 
-		for _, header := range headerList {
-			matched, err := checkMatch(patternValue, header)
-			if err != nil {
+		for _, condition := range group.conditions {
+			if matched, err := evaluate(condition, msg, groupCaptures, trace.child()); err != nil {
+				return false, err
+			} else if !matched {
+				return false, nil
+			}
+		}
+
+		mergeCaptures(captures, groupCaptures)
+		return true, nil
+	case "not":
+		// not matches if none of its patterns match, so there is nothing to capture
+		for _, condition := range group.conditions {
+			if matched, err := evaluate(condition, msg, nil, trace.child()); err != nil {
 				return false, err
+			} else if matched {
+				return false, nil
 			}
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (condition headerMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition(condition.name)
+
+	if _, keyInMap := msg.Headers[condition.name]; !keyInMap {
+		return false, nil
+	}
+
+	var headerList []string
+
+	switch h := msg.Headers[condition.name].(type) {
+	case string:
+		headerList = append(headerList, h)
+	case []string:
+		headerList = h
+	default:
+		return false, fmt.Errorf("unsupported header type %q", reflect.TypeOf(msg.Headers[condition.name]))
+	}
+
+	for _, p := range condition.patterns {
+		for i, header := range headerList {
+			if p.match(header) {
+				if captures != nil {
+					// captures keep the case of the header
+					value := header
+					if original := msg.OriginalHeader(condition.name); i < len(original) {
+						value = original[i]
+					}
+
+					addCaptures(p, value, captures)
+				}
 
-			if matched {
+				trace.decide(p.String(), header)
 				return true, nil
 			}
 		}
 	}
 
+	trace.decide("", strings.Join(headerList, ", "))
 	return false, nil
 }
 
-func checkMatch(pattern string, s string) (bool, error) {
-	patternLowered := strings.ToLower(pattern)
-	s = strings.ToLower(s)
+// exists matches if all headers are present, missing if none of them is.
+func (condition headerExistsMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	if condition.missing {
+		trace.condition("missing")
+	} else {
+		trace.condition("exists")
+	}
+
+	for _, name := range condition.names {
+		if _, keyInMap := msg.Headers[name]; keyInMap == condition.missing {
+			trace.decide(name, "")
+			return false, nil
+		}
+	}
+
+	trace.decide(strings.Join(condition.names, ", "), "")
+
+	return true, nil
+}
+
+func parseHeaderNames(patternValues interface{}) ([]string, error) {
+	var names []string
+
+	switch v := patternValues.(type) {
+	case string:
+		names = append(names, strings.ToLower(v))
+	case []string:
+		for _, val := range v {
+			names = append(names, strings.ToLower(val))
+		}
+	case []interface{}:
+		for _, val := range v {
+			name, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported header name type %v", reflect.TypeOf(val))
+			}
+
+			names = append(names, strings.ToLower(name))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported header name type %v", reflect.TypeOf(v))
+	}
+
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("header name must not be empty")
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no header names given")
+	}
+
+	return names, nil
+}
+
+// IsGroupOperator reports whether a condition name is one of the group operators or, and and not.
+func IsGroupOperator(op string) bool {
+	switch strings.ToLower(op) {
+	case "or", "and", "not":
+		return true
+	}
+
+	return false
+}
+
+func parseGroupPatterns(patternValues interface{}) ([]map[string]interface{}, error) {
+	var patterns []map[string]interface{}
+
+	switch v := patternValues.(type) {
+	case []map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		for _, val := range v {
+			pattern, ok := val.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unsupported nested pattern type %v", reflect.TypeOf(val))
+			}
+
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported nested pattern type %v", reflect.TypeOf(v))
+	}
+
+	return patterns, nil
+}
+
+// Match modes of a pattern. Plain pattern values use MatchModeAuto which tries equality, substring and regex matching in that order.
+const (
+	MatchModeAuto     = ""
+	MatchModeExact    = "exact"
+	MatchModeContains = "contains"
+	MatchModePrefix   = "prefix"
+	MatchModeSuffix   = "suffix"
+	MatchModeGlob     = "glob"
+	MatchModeRegex    = "regex"
+	MatchModeNumeric  = "numeric"
+)
+
+type pattern struct {
+	mode        string
+	value       string
+	comparisons comparisons
+}
+
+func isMatchMode(mode string) bool {
+	switch mode {
+	case MatchModeExact, MatchModeContains, MatchModePrefix, MatchModeSuffix, MatchModeGlob, MatchModeRegex:
+		return true
+	}
+
+	return false
+}
+
+func compilePattern(p pattern) (compiledPattern, error) {
 	var err error
+	compiled := compiledPattern{pattern: p}
+	compiled.value = strings.ToLower(p.value)
+
+	switch p.mode {
+	case MatchModeGlob:
+		compiled.regEx, err = regexp.Compile(globToRegexp(p.value))
+	case MatchModeRegex, MatchModeAuto:
+		if p.mode == MatchModeAuto && p.value == "" {
+			break
+		}
 
-	//fmt.Printf("%q == %q\n", pattern, s)
+		compiled.regEx, err = regexp.Compile(fmt.Sprintf("(?i)%v", p.value))
+	}
+
+	return compiled, err
+}
 
-	if pattern == "" && s == "" {
-		return true, err
+func (p compiledPattern) match(s string) bool {
+	s = strings.ToLower(s)
+
+	switch p.mode {
+	case MatchModeExact:
+		return p.value == s
+	case MatchModeContains:
+		return strings.Contains(s, p.value)
+	case MatchModePrefix:
+		return strings.HasPrefix(s, p.value)
+	case MatchModeSuffix:
+		return strings.HasSuffix(s, p.value)
+	case MatchModeGlob, MatchModeRegex:
+		return p.regEx.MatchString(s)
+	case MatchModeNumeric:
+		// headers that don't parse as a number never match
+		f, err := parseNumber(s)
+		if err != nil {
+			return false
+		}
+
+		return p.comparisons.match(f)
 	}
 
-	if pattern == "" && s != "" {
-		return false, err
+	if p.value == "" {
+		return s == ""
 	}
 
-	if patternLowered == s {
-		return true, err
+	if p.value == s {
+		return true
 	}
 
-	if strings.Contains(s, patternLowered) {
-		return true, err
+	if strings.Contains(s, p.value) {
+		return true
 	}
 
-	regEx, err := regexp.Compile(fmt.Sprintf("(?i)%v", pattern))
+	return p.regEx.MatchString(s)
+}
+
+// globToRegexp translates a shell-like glob (* and ?) into an anchored, case-insensitive regular expression.
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+
+	expr.WriteString("(?is)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	return expr.String()
+}
+
+// Pattern is a parsed pattern value of a condition with its match mode.
+type Pattern struct {
+	Mode  string
+	Value string
+}
+
+// ParsePatterns parses pattern values like the conditions of a rule set do, e.g. for translating them into other filter languages.
+func ParsePatterns(patternValues interface{}) ([]Pattern, error) {
+	parsedValues, err := parsePatternValues(patternValues)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	if regEx.MatchString(s) {
-		return true, err
+	patterns := make([]Pattern, 0, len(parsedValues))
+	for _, p := range parsedValues {
+		patterns = append(patterns, Pattern{Mode: p.mode, Value: p.value})
 	}
 
-	return false, err
+	return patterns, nil
+}
+
+func parsePatternValues(patternValues interface{}) ([]pattern, error) {
+	return parsePatternValuesWithMode(patternValues, MatchModeAuto)
 }
 
-func parsePatternValues(patternValues interface{}) ([]string, error) {
-	var values []string
+func parsePatternValuesWithMode(patternValues interface{}, mode string) ([]pattern, error) {
+	var values []pattern
 
 	switch v := patternValues.(type) {
 	case string:
-		return append(values, v), nil
+		return append(values, pattern{mode: mode, value: v}), nil
 	case int:
-		return append(values, fmt.Sprintf("%v", v)), nil
+		return append(values, pattern{mode: mode, value: fmt.Sprintf("%v", v)}), nil
 	//case float32:
 	//	return append(values, fmt.Sprintf("%v", v)), nil
-	//case float64:
-	//	return append(values, fmt.Sprintf("%v", v)), nil
+	case float64:
+		return append(values, pattern{mode: mode, value: fmt.Sprintf("%v", v)}), nil
 	//case bool:
 	//	return append(values, fmt.Sprintf("%v", v)), nil
 	case []string:
 		for _, val := range v {
-			values = append(values, val)
+			values = append(values, pattern{mode: mode, value: val})
 		}
 	case []interface{}:
 		for _, val := range v {
-			p, err := parsePatternValues(val)
+			p, err := parsePatternValuesWithMode(val, mode)
+
+			if err != nil {
+				return values, err
+			}
+
+			values = append(values, p...)
+		}
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = val
+		}
+
+		return parsePatternValuesWithMode(m, mode)
+	case map[string]interface{}:
+		// explicit match mode like {regex: '^Invoice \d+'}
+		if mode != MatchModeAuto {
+			return values, fmt.Errorf("match mode %q can't be nested", mode)
+		}
+
+		if isComparisonSpec(v) {
+			// numeric comparison like {gt: 5, le: 10}
+			cmps, err := parseComparisons(v, parseNumber)
+			if err != nil {
+				return values, err
+			}
+
+			return append(values, pattern{mode: MatchModeNumeric, value: fmt.Sprintf("%v", v), comparisons: cmps}), nil
+		}
+
+		if len(v) != 1 {
+			return values, fmt.Errorf("pattern must have exactly one match mode, got %v", len(v))
+		}
+
+		for key, val := range v {
+			key = strings.ToLower(key)
+			if !isMatchMode(key) {
+				return values, fmt.Errorf("match mode %q is unsupported", key)
+			}
 
+			p, err := parsePatternValuesWithMode(val, key)
 			if err != nil {
 				return values, err
 			}
@@ -1,6 +1,7 @@
 package filter_test
 
 import (
+	"fmt"
 	"github.com/arnisoph/postisto/pkg/config"
 	"github.com/arnisoph/postisto/pkg/filter"
 	"github.com/arnisoph/postisto/pkg/server"
@@ -120,7 +121,7 @@ func TestParseRuleSet(t *testing.T) {
 				},
 			},
 			matchExpected: false,
-			err:           `rule operator "non-existent-op" is unsupported`,
+			err:           `rule #1: rule operator "non-existent-op" is unsupported`,
 		},
 		{
 			filters: map[string]filter.Filter{
@@ -135,7 +136,7 @@ func TestParseRuleSet(t *testing.T) {
 				},
 			},
 			matchExpected: false,
-			err:           `unsupported value type server.Connection`,
+			err:           `rule #1: header "from": unsupported value type server.Connection`,
 		},
 		{
 			filters: map[string]filter.Filter{
@@ -150,7 +151,7 @@ func TestParseRuleSet(t *testing.T) {
 				},
 			},
 			matchExpected: false,
-			err:           `unsupported value type server.Connection`,
+			err:           `rule #1: header "from": unsupported value type server.Connection`,
 		},
 		{
 			filters: map[string]filter.Filter{
@@ -269,7 +270,7 @@ func TestParseRuleSet(t *testing.T) {
 				},
 			},
 			matchExpected: false,
-			err:           "error parsing regexp: invalid escape sequence: `\\ü`",
+			err:           "rule #1: header \"to\": pattern \"!^\\\\ü^@example.com\": error parsing regexp: invalid escape sequence: `\\ü`",
 		},
 		{
 			filters: map[string]filter.Filter{
@@ -282,7 +283,7 @@ func TestParseRuleSet(t *testing.T) {
 				},
 			},
 			matchExpected: false,
-			err:           "error parsing regexp: invalid escape sequence: `\\ü`",
+			err:           "rule #1: header \"to\": pattern \"!^\\\\ü^@example.com\": error parsing regexp: invalid escape sequence: `\\ü`",
 		},
 		{
 			filters: map[string]filter.Filter{
@@ -382,6 +383,552 @@ func TestParseRuleSet(t *testing.T) {
 			},
 			matchExpected: false,
 		},
+		{
+			filters: map[string]filter.Filter{
+				"and with nested not": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"from": "foo@example.com"},
+								{"not": []map[string]interface{}{{"subject": "invoice"}}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing and with nested not": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"from": "foo@example.com"},
+								{"not": []map[string]interface{}{{"subject": "löve"}}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"not as rule operator": {
+					RuleSet: filter.RuleSet{
+						{
+							"not": []map[string]interface{}{
+								{"from": "wrong value"},
+								{"to": "nope"},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"not with missing header": {
+					RuleSet: filter.RuleSet{
+						{
+							"not": []map[string]interface{}{{"x-does-not-exist": "foo"}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"deeply nested groups": {
+					RuleSet: filter.RuleSet{
+						{
+							"or": []map[string]interface{}{
+								{"from": "nope"},
+								{"and": []interface{}{
+									map[string]interface{}{"to": "example.com"},
+									map[string]interface{}{"or": []interface{}{
+										map[string]interface{}{"subject": "nope"},
+										map[string]interface{}{"not": []interface{}{
+											map[string]interface{}{"from": "nope"},
+										}},
+									}},
+								}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing deeply nested groups": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"to": "example.com"},
+								{"or": []interface{}{
+									map[string]interface{}{"subject": "nope"},
+									map[string]interface{}{"not": []interface{}{
+										map[string]interface{}{"from": "foo"},
+									}},
+								}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing with empty nested group": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"from": "foo@example.com"},
+								{"or": []map[string]interface{}{}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+			err:           `rule #1: rule operator "or" has no patterns`,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing with invalid nested group": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"from": "foo@example.com"},
+								{"not": "foo"},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+			err:           `rule #1: unsupported nested pattern type string`,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"exact match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"exact": "With Löve"}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing exact match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"exact": "löve"}}},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"regex characters in exact match mode are literal": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"exact": "with.löve"}}},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"contains match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"from": map[string]interface{}{"contains": "@EXAMPLE"}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"prefix match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"prefix": "WITH"}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"suffix match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"to": map[string]interface{}{"suffix": "example.com"}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"glob match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"from": map[string]interface{}{"glob": "*@example.???"}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing glob match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"from": map[string]interface{}{"glob": "foo+*"}}},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"regex match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"regex": "^with\\s+löve$"}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing regex match mode without substring fallback": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"regex": "^löve"}}},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"match modes in value list": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"from": []interface{}{map[string]interface{}{"exact": "nope"}, map[string]interface{}{"suffix": "@example.com"}}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"value list in match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"prefix": []interface{}{"nope", "with"}}}},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing with unsupported match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"fuzzy": "löve"}}},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+			err:           `rule #1: header "subject": match mode "fuzzy" is unsupported`,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing with several match modes": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{{"subject": map[string]interface{}{"prefix": "with", "suffix": "löve"}}},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+			err:           `rule #1: header "subject": pattern must have exactly one match mode, got 2`,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"exists condition": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"exists": "subject"},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"exists condition with several headers": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"exists": []string{"From", "to"}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing exists condition": {
+					RuleSet: filter.RuleSet{
+						{
+							"or": []map[string]interface{}{
+								{"exists": []string{"from", "x-spam-flag"}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"missing condition": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"missing": "X-Spam-Flag"},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing missing condition": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"missing": []string{"x-spam-flag", "from"}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"exists and missing in nested groups": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"from": "example.com"},
+								{"not": []map[string]interface{}{{"missing": "to"}}},
+								{"or": []map[string]interface{}{{"exists": "list-id"}, {"missing": "list-id"}}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing with match mode in exists condition": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"exists": map[string]interface{}{"regex": "^list-"}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+			err:           `rule #1: condition "exists": unsupported header name type map[string]interface {}`,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"numeric greater than comparison": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"X-Spam-Score": map[string]interface{}{"gt": 5}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"numeric comparison with float": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-spam-score": map[string]interface{}{"ge": 7.3}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"numeric range comparison": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-spam-score": map[string]interface{}{"gt": 5, "lt": 10}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing numeric range comparison": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-spam-score": map[string]interface{}{"gt": 7.3, "le": 10}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"numeric comparison with negative value": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-rspamd-score": map[string]interface{}{"lt": 0}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"numeric equal comparison with string value": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-spam-score": map[string]interface{}{"eq": "7.30"}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"numeric comparison on non-numeric header": {
+					RuleSet: filter.RuleSet{
+						{
+							"or": []map[string]interface{}{
+								{"x-spam-status": map[string]interface{}{"gt": 0}},
+								{"x-spam-status": map[string]interface{}{"le": 0}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"plain float pattern": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-spam-score": 7.3},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: true,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing with numeric comparison and match mode": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-spam-score": map[string]interface{}{"gt": 5, "regex": "^7"}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+			err:           `rule #1: header "x-spam-score": match mode "regex" can't be combined with numeric comparisons`,
+		},
+		{
+			filters: map[string]filter.Filter{
+				"failing with non-numeric comparison value": {
+					RuleSet: filter.RuleSet{
+						{
+							"and": []map[string]interface{}{
+								{"x-spam-score": map[string]interface{}{"gt": "high"}},
+							},
+						},
+					},
+				},
+			},
+			matchExpected: false,
+			err:           `rule #1: header "x-spam-score": invalid value for comparison "gt": "high" is not a number`,
+		},
 
 		//{
 		//	headers: MailHeaders{"from": "oO"},
@@ -401,7 +948,7 @@ func TestParseRuleSet(t *testing.T) {
 		//},
 	}
 
-	testMailHeaders := server.MessageHeaders{"from": "foo@example.com", "to": "me@EXAMPLE.com", "subject": "With Löve", "empty-header": "", "custom-Header": "Foobar"}
+	testMailHeaders := server.MessageHeaders{"from": "foo@example.com", "to": "me@EXAMPLE.com", "subject": "With Löve", "empty-header": "", "custom-Header": "Foobar", "x-spam-score": "7.3", "x-rspamd-score": "-1.20", "x-spam-status": "yes"}
 
 	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestParserRuleSet.yaml")
 	require.NoError(err)
@@ -431,6 +978,18 @@ func TestParseRuleSet(t *testing.T) {
 			// Test with same synthetic ruleSet test data from YAML
 			yml, err := yaml.Marshal(test.filters)
 			_, fieldInMap := filters[filterName]
+
+			if !fieldInMap && test.err != "" {
+				// malformed rule sets are rejected while loading the config
+				invalidFile := fmt.Sprintf("../../test/data/configs/invalid/TestParserRuleSet/%v.yaml", strings.ReplaceAll(filterName, " ", "_"))
+				require.FileExists(invalidFile, "Add test %q to %v:\n=========\n%v=========\n%v", filterName, invalidFile, string(yml), err)
+
+				_, err = config.NewConfigFromFile(invalidFile)
+				require.Error(err, "YML DATA TEST: Test #%v (%q) from ruleParserTests was expected to fail while loading the config", i+1, filterName)
+				require.Contains(err.Error(), test.err, "YML DATA TEST: Actual error message: %v", err.Error())
+				continue
+			}
+
 			require.True(fieldInMap, "Add test %q to TestParserRuleSet.yml:\n=========\n%v=========\n%v", filterName, string(yml), err)
 
 			ymlFilter := filters[filterName]
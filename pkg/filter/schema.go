@@ -0,0 +1,335 @@
+package filter
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// Position is where a filter is defined in the config, so that problems can be reported with file name and line number.
+type Position struct {
+	File      string // set by the config loader
+	Line      int    // line of the filter
+	RuleLines []int  // lines of the rules in rule set order
+}
+
+// String returns "file:line", or just the line if the file isn't known
+func (pos Position) String() string {
+	if pos.File == "" {
+		return fmt.Sprintf("line %v", pos.Line)
+	}
+
+	return fmt.Sprintf("%v:%v", pos.File, pos.Line)
+}
+
+// RuleLine returns the position of the rule with the number as used in RuleError, or the position of the filter if it isn't known.
+func (pos Position) RuleLine(rule int) Position {
+	if rule < 1 || rule > len(pos.RuleLines) {
+		return pos
+	}
+
+	return Position{File: pos.File, Line: pos.RuleLines[rule-1]}
+}
+
+var (
+	filterKeys  = []string{"commands", "rules", "continue", "priority"}
+	commandKeys = []string{"move", "move_to_thread", "add_flags", "remove_flags", "replace_all_flags", "dedupe"}
+)
+
+// decode decodes a filter node, rejecting unknown keys and values of the wrong type. The name is only allowed in the ordered list form of a filter set.
+// Problems are returned as "line N: problem" so that all problems of a config file can be reported together.
+func (filter *Filter) decode(node *yaml.Node, withName bool) (string, []string) {
+	var name string
+	var errs []string
+
+	*filter = Filter{Position: Position{Line: node.Line}}
+
+	if node.Kind != yaml.MappingNode {
+		return "", []string{fmt.Sprintf("line %v: a filter has to be a mapping of %v", node.Line, strings.Join(filterKeys, ", "))}
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+
+		switch key.Value {
+		case "name":
+			if !withName {
+				errs = append(errs, unknownKeyError(key, "key", filterKeys))
+				continue
+			}
+
+			if val.Kind != yaml.ScalarNode || val.Tag == "!!null" {
+				errs = append(errs, fmt.Sprintf("line %v: name has to be a string", val.Line))
+				continue
+			}
+
+			name = val.Value
+		case "commands":
+			errs = append(errs, filter.Commands.decode(val)...)
+		case "rules":
+			errs = append(errs, filter.decodeRules(val)...)
+		case "continue":
+			if val.Tag != "!!bool" || val.Decode(&filter.Continue) != nil {
+				errs = append(errs, fmt.Sprintf("line %v: continue has to be true or false, not %q", val.Line, val.Value))
+			}
+		case "priority":
+			var priority int
+			if val.Tag != "!!int" || val.Decode(&priority) != nil {
+				errs = append(errs, fmt.Sprintf("line %v: priority has to be an integer, not %q", val.Line, val.Value))
+				continue
+			}
+
+			filter.Priority = &priority
+		default:
+			keys := filterKeys
+			if withName {
+				keys = append([]string{"name"}, filterKeys...)
+			}
+
+			errs = append(errs, unknownKeyError(key, "key", keys))
+		}
+	}
+
+	return name, errs
+}
+
+// decodeRules decodes the rule set and remembers the lines of the rules, so that compile errors can point to them.
+// The rules themselves are checked when the rule set is compiled.
+func (filter *Filter) decodeRules(node *yaml.Node) []string {
+	if node.Kind != yaml.SequenceNode {
+		return []string{fmt.Sprintf("line %v: rules have to be a list of rules like `- and: [...]`", node.Line)}
+	}
+
+	for _, ruleNode := range node.Content {
+		filter.Position.RuleLines = append(filter.Position.RuleLines, ruleNode.Line)
+	}
+
+	if err := node.Decode(&filter.RuleSet); err != nil {
+		return typeErrors(err, node)
+	}
+
+	return nil
+}
+
+// UnmarshalYAML decodes commands, rejecting unknown commands and values of the wrong type.
+func (cmds *Commands) UnmarshalYAML(node *yaml.Node) error {
+	if errs := cmds.decode(node); len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+
+	return nil
+}
+
+func (cmds *Commands) decode(node *yaml.Node) []string {
+	var errs []string
+
+	*cmds = Commands{}
+
+	if node.Tag == "!!null" {
+		return nil
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return []string{fmt.Sprintf("line %v: commands have to be a mapping of %v", node.Line, strings.Join(commandKeys, ", "))}
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+
+		var err string
+		switch key.Value {
+		case "move":
+			if val.Kind != yaml.ScalarNode || val.Tag != "!!str" || val.Value == "" {
+				err = fmt.Sprintf("line %v: command \"move\" requires a mailbox name%v", val.Line, quoteHint(val))
+				break
+			}
+
+			cmds.Move = val.Value
+		case "move_to_thread":
+			if val.Tag != "!!bool" || val.Decode(&cmds.MoveToThread) != nil {
+				err = fmt.Sprintf("line %v: command \"move_to_thread\" has to be true or false, not %q", val.Line, val.Value)
+			}
+		case "add_flags":
+			cmds.AddFlags, err = decodeFlags(key.Value, val)
+		case "remove_flags":
+			cmds.RemoveFlags, err = decodeFlags(key.Value, val)
+		case "replace_all_flags":
+			cmds.ReplaceAllFlags, err = decodeFlags(key.Value, val)
+		case "dedupe":
+			if val.Kind != yaml.ScalarNode || !contains(DedupeActions, val.Value) {
+				err = fmt.Sprintf("line %v: command \"dedupe\" has to be one of %v, not %q", val.Line, strings.Join(DedupeActions, ", "), val.Value)
+				break
+			}
+
+			cmds.Dedupe = val.Value
+		default:
+			err = unknownKeyError(key, "command", commandKeys)
+		}
+
+		if err != "" {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// decodeFlags decodes a list of flags. The list is never nil so that an empty replace_all_flags list removes all flags.
+func decodeFlags(command string, node *yaml.Node) ([]string, string) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Sprintf("line %v: command %q requires a list of flags like ['\\Seen', '$Label1']", node.Line, command)
+	}
+
+	flags := []string{}
+	for _, flag := range node.Content {
+		if flag.Kind != yaml.ScalarNode || flag.Tag != "!!str" || flag.Value == "" {
+			return nil, fmt.Sprintf("line %v: command %q: flags have to be strings%v", flag.Line, command, quoteHint(flag))
+		}
+
+		flags = append(flags, flag.Value)
+	}
+
+	return flags, ""
+}
+
+// MarshalYAML writes the commands in the order they are applied, leaving out the ones that aren't set.
+func (cmds Commands) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Style: yaml.FlowStyle}
+
+	add := func(key string, val interface{}) error {
+		valNode := &yaml.Node{}
+		if err := valNode.Encode(val); err != nil {
+			return err
+		}
+
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, valNode)
+		return nil
+	}
+
+	values := []struct {
+		key   string
+		isSet bool
+		val   interface{}
+	}{
+		{key: "move", isSet: cmds.Move != "", val: cmds.Move},
+		{key: "move_to_thread", isSet: cmds.MoveToThread, val: cmds.MoveToThread},
+		{key: "add_flags", isSet: cmds.AddFlags != nil, val: cmds.AddFlags},
+		{key: "remove_flags", isSet: cmds.RemoveFlags != nil, val: cmds.RemoveFlags},
+		{key: "replace_all_flags", isSet: cmds.ReplaceAllFlags != nil, val: cmds.ReplaceAllFlags},
+		{key: "dedupe", isSet: cmds.Dedupe != "", val: cmds.Dedupe},
+	}
+
+	for _, v := range values {
+		if !v.isSet {
+			continue
+		}
+
+		if err := add(v.key, v.val); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// UnmarshalYAML decodes the map and the ordered list form of a filter set. Filters of the list form are prioritized by their position unless they set a priority.
+func (filterSet *FilterSet) UnmarshalYAML(node *yaml.Node) error {
+	var errs []string
+	*filterSet = FilterSet{}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+
+			if _, ok := (*filterSet)[key.Value]; ok {
+				errs = append(errs, fmt.Sprintf("line %v: filter %q is defined more than once", key.Line, key.Value))
+				continue
+			}
+
+			var filter Filter
+			_, filterErrs := filter.decode(val, false)
+			errs = append(errs, prefixErrors(fmt.Sprintf("filter %q", key.Value), filterErrs)...)
+
+			filter.Position.Line = key.Line
+			(*filterSet)[key.Value] = filter
+		}
+	case yaml.SequenceNode:
+		for i, val := range node.Content {
+			var filter Filter
+			name, filterErrs := filter.decode(val, true)
+
+			if name == "" {
+				errs = append(errs, prefixErrors(fmt.Sprintf("filter #%v", i+1), filterErrs)...)
+				if val.Kind == yaml.MappingNode {
+					errs = append(errs, fmt.Sprintf("line %v: filter #%v has no name", val.Line, i+1))
+				}
+				continue
+			}
+
+			errs = append(errs, prefixErrors(fmt.Sprintf("filter %q", name), filterErrs)...)
+
+			if _, ok := (*filterSet)[name]; ok {
+				errs = append(errs, fmt.Sprintf("line %v: filter %q is defined more than once", val.Line, name))
+				continue
+			}
+
+			if filter.Priority == nil {
+				position := i
+				filter.Priority = &position
+			}
+
+			(*filterSet)[name] = filter
+		}
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil
+		}
+
+		fallthrough
+	default:
+		errs = append(errs, fmt.Sprintf("line %v: filters have to be a mapping of filter names to filters or a list of filters with names", node.Line))
+	}
+
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+
+	return nil
+}
+
+// prefixErrors adds context to "line N: problem" errors: "line N: context: problem"
+func prefixErrors(context string, errs []string) []string {
+	var prefixed []string
+
+	for _, err := range errs {
+		if line, problem, ok := strings.Cut(err, ": "); ok && strings.HasPrefix(line, "line ") {
+			prefixed = append(prefixed, fmt.Sprintf("%v: %v: %v", line, context, problem))
+		} else {
+			prefixed = append(prefixed, fmt.Sprintf("%v: %v", context, err))
+		}
+	}
+
+	return prefixed
+}
+
+// quoteHint suggests quoting values that YAML reads as numbers or booleans
+func quoteHint(node *yaml.Node) string {
+	if node.Kind == yaml.ScalarNode && (node.Tag == "!!int" || node.Tag == "!!float" || node.Tag == "!!bool") {
+		return fmt.Sprintf(", quote %v like '%v'", node.Value, node.Value)
+	}
+
+	return ""
+}
+
+func typeErrors(err error, node *yaml.Node) []string {
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		return typeErr.Errors
+	}
+
+	return []string{fmt.Sprintf("line %v: %v", node.Line, err)}
+}
+
+func unknownKeyError(key *yaml.Node, kind string, known []string) string {
+	return fmt.Sprintf("line %v: unknown %v %q, expected one of %v", key.Line, kind, key.Value, strings.Join(known, ", "))
+}
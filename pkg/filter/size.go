@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type sizeMatcher struct {
+	comparisons comparisons
+}
+
+// Size units, following Sieve (RFC 5228) a kilobyte has 1024 bytes
+var sizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+	{"b", 1},
+}
+
+func compileSizeCondition(patternValues interface{}) (matcher, error) {
+	spec, ok := patternValues.(map[string]interface{})
+	if !ok || !isComparisonSpec(spec) {
+		return nil, fmt.Errorf("size requires comparisons like {gt: 10MB}")
+	}
+
+	cmps, err := parseComparisons(spec, ParseSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return sizeMatcher{comparisons: cmps}, nil
+}
+
+// size matches against the RFC822.SIZE of the message
+func (condition sizeMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("size")
+	trace.decide(condition.comparisons.String(), fmt.Sprint(msg.Size))
+
+	return condition.comparisons.match(float64(msg.Size)), nil
+}
+
+// ParseSize parses sizes in bytes with optional human units like 10MB, 500K or 1.5GiB.
+func ParseSize(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int, float64:
+		return parseNumber(n)
+	case string:
+		s := strings.ToLower(strings.TrimSpace(n))
+		factor := 1.0
+
+		for _, unit := range sizeUnits {
+			if strings.HasSuffix(s, unit.suffix) {
+				s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+				factor = unit.factor
+				break
+			}
+		}
+
+		size, err := strconv.ParseFloat(s, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("%q is not a valid size", n)
+		}
+
+		return size * factor, nil
+	default:
+		return 0, fmt.Errorf("unsupported size type %v", reflect.TypeOf(v))
+	}
+}
@@ -0,0 +1,60 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSizeConditions(t *testing.T) {
+	require := require.New(t)
+
+	largeMsg := server.NewMessage(&imapUtil.Message{Size: 12 * 1024 * 1024}, server.MessageHeaders{})
+	smallMsg := server.NewMessage(&imapUtil.Message{Size: 2048}, server.MessageHeaders{})
+
+	// ACTUAL TESTS BELOW
+
+	sizeConditionTests := []struct {
+		filterName    string
+		msg           *server.Message
+		matchExpected bool
+	}{
+		{filterName: "larger than 10MB", msg: largeMsg, matchExpected: true},
+		{filterName: "larger than 10MB", msg: smallMsg, matchExpected: false},
+		{filterName: "between 1K and 1MiB", msg: smallMsg, matchExpected: true},
+		{filterName: "between 1K and 1MiB", msg: largeMsg, matchExpected: false},
+		{filterName: "exactly 2048 bytes", msg: smallMsg, matchExpected: true},
+	}
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestSizeConditions.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+
+	for i, test := range sizeConditionTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, err := testFilter.Match(test.msg)
+		require.NoError(err)
+		require.Equal(test.matchExpected, matched, "Test #%v (%q) failed: size=%v", i+1, test.filterName, test.msg.Size)
+	}
+
+	// Invalid size conditions
+	invalidSizeConditionTests := []struct {
+		spec interface{}
+		err  string
+	}{
+		{spec: "10MB", err: `rule #1: condition "size": size requires comparisons like {gt: 10MB}`},
+		{spec: map[string]interface{}{"gt": "lots"}, err: `rule #1: condition "size": invalid value for comparison "gt": "lots" is not a valid size`},
+		{spec: map[string]interface{}{"gt": "-1K"}, err: `rule #1: condition "size": invalid value for comparison "gt": "-1K" is not a valid size`},
+		{spec: map[string]interface{}{"gt": "10MB", "regex": "^1"}, err: `rule #1: condition "size": match mode "regex" can't be combined with numeric comparisons`},
+	}
+
+	for _, test := range invalidSizeConditionTests {
+		_, err := filter.CompileRuleSet(filter.RuleSet{{"and": []map[string]interface{}{{"size": test.spec}}}})
+		require.EqualError(err, test.err)
+	}
+}
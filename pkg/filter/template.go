@@ -0,0 +1,306 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// emptyTemplateValue replaces template values that are empty unless the default filter is used
+const emptyTemplateValue = "unknown"
+
+var (
+	templateIdentPattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	templateAddressPattern = regexp.MustCompile(`([^\s<>@",;]+)@([^\s<>@",;]+)`)
+)
+
+// moveTemplate is a parsed move target like "Lists/{{ header 'list-id' | listname }}" or "Archive/{{ date.Year }}/{{ date.Month }}"
+type moveTemplate struct {
+	raw   string
+	parts []templatePart
+}
+
+// templatePart is either literal text or an expression
+type templatePart struct {
+	text    string
+	source  string // header, date or capture
+	arg     string // header name, date field or capture name
+	filters []templateFilter
+}
+
+type templateFilter struct {
+	name string
+	arg  string
+}
+
+var templateDateFields = map[string]string{"year": "2006", "month": "01", "day": "02"}
+
+// isTemplate reports whether a move target contains template expressions
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// parseMoveTemplate parses the expressions of a move target. Expressions are
+//   - {{ header 'name' }}: the first value of a header
+//   - {{ date.Year }}, {{ date.Month }}, {{ date.Day }}: the Date header, or INTERNALDATE if it's missing
+//   - {{ name }}: the named capture (?P<name>...) of a matching regex in the rules
+//
+// followed by optional filters: lower, upper, listname, domain, localpart and default 'value'. Header values and captures keep their case,
+// except for captures of address conditions like from:domain since parsed addresses are lowercased.
+func parseMoveTemplate(s string) (*moveTemplate, error) {
+	tmpl := &moveTemplate{raw: s}
+
+	for rest := s; rest != ""; {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			tmpl.parts = append(tmpl.parts, templatePart{text: rest})
+			break
+		}
+
+		if start > 0 {
+			tmpl.parts = append(tmpl.parts, templatePart{text: rest[:start]})
+		}
+
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated expression %q", rest[start:])
+		}
+
+		part, err := parseTemplateExpression(rest[start+2 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("expression %q: %v", rest[start:start+end+2], err)
+		}
+
+		tmpl.parts = append(tmpl.parts, part)
+		rest = rest[start+end+2:]
+	}
+
+	return tmpl, nil
+}
+
+func parseTemplateExpression(expr string) (templatePart, error) {
+	var part templatePart
+
+	segments, err := splitTemplateSegments(expr)
+	if err != nil {
+		return part, err
+	}
+
+	fields, err := templateFields(segments[0])
+	if err != nil {
+		return part, err
+	}
+
+	switch {
+	case len(fields) == 0:
+		return part, fmt.Errorf("empty expression")
+	case fields[0] == "header":
+		if len(fields) != 2 || fields[1] == "" {
+			return part, fmt.Errorf("header requires a quoted header name like header 'list-id'")
+		}
+
+		part.source, part.arg = "header", strings.ToLower(fields[1])
+	case strings.HasPrefix(fields[0], "date."):
+		field := strings.ToLower(strings.TrimPrefix(fields[0], "date."))
+		if _, ok := templateDateFields[field]; !ok || len(fields) != 1 {
+			return part, fmt.Errorf("unsupported date field %q, use date.Year, date.Month or date.Day", fields[0])
+		}
+
+		part.source, part.arg = "date", field
+	case len(fields) == 1 && templateIdentPattern.MatchString(fields[0]):
+		part.source, part.arg = "capture", fields[0]
+	default:
+		return part, fmt.Errorf("unsupported value %q", strings.TrimSpace(segments[0]))
+	}
+
+	for _, segment := range segments[1:] {
+		fields, err := templateFields(segment)
+		if err != nil {
+			return part, err
+		}
+
+		if len(fields) == 0 {
+			return part, fmt.Errorf("empty filter")
+		}
+
+		filter := templateFilter{name: fields[0]}
+		switch filter.name {
+		case "lower", "upper", "listname", "domain", "localpart":
+			if len(fields) != 1 {
+				return part, fmt.Errorf("filter %q takes no argument", filter.name)
+			}
+		case "default":
+			if len(fields) != 2 {
+				return part, fmt.Errorf("filter %q requires a quoted value like default 'other'", filter.name)
+			}
+			filter.arg = fields[1]
+		default:
+			return part, fmt.Errorf("unsupported filter %q", filter.name)
+		}
+
+		part.filters = append(part.filters, filter)
+	}
+
+	return part, nil
+}
+
+// splitTemplateSegments splits an expression at the pipes outside of quotes
+func splitTemplateSegments(expr string) ([]string, error) {
+	var segments []string
+	var quote rune
+	start := 0
+
+	for i, c := range expr {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '|':
+			segments = append(segments, expr[start:i])
+			start = i + 1
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated string")
+	}
+
+	return append(segments, expr[start:]), nil
+}
+
+// templateFields splits a segment into words, quoted strings are unquoted
+func templateFields(segment string) ([]string, error) {
+	var fields []string
+
+	for rest := strings.TrimSpace(segment); rest != ""; rest = strings.TrimSpace(rest) {
+		if rest[0] == '\'' || rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+
+			fields = append(fields, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+
+		fields = append(fields, rest[:end])
+		rest = rest[end:]
+	}
+
+	return fields, nil
+}
+
+// captureNames returns the names of the captures that the template refers to
+func (tmpl *moveTemplate) captureNames() []string {
+	var names []string
+
+	for _, part := range tmpl.parts {
+		if part.source == "capture" {
+			names = append(names, part.arg)
+		}
+	}
+
+	return names
+}
+
+// render fills in the values of the message. Values are sanitised so that they can't add levels to the mailbox hierarchy.
+func (tmpl *moveTemplate) render(msg *server.Message, captures map[string]string, delimiter string) string {
+	var rendered strings.Builder
+
+	for _, part := range tmpl.parts {
+		if part.source == "" {
+			rendered.WriteString(part.text)
+			continue
+		}
+
+		var value string
+		switch part.source {
+		case "header":
+			if values := msg.OriginalHeader(part.arg); len(values) > 0 {
+				value = values[0]
+			}
+		case "date":
+			date := msg.Date
+			if date.IsZero() {
+				date = msg.InternalDate
+			}
+
+			if !date.IsZero() {
+				value = date.Format(templateDateFields[part.arg])
+			}
+		case "capture":
+			value = captures[part.arg]
+		}
+
+		value = strings.TrimSpace(value)
+		for _, filter := range part.filters {
+			value = filter.apply(value)
+		}
+
+		value = sanitiseMailboxName(value, delimiter)
+		if value == "" {
+			value = emptyTemplateValue
+		}
+
+		rendered.WriteString(value)
+	}
+
+	return rendered.String()
+}
+
+func (filter templateFilter) apply(value string) string {
+	switch filter.name {
+	case "lower":
+		return strings.ToLower(value)
+	case "upper":
+		return strings.ToUpper(value)
+	case "listname":
+		// "Go Nuts" <golang-nuts.googlegroups.com> => golang-nuts
+		if start := strings.LastIndex(value, "<"); start >= 0 {
+			value = strings.TrimSuffix(value[start+1:], ">")
+		}
+
+		name, _, _ := strings.Cut(strings.TrimSpace(value), ".")
+		return name
+	case "domain", "localpart":
+		addr := templateAddressPattern.FindStringSubmatch(value)
+		if addr == nil {
+			return ""
+		}
+
+		if filter.name == "domain" {
+			return addr[2]
+		}
+
+		return addr[1]
+	case "default":
+		if strings.TrimSpace(value) == "" {
+			return filter.arg
+		}
+	}
+
+	return value
+}
+
+// sanitiseMailboxName replaces the hierarchy delimiter, LIST wildcards and control characters so that a value is a single mailbox name
+func sanitiseMailboxName(value string, delimiter string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == '*' || r == '%' || unicode.IsControl(r) || (delimiter != "" && strings.ContainsRune(delimiter, r)) {
+			return '_'
+		}
+
+		return r
+	}, value)
+
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,99 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMoveTemplates(t *testing.T) {
+	require := require.New(t)
+
+	newMsg := func(date time.Time, headers server.MessageHeaders) *server.Message {
+		return server.NewMessage(&imapUtil.Message{Envelope: &imapUtil.Envelope{Date: date}, InternalDate: time.Date(2019, 4, 23, 18, 34, 29, 0, time.UTC)}, headers)
+	}
+	date := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestMoveTemplates.yaml")
+	require.NoError(err)
+	filters := cfg.Filters["templates"]
+
+	renderTests := []struct {
+		filterName string
+		msg        *server.Message
+		delimiter  string
+		move       string
+	}{
+		{filterName: "mailing lists", msg: newMsg(date, server.MessageHeaders{"list-id": `"go nuts" <golang-nuts.googlegroups.com>`}), delimiter: "/", move: "Lists/golang-nuts"},
+		{filterName: "mailing lists", msg: newMsg(date, server.MessageHeaders{"list-id": "Announce.lists.example.com"}), delimiter: "/", move: "Lists/Announce"},
+		{filterName: "mailing lists", msg: newMsg(date, server.MessageHeaders{"list-id": "<>"}), delimiter: "/", move: "Lists/unknown"},
+		{filterName: "archive", msg: newMsg(date, server.MessageHeaders{"subject": "please archive me"}), delimiter: "/", move: "Archive/2024/03"},
+		{filterName: "archive", msg: newMsg(time.Time{}, server.MessageHeaders{"subject": "please archive me"}), delimiter: "/", move: "Archive/2019/04"},
+		{filterName: "projects", msg: newMsg(date, server.MessageHeaders{"subject": "Re: [ALPHA-42] Release", "from": "jane@example.com"}), delimiter: "/", move: "Projects/ALPHA"},
+		{filterName: "projects", msg: newMsg(date, server.MessageHeaders{"subject": "Re: [Alpha-42] Release", "from": "jane@example.com"}), delimiter: "/", move: "Projects/Alpha"},
+		{filterName: "projects", msg: newMsg(date, server.MessageHeaders{"subject": "hello", "from": "jane@beta.example.com"}), delimiter: "/", move: "Projects/beta"},
+		// captures of address conditions are lowercased like the parsed addresses, header values keep their case
+		{filterName: "projects", msg: newMsg(date, server.MessageHeaders{"subject": "hello", "from": "Jane@Beta.Example.com"}), delimiter: "/", move: "Projects/beta"},
+		{filterName: "senders", msg: newMsg(date, server.MessageHeaders{"from": `"Jane" <Jane.Doe@Example.com>`}), delimiter: "/", move: "Senders/Example.com/Jane.Doe"},
+		{filterName: "senders", msg: newMsg(date, server.MessageHeaders{"from": `"jane" <jane.doe@example.com>`}), delimiter: "/", move: "Senders/example.com/jane.doe"},
+		// values can't add levels to the hierarchy
+		{filterName: "senders", msg: newMsg(date, server.MessageHeaders{"from": `"jane" <jane.doe@example.com>`}), delimiter: ".", move: "Senders/example_com/jane_doe"},
+		{filterName: "senders", msg: newMsg(date, server.MessageHeaders{"from": "jane/doe*@example.com"}), delimiter: "/", move: "Senders/example.com/jane_doe_"},
+		{filterName: "senders", msg: newMsg(date, server.MessageHeaders{"from": "undisclosed recipients"}), delimiter: "/", move: "Senders/unknown/nobody"},
+	}
+
+	for i, test := range renderTests {
+		testFilter, ok := filters[test.filterName]
+		require.True(ok, "Test #%v: filter %q not found", i+1, test.filterName)
+
+		matched, captures, err := testFilter.MatchWithCaptures(test.msg)
+		require.NoError(err)
+		require.True(matched, "Test #%v", i+1)
+
+		cmds, err := testFilter.RenderCommands(test.msg, captures, test.delimiter)
+		require.NoError(err, "Test #%v", i+1)
+		require.Equal(test.move, cmds.Move, "Test #%v", i+1)
+
+		// Explaining records the same captures
+		trace, err := testFilter.Explain(test.msg)
+		require.NoError(err)
+		require.Equal(captures["project"], trace.Captures["project"], "Test #%v", i+1)
+	}
+
+	// Other commands are kept and the filter itself isn't changed
+	cmds, err := filters["archive"].RenderCommands(newMsg(date, server.MessageHeaders{"subject": "archive me"}), nil, "/")
+	require.NoError(err)
+	require.Equal(filter.Commands{Move: "Archive/2024/03", AddFlags: []string{`\Seen`}}, cmds)
+	require.Equal("Archive/{{ date.Year }}/{{ date.Month }}", filters["archive"].Commands.Move)
+
+	// Invalid templates
+	invalidTemplateTests := []struct {
+		move string
+		err  string
+	}{
+		{move: "Lists/{{ header 'list-id'", err: `command "move": unterminated expression "{{ header 'list-id'"`},
+		{move: "Lists/{{ }}", err: `command "move": expression "{{ }}": empty expression`},
+		{move: "Lists/{{ header }}", err: `command "move": expression "{{ header }}": header requires a quoted header name like header 'list-id'`},
+		{move: "Lists/{{ header 'list-id }}", err: `command "move": expression "{{ header 'list-id }}": unterminated string`},
+		{move: "Archive/{{ date.Week }}", err: `command "move": expression "{{ date.Week }}": unsupported date field "date.Week", use date.Year, date.Month or date.Day`},
+		{move: "Lists/{{ header 'list-id' | title }}", err: `command "move": expression "{{ header 'list-id' | title }}": unsupported filter "title"`},
+		{move: "Lists/{{ header 'list-id' | default }}", err: `command "move": expression "{{ header 'list-id' | default }}": filter "default" requires a quoted value like default 'other'`},
+		{move: "Lists/{{ header 'list-id' | lower 'x' }}", err: `command "move": expression "{{ header 'list-id' | lower 'x' }}": filter "lower" takes no argument`},
+		{move: "Projects/{{ project }}", err: `command "move": "project" isn't a named capture like (?P<project>...) of a regular expression in the rules`},
+		{move: "Projects/{{ project name }}", err: `command "move": expression "{{ project name }}": unsupported value "project name"`},
+	}
+
+	for i, test := range invalidTemplateTests {
+		invalidFilter := filter.Filter{
+			Commands: filter.Commands{Move: test.move},
+			RuleSet:  filter.RuleSet{{"and": []map[string]interface{}{{"not": []map[string]interface{}{{"subject": map[string]interface{}{"regex": "(?P<project>[a-z]+)"}}}}}}},
+		}
+		require.EqualError(invalidFilter.Compile(), test.err, "Test #%v", i+1)
+	}
+}
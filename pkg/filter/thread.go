@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	"github.com/arnisoph/postisto/pkg/server"
+	"strings"
+)
+
+type threadMatcher struct {
+	spec      string
+	found     bool
+	mailboxes []compiledPattern
+	threads   *server.ThreadIndex
+}
+
+// compileThreadCondition compiles conditions like {thread: true}, {thread: false} or {thread: {mailbox: 'Projects/*'}}.
+// They match if the message is a reply to a message in one of the mailboxes searched for threads, or in one matching the mailbox patterns.
+func compileThreadCondition(patternValues interface{}, threads *server.ThreadIndex) (matcher, error) {
+	if threads == nil {
+		return nil, fmt.Errorf("threads can only be looked up if threads are configured for the account")
+	}
+
+	condition := threadMatcher{spec: fmt.Sprint(patternValues), found: true, threads: threads}
+
+	switch spec := patternValues.(type) {
+	case bool:
+		condition.found = spec
+	case map[string]interface{}:
+		if len(spec) == 0 {
+			return nil, fmt.Errorf("thread requires true, false or options like {mailbox: 'Projects/*'}")
+		}
+
+		for key, val := range spec {
+			if strings.ToLower(key) != "mailbox" {
+				return nil, fmt.Errorf("thread option %q is unsupported", key)
+			}
+
+			var err error
+			if condition.mailboxes, err = compileGlobPatterns(val); err != nil {
+				return nil, fmt.Errorf("thread option %q: %v", key, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("thread requires true, false or options like {mailbox: 'Projects/*'}")
+	}
+
+	return condition, nil
+}
+
+// thread looks up the mailbox of the nearest message the message refers to
+func (condition threadMatcher) match(msg *server.Message, captures map[string]string, trace *TraceNode) (bool, error) {
+	trace.condition("thread")
+
+	mailbox, err := condition.threads.Lookup(msg)
+	if err != nil {
+		return false, err
+	}
+
+	trace.decide(condition.spec, mailbox)
+
+	found := mailbox != "" && (condition.mailboxes == nil || matchAny(condition.mailboxes, strings.ToLower(mailbox)))
+	return found == condition.found, nil
+}
+
+// resolveThreadMove replaces move_to_thread with a move to the mailbox of the message the message refers to. The move of the filter is kept if the thread isn't found.
+func resolveThreadMove(srv *server.Connection, msg *server.Message, cmds Commands) (Commands, error) {
+	if !cmds.MoveToThread {
+		return cmds, nil
+	}
+
+	cmds.MoveToThread = false
+
+	if srv.Threads == nil {
+		return Commands{}, fmt.Errorf("move_to_thread requires threads to be configured for the account")
+	}
+
+	mailbox, err := srv.Threads.Lookup(msg)
+	if err != nil {
+		return Commands{}, err
+	}
+
+	if mailbox != "" {
+		log.Debugw("Filing reply next to its thread", "uid", msg.RawMessage.Uid, "mailbox", mailbox)
+		cmds.Move = mailbox
+	}
+
+	return cmds, nil
+}
@@ -0,0 +1,107 @@
+package filter_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	"github.com/arnisoph/postisto/test/integration"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThreadConditions(t *testing.T) {
+	require := require.New(t)
+
+	threads, err := server.NewThreadIndex([]string{"Projects/*"}, "")
+	require.NoError(err)
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestThreadConditions.yaml")
+	require.NoError(err)
+	require.Equal([]string{"Projects/*", "Clients"}, cfg.Accounts["threads"].Connection.Threads.Mailboxes)
+	require.Len(cfg.Filters["threads"], 3)
+
+	// Messages that don't reply to anything are new threads
+	msg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"subject": "hello"})
+	for filterName, matchExpected := range map[string]bool{"replies to projects": false, "replies to known threads": false, "new threads": true} {
+		matched, err := cfg.Filters["threads"][filterName].Match(msg)
+		require.NoError(err)
+		require.Equal(matchExpected, matched, "filter %q", filterName)
+	}
+
+	// Replies are looked up on the server
+	reply := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"in-reply-to": "<a@example.com>"})
+	_, err = cfg.Filters["threads"]["new threads"].Match(reply)
+	require.EqualError(err, "threads can't be looked up without a server connection")
+
+	// Invalid thread conditions
+	invalidThreadConditionTests := []struct {
+		spec    interface{}
+		threads *server.ThreadIndex
+		err     string
+	}{
+		{spec: true, err: `rule #1: condition "thread": threads can only be looked up if threads are configured for the account`},
+		{spec: "Projects/*", threads: threads, err: `rule #1: condition "thread": thread requires true, false or options like {mailbox: 'Projects/*'}`},
+		{spec: map[string]interface{}{}, threads: threads, err: `rule #1: condition "thread": thread requires true, false or options like {mailbox: 'Projects/*'}`},
+		{spec: map[string]interface{}{"folder": "x"}, threads: threads, err: `rule #1: condition "thread": thread option "folder" is unsupported`},
+		{spec: map[string]interface{}{"mailbox": map[string]interface{}{"gt": 1}}, threads: threads, err: `rule #1: condition "thread": thread option "mailbox": numeric comparisons are unsupported`},
+	}
+
+	for i, test := range invalidThreadConditionTests {
+		ruleSet := filter.RuleSet{{"and": []map[string]interface{}{{"thread": test.spec}}}}
+		_, err := filter.CompileRuleSetWithOptions(ruleSet, filter.CompileOptions{Threads: test.threads})
+		require.EqualError(err, test.err, "Test #%v", i+1)
+	}
+}
+
+func TestMoveToThread(t *testing.T) {
+	require := require.New(t)
+
+	testContainer := integration.NewTestContainer()
+	acc := integration.NewAccount(t, testContainer.IP, "", "test", testContainer.Imap, true, false, true, nil, testContainer.Redis)
+
+	require.NoError(acc.Connection.Connect())
+	defer func() {
+		require.Nil(acc.Connection.Disconnect())
+	}()
+
+	cachePath := filepath.Join(t.TempDir(), "threads.json")
+	threads, err := server.NewThreadIndex([]string{"Projects-*", "Clients"}, cachePath)
+	require.NoError(err)
+	acc.Connection.Threads = threads
+
+	// The parent is filed already, the reply and an unrelated message are new
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log18.txt", "Projects-Alpha", nil))
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log19.txt", *acc.InputMailbox, nil))
+	require.NoError(acc.Connection.Upload("../../test/data/mails/log1.txt", *acc.InputMailbox, nil))
+
+	replies := filter.Filter{
+		Commands: filter.Commands{MoveToThread: true, Move: "Replies"},
+		RuleSet:  filter.RuleSet{{"or": []map[string]interface{}{{"thread": true}, {"exists": "in-reply-to"}}}},
+	}
+	require.NoError(replies.CompileWithOptions(filter.CompileOptions{Threads: threads}))
+
+	// ACTUAL TESTS BELOW
+
+	require.NoError(filter.EvaluateFilterSetsOnMsgs(&acc.Connection, *acc.InputMailbox, []string{imapUtil.SeenFlag, imapUtil.FlaggedFlag}, *acc.FallbackMailbox, filter.FilterSet{"replies": replies}))
+
+	// The reply is filed next to its parent
+	uids, err := acc.Connection.Search("Projects-Alpha", nil, nil)
+	require.NoError(err)
+	require.Len(uids, 2)
+
+	// The unrelated message is flagged by the fallback
+	uids, err = acc.Connection.Search(*acc.InputMailbox, []string{imapUtil.FlaggedFlag}, nil)
+	require.NoError(err)
+	require.Len(uids, 1)
+
+	// Both the parent and the moved reply are cached
+	data, err := os.ReadFile(cachePath)
+	require.NoError(err)
+	require.Contains(string(data), `"<alpha-kickoff-1@example.com>":{"mailbox":"Projects-Alpha"`)
+	require.Contains(string(data), `"<alpha-reply-2@example.org>":{"mailbox":"Projects-Alpha"`)
+}
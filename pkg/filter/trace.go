@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Trace explains how a filter was evaluated against a message. It can be marshalled to JSON for tooling.
+type Trace struct {
+	Filter  string       `json:"filter,omitempty"`
+	Matched bool         `json:"matched"`
+	Rule    int          `json:"rule,omitempty"` // number of the matching rule, starting at 1
+	Rules   []*TraceNode `json:"rules"`
+
+	Captures map[string]string `json:"captures,omitempty"` // named captures of the regular expressions in the matching rule
+}
+
+// TraceNode is an evaluated group or condition of a rule. Groups stop evaluating as soon as their result is clear, so skipped conditions don't show up.
+type TraceNode struct {
+	Condition string       `json:"condition"`         // group operator or condition like "and", "subject" or "size"
+	Matched   bool         `json:"matched"`           // result of the node, negated for not groups
+	Pattern   string       `json:"pattern,omitempty"` // pattern that decided the result of a condition
+	Value     string       `json:"value,omitempty"`   // message value the pattern was matched against, e.g. a header value
+	Children  []*TraceNode `json:"children,omitempty"`
+}
+
+// Decision returns the condition that decided the result of the filter. It is nil if no rule was evaluated.
+func (trace *Trace) Decision() *TraceNode {
+	if len(trace.Rules) == 0 {
+		return nil
+	}
+
+	node := trace.Rules[len(trace.Rules)-1]
+	if trace.Rule > 0 {
+		node = trace.Rules[trace.Rule-1]
+	}
+
+	// groups stop at the condition that decides their result, so it's always the last evaluated one
+	for len(node.Children) > 0 {
+		node = node.Children[len(node.Children)-1]
+	}
+
+	return node
+}
+
+// Path returns the way through the rule tree to the deciding condition, e.g. ["rule #2", "and", "not", "subject"].
+func (trace *Trace) Path() []string {
+	if len(trace.Rules) == 0 {
+		return nil
+	}
+
+	ruleNum := len(trace.Rules)
+	if trace.Rule > 0 {
+		ruleNum = trace.Rule
+	}
+
+	path := []string{fmt.Sprintf("rule #%v", ruleNum)}
+	for node := trace.Rules[ruleNum-1]; node != nil; {
+		path = append(path, node.Condition)
+
+		if len(node.Children) == 0 {
+			break
+		}
+		node = node.Children[len(node.Children)-1]
+	}
+
+	return path
+}
+
+// Summary describes the trace in one line. Trace deliberately isn't a fmt.Stringer so that structured loggers encode the whole tree.
+func (trace *Trace) Summary() string {
+	decision := trace.Decision()
+	if decision == nil {
+		return fmt.Sprintf("filter %q: matched=%v", trace.Filter, trace.Matched)
+	}
+
+	return fmt.Sprintf("filter %q: matched=%v path=%v pattern=%q value=%q", trace.Filter, trace.Matched, strings.Join(trace.Path(), " > "), decision.Pattern, decision.Value)
+}
+
+// condition names the condition of the node. Like all TraceNode helpers it is a no-op on nil nodes so that matchers don't need to check whether tracing is enabled.
+func (node *TraceNode) condition(name string) {
+	if node == nil {
+		return
+	}
+
+	node.Condition = name
+}
+
+// decide records the pattern and the message value that decided the result of a condition.
+func (node *TraceNode) decide(pattern string, value string) {
+	if node == nil {
+		return
+	}
+
+	node.Pattern = pattern
+	node.Value = value
+}
+
+// child adds a node for a sub condition. It returns nil if the parent isn't traced.
+func (node *TraceNode) child() *TraceNode {
+	if node == nil {
+		return nil
+	}
+
+	child := &TraceNode{}
+	node.Children = append(node.Children, child)
+	return child
+}
+
+func (node *TraceNode) result(matched bool) {
+	if node == nil {
+		return
+	}
+
+	node.Matched = matched
+}
+
+func (p pattern) String() string {
+	switch p.mode {
+	case MatchModeAuto:
+		return p.value
+	case MatchModeNumeric:
+		return p.comparisons.String()
+	default:
+		return fmt.Sprintf("%v: %v", p.mode, p.value)
+	}
+}
+
+func (cmps comparisons) String() string {
+	var s []string
+	for _, cmp := range cmps {
+		s = append(s, fmt.Sprintf("%v: %v", cmp.op, cmp.value))
+	}
+
+	return "{" + strings.Join(s, ", ") + "}"
+}
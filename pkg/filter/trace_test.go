@@ -0,0 +1,90 @@
+package filter_test
+
+import (
+	"encoding/json"
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	require := require.New(t)
+
+	vendorFilter := filter.Filter{RuleSet: filter.RuleSet{
+		{"or": []map[string]interface{}{{"subject": "foo"}}},
+		{"and": []map[string]interface{}{
+			{"from": map[string]interface{}{"contains": "vendor"}},
+			{"not": []map[string]interface{}{{"subject": "invoice"}}},
+		}},
+	}}
+
+	orderMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "shop <shop@vendor.example>", "subject": "your order"})
+	invoiceMsg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "shop <shop@vendor.example>", "subject": "invoice 123"})
+
+	// ACTUAL TESTS BELOW
+
+	// Matching message
+	trace, err := vendorFilter.Explain(orderMsg)
+	require.NoError(err)
+	require.True(trace.Matched)
+	require.Equal(2, trace.Rule)
+	require.Equal([]string{"rule #2", "and", "not", "subject"}, trace.Path())
+	require.Equal(&filter.TraceNode{Condition: "subject", Matched: false, Value: "your order"}, trace.Decision())
+	require.Equal(&filter.TraceNode{Condition: "from", Matched: true, Pattern: "contains: vendor", Value: "shop <shop@vendor.example>"}, trace.Rules[1].Children[0])
+
+	// Non-matching message
+	trace, err = vendorFilter.Explain(invoiceMsg)
+	require.NoError(err)
+	require.False(trace.Matched)
+	require.Equal(0, trace.Rule)
+	require.Equal([]string{"rule #2", "and", "not", "subject"}, trace.Path())
+	require.Equal(&filter.TraceNode{Condition: "subject", Matched: true, Pattern: "invoice", Value: "invoice 123"}, trace.Decision())
+	require.False(trace.Rules[1].Children[1].Matched) // not
+
+	// Machine-readable form
+	trace.Filter = "vendor"
+	traceJSON, err := json.Marshal(trace)
+	require.NoError(err)
+	require.JSONEq(`{
+		"filter": "vendor",
+		"matched": false,
+		"rules": [
+			{"condition": "or", "matched": false, "children": [
+				{"condition": "subject", "matched": false, "value": "invoice 123"}
+			]},
+			{"condition": "and", "matched": false, "children": [
+				{"condition": "from", "matched": true, "pattern": "contains: vendor", "value": "shop <shop@vendor.example>"},
+				{"condition": "not", "matched": false, "children": [
+					{"condition": "subject", "matched": true, "pattern": "invoice", "value": "invoice 123"}
+				]}
+			]}
+		]
+	}`, string(traceJSON))
+	require.Equal(`filter "vendor": matched=false path=rule #2 > and > not > subject pattern="invoice" value="invoice 123"`, trace.Summary())
+
+	// Other conditions
+	sizeFilter := filter.Filter{RuleSet: filter.RuleSet{{"and": []map[string]interface{}{{"size": map[string]interface{}{"gt": "1K"}}, {"x-spam-score": map[string]interface{}{"ge": 5}}}}}}
+	trace, err = sizeFilter.Explain(server.NewMessage(&imapUtil.Message{Size: 2048}, server.MessageHeaders{"x-spam-score": "7.3"}))
+	require.NoError(err)
+	require.True(trace.Matched)
+	require.Equal(&filter.TraceNode{Condition: "size", Matched: true, Pattern: "{gt: 1024}", Value: "2048"}, trace.Rules[0].Children[0])
+	require.Equal(&filter.TraceNode{Condition: "x-spam-score", Matched: true, Pattern: "{ge: 5}", Value: "7.3"}, trace.Rules[0].Children[1])
+
+	// Explain always agrees with Match
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestParserRuleSet.yaml")
+	require.NoError(err)
+
+	msg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"from": "foo@example.com", "to": "me@example.com", "subject": "with löve", "x-spam-score": "7.3"})
+	for filterName, testFilter := range cfg.Filters["test"] {
+		matched, err := testFilter.Match(msg)
+		require.NoError(err)
+
+		trace, err := testFilter.Explain(msg)
+		require.NoError(err)
+		require.Equal(matched, trace.Matched, "filter %q", filterName)
+		require.NotNil(trace.Decision(), "filter %q", filterName)
+	}
+}
@@ -69,6 +69,11 @@ func GetLogLevel() string {
 	return log.level
 }
 
+// DebugEnabled reports whether debug messages are logged so that expensive debug information can be skipped otherwise.
+func DebugEnabled() bool {
+	return log.level == "debug" || log.level == "trace"
+}
+
 func Panic(msg string, err error) {
 	log.logger.With("err", err).Panic(msg)
 }
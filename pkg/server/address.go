@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	mailUtil "github.com/emersion/go-message/mail"
+	"strings"
+)
+
+// Address is a parsed and lowercased address of an address list header like From, To, Cc or Reply-To.
+type Address struct {
+	Name    string // display name, e.g. "example.com support"
+	Address string // e.g. "support@example.com"
+}
+
+func newAddress(addr *mailUtil.Address) Address {
+	return Address{
+		Name:    strings.ToLower(strings.TrimSpace(addr.Name)),
+		Address: strings.ToLower(strings.TrimSpace(addr.Address)),
+	}
+}
+
+// LocalPart returns the part of the address before the last @.
+func (addr Address) LocalPart() string {
+	if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+		return addr.Address[:i]
+	}
+
+	return addr.Address
+}
+
+// Domain returns the part of the address after the last @.
+func (addr Address) Domain() string {
+	if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+		return addr.Address[i+1:]
+	}
+
+	return ""
+}
+
+// String formats the address like it is stored in the message headers: "name <address>"
+func (addr Address) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%v <%v>", addr.Name, addr.Address))
+}
+
+// AddressList returns the parsed addresses of an address list header. If the message wasn't fetched from a server, the header value is parsed instead.
+func (msg *Message) AddressList(fieldName string) []Address {
+	fieldName = strings.ToLower(fieldName)
+
+	if addrs, ok := msg.Addresses[fieldName]; ok {
+		return addrs
+	}
+
+	var values []string
+	switch val := msg.Headers[fieldName].(type) {
+	case string:
+		values = append(values, val)
+	case []string:
+		values = val
+	}
+
+	var addrs []Address
+	for _, value := range values {
+		parsed, err := mailUtil.ParseAddressList(value)
+		if err != nil {
+			// not an address list, so there is nothing to match on
+			continue
+		}
+
+		for _, addr := range parsed {
+			addrs = append(addrs, newAddress(addr))
+		}
+	}
+
+	return addrs
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"strings"
+)
+
+// AuthResult is the result of one authentication method like DKIM, SPF or DMARC as reported by a mail server in the Authentication-Results (RFC 8601) or Received-SPF (RFC 7208) headers.
+// Results are only trustworthy if AuthServID is the one of the own mail server, since everybody can add these headers to a message.
+type AuthResult struct {
+	AuthServID string            // server that added the header, the receiver for Received-SPF
+	Method     string            // e.g. dkim, spf, dmarc or arc
+	Result     string            // e.g. pass, fail, softfail or none
+	Reason     string            // optional reason given by the server
+	Properties map[string]string // e.g. header.d => example.com, smtp.mailfrom => user@example.com
+}
+
+// Domain returns the domain the result was reported for: header.d for DKIM, header.from for DMARC and the domain of smtp.mailfrom or smtp.helo for SPF.
+func (result AuthResult) Domain() string {
+	var keys []string
+
+	switch result.Method {
+	case "dkim":
+		keys = []string{"header.d", "header.i"}
+	case "dmarc":
+		keys = []string{"header.from"}
+	case "spf":
+		keys = []string{"smtp.mailfrom", "smtp.helo"}
+	default:
+		return ""
+	}
+
+	for _, key := range keys {
+		if value := result.Properties[key]; value != "" {
+			// addresses like smtp.mailfrom or header.i
+			if i := strings.LastIndex(value, "@"); i >= 0 {
+				return value[i+1:]
+			}
+
+			return value
+		}
+	}
+
+	return ""
+}
+
+// AuthResults returns the parsed results of all Authentication-Results and Received-SPF headers of the message, in header order.
+func (msg *Message) AuthResults() []AuthResult {
+	var results []AuthResult
+
+	for _, value := range msg.headerValues("authentication-results") {
+		results = append(results, parseAuthResults(value)...)
+	}
+
+	for _, value := range msg.headerValues("received-spf") {
+		if result, ok := parseReceivedSPF(value); ok {
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
+
+// TrustedAuthResults returns the results of a method from the topmost Authentication-Results header of one of the trusted authserv-ids,
+// or for SPF from the topmost trusted Received-SPF header if that header doesn't report SPF. Headers further down may have been added by
+// the sender with the authserv-id of the own mail server, so only the topmost one added by the own server is trusted (RFC 8601, section 5).
+// Results are nil if the trusted header doesn't report the method.
+func (msg *Message) TrustedAuthResults(method string, authServIDs []string) []AuthResult {
+	for _, value := range msg.headerValues("authentication-results") {
+		if !contains(authServIDs, parseAuthServID(value)) {
+			continue
+		}
+
+		var results []AuthResult
+		for _, result := range parseAuthResults(value) {
+			if result.Method == method {
+				results = append(results, result)
+			}
+		}
+
+		if len(results) > 0 {
+			return results
+		}
+
+		break
+	}
+
+	if method != "spf" {
+		return nil
+	}
+
+	for _, value := range msg.headerValues("received-spf") {
+		if result, ok := parseReceivedSPF(value); ok && contains(authServIDs, result.AuthServID) {
+			return []AuthResult{result}
+		}
+	}
+
+	return nil
+}
+
+func (msg *Message) headerValues(fieldName string) []string {
+	switch val := msg.Headers[fieldName].(type) {
+	case string:
+		return []string{val}
+	case []string:
+		return val
+	}
+
+	return nil
+}
+
+// parseAuthResults parses an Authentication-Results header value like
+// "mx.example.com; dkim=pass header.d=example.com; spf=fail smtp.mailfrom=example.com".
+// Malformed result entries are skipped.
+func parseAuthResults(value string) []AuthResult {
+	var results []AuthResult
+
+	authServID := parseAuthServID(value)
+	if authServID == "" {
+		return nil
+	}
+
+	parts := splitOutsideQuotes(stripComments(value), ';')
+
+	for _, part := range parts[1:] {
+		fields := fieldsOutsideQuotes(joinAssignments(part))
+		if len(fields) == 0 || fields[0] == "none" {
+			continue
+		}
+
+		method, result, ok := strings.Cut(fields[0], "=")
+		if !ok {
+			continue
+		}
+
+		// methods may have a version like dkim/1
+		method, _, _ = strings.Cut(method, "/")
+
+		authResult := AuthResult{
+			AuthServID: authServID,
+			Method:     strings.ToLower(method),
+			Result:     strings.ToLower(unquote(result)),
+			Properties: map[string]string{},
+		}
+
+		for _, field := range fields[1:] {
+			key, val, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+
+			key = strings.ToLower(key)
+			if key == "reason" {
+				authResult.Reason = unquote(val)
+			} else {
+				authResult.Properties[key] = strings.ToLower(unquote(val))
+			}
+		}
+
+		results = append(results, authResult)
+	}
+
+	return results
+}
+
+// parseAuthServID returns the authserv-id of an Authentication-Results header value, without its optional version
+func parseAuthServID(value string) string {
+	parts := splitOutsideQuotes(stripComments(value), ';')
+	if len(parts) == 0 {
+		return ""
+	}
+
+	header := strings.Fields(parts[0])
+	if len(header) == 0 {
+		return ""
+	}
+
+	return strings.ToLower(unquote(header[0]))
+}
+
+// parseReceivedSPF parses a Received-SPF header value like
+// "pass (comment) receiver=mx.example.com; client-ip=192.0.2.1; envelope-from=user@example.com; helo=mail.example.com".
+func parseReceivedSPF(value string) (AuthResult, bool) {
+	fields := fieldsOutsideQuotes(joinAssignments(strings.ReplaceAll(stripComments(value), ";", " ")))
+	if len(fields) == 0 || strings.Contains(fields[0], "=") {
+		return AuthResult{}, false
+	}
+
+	result := AuthResult{Method: "spf", Result: strings.ToLower(fields[0]), Properties: map[string]string{}}
+
+	for _, field := range fields[1:] {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+
+		val = strings.ToLower(unquote(val))
+		switch strings.ToLower(key) {
+		case "receiver":
+			result.AuthServID = val
+		case "envelope-from":
+			result.Properties["smtp.mailfrom"] = val
+		case "helo":
+			result.Properties["smtp.helo"] = val
+		case "client-ip":
+			result.Properties["policy.client-ip"] = val
+		}
+	}
+
+	return result, true
+}
+
+// stripComments removes (possibly nested) comments outside of quoted strings and unfolds the header.
+func stripComments(value string) string {
+	var stripped strings.Builder
+	depth := 0
+	quoted := false
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case c == '\\' && (quoted || depth > 0) && i+1 < len(value):
+			if depth == 0 {
+				stripped.WriteByte(c)
+				stripped.WriteByte(value[i+1])
+			}
+			i++
+			continue
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			stripped.WriteByte(' ')
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			continue
+		case c == '\r' || c == '\n' || c == '\t':
+			c = ' '
+		}
+
+		if depth == 0 {
+			stripped.WriteByte(c)
+		}
+	}
+
+	return stripped.String()
+}
+
+// joinAssignments removes whitespace around = so that "key = value" becomes one field
+func joinAssignments(value string) string {
+	for _, old := range []string{" =", "= "} {
+		for strings.Contains(value, old) {
+			value = strings.ReplaceAll(value, old, "=")
+		}
+	}
+
+	return value
+}
+
+func splitOutsideQuotes(value string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && quoted:
+			i++
+		case value[i] == '"':
+			quoted = !quoted
+		case value[i] == sep && !quoted:
+			parts = append(parts, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(parts, strings.TrimSpace(value[start:]))
+}
+
+func fieldsOutsideQuotes(value string) []string {
+	var fields []string
+
+	for _, field := range splitOutsideQuotes(value, ' ') {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+func unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+
+	value = value[1 : len(value)-1]
+
+	var unquoted strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		unquoted.WriteByte(value[i])
+	}
+
+	return unquoted.String()
+}
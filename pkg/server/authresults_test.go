@@ -0,0 +1,75 @@
+package server_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAuthResults(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	authResultsTests := []struct {
+		headers server.MessageHeaders
+		results []server.AuthResult
+		domains []string
+	}{
+		{ // RFC 8601 appendix B.6
+			headers: server.MessageHeaders{"authentication-results": "example.com; spf=pass smtp.mailfrom=example.net (comment) header.from=example.net; sender-id=pass header.from=example.net; dkim=pass (good signature) header.d=mail-router.example.net; dkim=fail (bad signature) header.d=newyork.example.com"},
+			results: []server.AuthResult{
+				{AuthServID: "example.com", Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "example.net", "header.from": "example.net"}},
+				{AuthServID: "example.com", Method: "sender-id", Result: "pass", Properties: map[string]string{"header.from": "example.net"}},
+				{AuthServID: "example.com", Method: "dkim", Result: "pass", Properties: map[string]string{"header.d": "mail-router.example.net"}},
+				{AuthServID: "example.com", Method: "dkim", Result: "fail", Properties: map[string]string{"header.d": "newyork.example.com"}},
+			},
+			domains: []string{"example.net", "", "mail-router.example.net", "newyork.example.com"},
+		},
+		{ // several headers, versions, reasons, quoted values, folding and whitespace around =
+			headers: server.MessageHeaders{"authentication-results": []string{
+				"mx.example.com 1; none",
+				"mx.example.com;\r\n\tdmarc = fail (p=reject dis=none) header.from=paypal.com;\r\n\tdkim/1=neutral reason=\"no key; retry\" header.i=\"@paypal.com\"",
+			}},
+			results: []server.AuthResult{
+				{AuthServID: "mx.example.com", Method: "dmarc", Result: "fail", Properties: map[string]string{"header.from": "paypal.com"}},
+				{AuthServID: "mx.example.com", Method: "dkim", Result: "neutral", Reason: "no key; retry", Properties: map[string]string{"header.i": "@paypal.com"}},
+			},
+			domains: []string{"paypal.com", "paypal.com"},
+		},
+		{ // RFC 7208 section 9.1
+			headers: server.MessageHeaders{"received-spf": "pass (mybox.example.org: domain of myname@example.com designates 192.0.2.1 as permitted sender) receiver=mybox.example.org; client-ip=192.0.2.1; envelope-from=\"myname@example.com\"; helo=foo.example.com;"},
+			results: []server.AuthResult{
+				{AuthServID: "mybox.example.org", Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "myname@example.com", "smtp.helo": "foo.example.com", "policy.client-ip": "192.0.2.1"}},
+			},
+			domains: []string{"example.com"},
+		},
+		{ // SPF results without envelope sender are reported for the HELO name
+			headers: server.MessageHeaders{"received-spf": "none (mx.example.com: no spf record) receiver=mx.example.com; helo=mail.example.org"},
+			results: []server.AuthResult{
+				{AuthServID: "mx.example.com", Method: "spf", Result: "none", Properties: map[string]string{"smtp.helo": "mail.example.org"}},
+			},
+			domains: []string{"mail.example.org"},
+		},
+		{
+			headers: server.MessageHeaders{"authentication-results": "", "received-spf": "receiver=mx.example.com"},
+		},
+		{
+			headers: server.MessageHeaders{"subject": "no results"},
+		},
+	}
+
+	for i, test := range authResultsTests {
+		msg := server.NewMessage(&imapUtil.Message{}, test.headers)
+
+		results := msg.AuthResults()
+		require.Equal(test.results, results, "Test #%v", i+1)
+
+		var domains []string
+		for _, result := range results {
+			domains = append(domains, result.Domain())
+		}
+		require.Equal(test.domains, domains, "Test #%v", i+1)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset" // decode all common charsets, not only UTF-8 and US-ASCII
+	"html"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// DefaultBodyMaxSize is the number of bytes fetched per text part if the connection doesn't set bodymaxsize.
+const DefaultBodyMaxSize = 64 * 1024
+
+var (
+	htmlInvisibleRegEx = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	htmlTagRegEx       = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// FetchText fetches the text parts of a message and decodes them by transfer encoding and charset. Plain text parts are preferred over HTML parts.
+// Only the first maxSize bytes of every text part are downloaded (partial BODY.PEEK) so that neither attachments nor huge messages are transferred and the message isn't marked as seen.
+func (conn *Connection) FetchText(mailbox string, uid uint32, maxSize uint32) (string, error) {
+	// Re-login if necessary
+	if err := conn.ensureConnected(); err != nil {
+		return "", err
+	}
+
+	imapMessage, err := conn.fetchOne(mailbox, uid, []imapUtil.FetchItem{imapUtil.FetchBodyStructure})
+	if err != nil {
+		return "", err
+	}
+
+	if imapMessage.BodyStructure == nil {
+		return "", fmt.Errorf("server didn't return the body structure of message %v", uid)
+	}
+
+	return conn.fetchTextParts(mailbox, uid, imapMessage.BodyStructure, maxSize)
+}
+
+// fetchTextParts fetches and decodes the text parts of a message whose body structure is already known.
+func (conn *Connection) fetchTextParts(mailbox string, uid uint32, bodyStructure *imapUtil.BodyStructure, maxSize uint32) (string, error) {
+	// Re-login if necessary
+	if err := conn.ensureConnected(); err != nil {
+		return "", err
+	}
+
+	if maxSize == 0 {
+		maxSize = DefaultBodyMaxSize
+	}
+
+	log.Debugw("Starting to fetch message text", "mailbox", mailbox, "uid", uid, "maxSize", maxSize)
+
+	paths, parts := findTextParts(bodyStructure)
+	if len(parts) == 0 {
+		return "", nil
+	}
+
+	var sections []*imapUtil.BodySectionName
+	var items []imapUtil.FetchItem
+	for _, path := range paths {
+		section := &imapUtil.BodySectionName{BodyPartName: imapUtil.BodyPartName{Path: path}, Peek: true, Partial: []int{0, int(maxSize)}}
+		sections = append(sections, section)
+		items = append(items, section.FetchItem())
+	}
+
+	imapMessage, err := conn.fetchOne(mailbox, uid, items)
+	if err != nil {
+		return "", err
+	}
+
+	var texts []string
+	for i, section := range sections {
+		text, err := decodeText(parts[i], imapMessage.GetBody(section))
+		if err != nil {
+			log.Errorw("Failed to decode message text", err, "mailbox", mailbox, "uid", uid, "part", paths[i])
+			return "", err
+		}
+
+		texts = append(texts, text)
+	}
+
+	return strings.Join(texts, "\n"), nil
+}
+
+// FetchRaw fetches a section of a message undecoded, e.g. the header section or the entire message. The message isn't marked as seen.
+func (conn *Connection) FetchRaw(mailbox string, uid uint32, specifier imapUtil.PartSpecifier) ([]byte, error) {
+	// Re-login if necessary
+	if err := conn.ensureConnected(); err != nil {
+		return nil, err
+	}
+
+	section := &imapUtil.BodySectionName{BodyPartName: imapUtil.BodyPartName{Specifier: specifier}, Peek: true}
+	imapMessage, err := conn.fetchOne(mailbox, uid, []imapUtil.FetchItem{section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+
+	literal := imapMessage.GetBody(section)
+	if literal == nil {
+		return nil, fmt.Errorf("server didn't return the requested section of message %v", uid)
+	}
+
+	return ioutil.ReadAll(literal)
+}
+
+func (conn *Connection) fetchOne(mailbox string, uid uint32, items []imapUtil.FetchItem) (*imapUtil.Message, error) {
+	// Select mailbox
+	if _, err := conn.Select(mailbox, true, false); err != nil {
+		log.Errorw("Failed to open mailbox to fetch message", err, "mailbox", mailbox)
+		return nil, err
+	}
+
+	seqset := imapUtil.SeqSet{}
+	seqset.AddNum(uid)
+
+	imapMessages := make(chan *imapUtil.Message, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- conn.imapClient.UidFetch(&seqset, items, imapMessages)
+	}()
+
+	if err := <-errs; err != nil {
+		log.Errorw("Failed to fetch message from mailbox", err, "mailbox", mailbox, "uid", uid)
+		return nil, err
+	}
+
+	imapMessage := <-imapMessages
+	if imapMessage == nil {
+		return nil, fmt.Errorf("message %v not found in mailbox %q", uid, mailbox)
+	}
+
+	return imapMessage, nil
+}
+
+// findTextParts returns the inline text/plain parts of a message or its text/html parts if there is no plain text.
+func findTextParts(bodyStructure *imapUtil.BodyStructure) ([][]int, []*imapUtil.BodyStructure) {
+	found := map[string][][]int{}
+	foundParts := map[string][]*imapUtil.BodyStructure{}
+
+	bodyStructure.Walk(func(path []int, part *imapUtil.BodyStructure) bool {
+		if !strings.EqualFold(part.MIMEType, "text") || strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+
+		subType := strings.ToLower(part.MIMESubType)
+		if subType != "plain" && subType != "html" {
+			return true
+		}
+
+		found[subType] = append(found[subType], path)
+		foundParts[subType] = append(foundParts[subType], part)
+		return true
+	})
+
+	if len(found["plain"]) > 0 {
+		return found["plain"], foundParts["plain"]
+	}
+
+	return found["html"], foundParts["html"]
+}
+
+func decodeText(part *imapUtil.BodyStructure, body imapUtil.Literal) (string, error) {
+	if body == nil {
+		return "", nil
+	}
+
+	var header message.Header
+	header.SetContentType(strings.ToLower(part.MIMEType+"/"+part.MIMESubType), part.Params)
+	if part.Encoding != "" {
+		header.Set("Content-Transfer-Encoding", part.Encoding)
+	}
+
+	entity, err := message.New(header, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return "", err
+	}
+
+	// Partial fetches can cut off encoded data, so keep whatever could be decoded
+	decoded, _ := ioutil.ReadAll(entity.Body)
+	text := string(decoded)
+
+	if strings.EqualFold(part.MIMESubType, "html") {
+		text = htmlInvisibleRegEx.ReplaceAllString(text, " ")
+		text = htmlTagRegEx.ReplaceAllString(text, " ")
+		text = html.UnescapeString(text)
+	}
+
+	return text, nil
+}
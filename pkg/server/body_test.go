@@ -0,0 +1,60 @@
+package server_test
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/server"
+	"github.com/arnisoph/postisto/test/integration"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFetchText(t *testing.T) {
+	require := require.New(t)
+
+	testContainer := integration.NewTestContainer()
+	acc := integration.NewAccount(t, testContainer.IP, "", "test", testContainer.Imap, true, false, true, nil, testContainer.Redis)
+
+	require.NoError(acc.Connection.Connect())
+	defer func() {
+		require.Nil(acc.Connection.Disconnect())
+	}()
+
+	for _, mailNum := range []int{10, 3, 14} {
+		require.Nil(acc.Connection.Upload(fmt.Sprintf("../../test/data/mails/log%v.txt", mailNum), "INBOX", []string{}))
+	}
+
+	// ACTUAL TESTS BELOW
+
+	fetchedMails, err := acc.Connection.SearchAndFetch("INBOX", nil, nil)
+	require.NoError(err)
+	require.Len(fetchedMails, 3)
+
+	// multipart/alternative, quoted-printable UTF-8: the plain text part is preferred
+	text, err := fetchedMails[0].Text()
+	require.NoError(err)
+	require.Contains(text, "Connecting you to Jenny. Shubham if you haven’t already found a time to")
+	require.NotContains(text, "<html")
+
+	// text/html only, quoted-printable ISO-8859-1: tags are stripped and entities decoded
+	text, err = fetchedMails[1].Text()
+	require.NoError(err)
+	require.Contains(text, "Hi Shubham Sharma,")
+	require.Contains(text, "“lined up interviews")
+	require.NotContains(text, "<div")
+
+	// multipart/mixed with PDF attachment: the attachment isn't fetched
+	text, err = fetchedMails[2].Text()
+	require.NoError(err)
+	require.Contains(text, "---------- Forwarded message ----------")
+	require.NotContains(text, "%PDF")
+
+	// Fetching the text doesn't mark the message as seen
+	flags, err := acc.Connection.GetFlags("INBOX", fetchedMails[0].RawMessage.Uid)
+	require.NoError(err)
+	require.NotContains(flags, server.SeenFlag)
+
+	// Only the first bytes of every text part are fetched
+	text, err = acc.Connection.FetchText("INBOX", fetchedMails[0].RawMessage.Uid, 16)
+	require.NoError(err)
+	require.LessOrEqual(len(text), 16)
+}
@@ -20,8 +20,13 @@ type Connection struct {
 	Starttls      *bool  `yaml:"starttls"`
 	TLSVerify     *bool  `yaml:"tlsverify"`
 	TLSCACertFile string `yaml:"cacertfile"`
+	BodyMaxSize   uint32 `yaml:"bodymaxsize"`
+
+	Threads    *ThreadIndex    `yaml:"-"` // looks up the mailboxes of thread parents, nil if not configured for the account
+	Duplicates *DuplicateIndex `yaml:"-"` // looks up earlier copies of messages, nil if not configured for the account
 
 	imapClient *imapClientPkg.Client
+	delimiter  *string
 }
 
 // Manually connect to the IMAP server. Usually the session to the IMAP server is re-established automatically if we're disconnected or logged out.
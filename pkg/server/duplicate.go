@@ -0,0 +1,409 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	imapUtil "github.com/emersion/go-imap"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DuplicateFlag is the keyword that dedupe: flag adds to the extra copies of a message
+	DuplicateFlag = "$Duplicate"
+	// DefaultDuplicateWindow is how far apart copies may have arrived unless the config sets a window
+	DefaultDuplicateWindow = 7 * 24 * time.Hour
+	// duplicateStoreVersion is increased whenever the keys are computed differently so that old stores are rebuilt
+	duplicateStoreVersion = 1
+	// duplicateFetchBatchSize limits how many messages are fetched at once to index a mailbox
+	duplicateFetchBatchSize = 500
+)
+
+// DefaultDuplicateHeaders are the headers that identify copies of a message if they are identified by hash without configured headers
+var DefaultDuplicateHeaders = []string{"from", "to", "cc", "subject", "date"}
+
+// DuplicateIndex finds other copies of a message in its own mailbox and the searched mailboxes. Copies are identified by their Message-ID,
+// or by a hash of some headers and optionally the body text. The keys of the messages are stored per mailbox together with the highest
+// indexed UID, so that only messages that were added since need to be fetched to look up duplicates.
+type DuplicateIndex struct {
+	Mailboxes []string      // names of the searched mailboxes besides the mailbox of the message, * matches any characters like in Lists/*
+	Headers   []string      // hashed headers, copies are identified by their Message-ID if empty
+	Body      bool          // hash the body text as well, which requires fetching it
+	Window    time.Duration // copies that arrived further apart aren't duplicates
+	Target    string        // mailbox that dedupe: move moves the extra copies to
+
+	path    string
+	mu      sync.Mutex
+	store   duplicateStore
+	changed bool
+}
+
+// DuplicateCopy is another copy of a message
+type DuplicateCopy struct {
+	Mailbox string
+	UID     uint32
+	Date    time.Time // INTERNALDATE
+}
+
+type duplicateStore struct {
+	Version   int                               `json:"version"`
+	Key       string                            `json:"key"` // how the keys were computed, the store is rebuilt if it changes
+	Mailboxes map[string]*duplicateMailboxStore `json:"mailboxes"`
+}
+
+type duplicateMailboxStore struct {
+	UIDValidity uint32                     `json:"uid_validity"`
+	LastUID     uint32                     `json:"last_uid"`
+	Copies      map[string][]duplicateCopy `json:"copies"` // key => messages of the mailbox with that key
+}
+
+type duplicateCopy struct {
+	UID  uint32    `json:"uid"`
+	Date time.Time `json:"date"`
+}
+
+// NewDuplicateIndex creates an index that identifies copies by the hash of the headers and the body text, or by their Message-ID if no headers are given.
+// The store is kept in memory only if path is empty, otherwise it's loaded from the JSON file at path if it exists already.
+func NewDuplicateIndex(mailboxes []string, headers []string, body bool, window time.Duration, path string) (*DuplicateIndex, error) {
+	if body && len(headers) == 0 {
+		return nil, fmt.Errorf("hashing the body requires headers to hash")
+	}
+
+	if window < 0 {
+		return nil, fmt.Errorf("window must not be negative")
+	} else if window == 0 {
+		window = DefaultDuplicateWindow
+	}
+
+	var lowerHeaders []string
+	for _, header := range headers {
+		lowerHeaders = append(lowerHeaders, strings.ToLower(header))
+	}
+
+	index := &DuplicateIndex{Mailboxes: mailboxes, Headers: lowerHeaders, Body: body, Window: window, path: path}
+	index.reset()
+
+	if path == "" {
+		return index, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var store duplicateStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("failed to parse duplicate store %q: %v", path, err)
+	}
+
+	if store.Version != duplicateStoreVersion || store.Key != index.store.Key || store.Mailboxes == nil {
+		log.Infow("Warning: duplicate store was built with other settings and is rebuilt", "store", path)
+		return index, nil
+	}
+
+	index.store = store
+	return index, nil
+}
+
+// Key returns what identifies the copies of the message: its Message-ID or the hash of the configured headers and the body text.
+// It's empty if the message has no Message-ID, such messages have no duplicates.
+func (index *DuplicateIndex) Key(msg *Message) (string, error) {
+	if len(index.Headers) == 0 {
+		messageID, _ := msg.Headers["message-id"].(string)
+		return strings.ToLower(strings.TrimSpace(messageID)), nil
+	}
+
+	hash := sha256.New()
+	for _, header := range index.Headers {
+		value := ""
+		if v, ok := msg.Headers[header]; ok {
+			value = strings.TrimSpace(fmt.Sprint(v))
+		}
+
+		fmt.Fprintf(hash, "%v: %v\n", header, value)
+	}
+
+	if index.Body {
+		text, err := msg.Text()
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(hash, "\n%v", strings.Join(strings.Fields(text), " "))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Lookup returns an earlier copy of the message, or nil if the message isn't a duplicate. Copies in other mailboxes are earlier copies,
+// in the mailbox of the message the copy with the lowest UID is the original. The result is remembered for the message.
+func (index *DuplicateIndex) Lookup(msg *Message) (*DuplicateCopy, error) {
+	if msg.duplicateChecked {
+		return msg.duplicate, nil
+	}
+
+	key, err := index.Key(msg)
+	if err != nil || key == "" {
+		return nil, err
+	}
+
+	if msg.conn == nil {
+		return nil, fmt.Errorf("duplicates can't be looked up without a server connection")
+	}
+
+	searched, err := resolveMailboxes(msg.conn, index.Mailboxes)
+	if err != nil {
+		return nil, err
+	}
+
+	// The mailbox of the message is searched first
+	mailboxes := []string{msg.mailbox}
+	for _, mailbox := range searched {
+		if mailbox != msg.mailbox {
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}
+
+	for _, mailbox := range mailboxes {
+		if err := index.update(msg.conn, mailbox); err != nil {
+			return nil, fmt.Errorf("failed to index mailbox %q: %v", mailbox, err)
+		}
+
+		for _, candidate := range index.copies(mailbox, key) {
+			if mailbox == msg.mailbox && candidate.UID >= msg.RawMessage.Uid {
+				continue
+			}
+
+			if diff := msg.InternalDate.Sub(candidate.Date); diff > index.Window || diff < -index.Window {
+				continue
+			}
+
+			// The copy may have been moved or deleted since it was indexed
+			found, err := index.exists(msg.conn, mailbox, candidate.UID)
+			if err != nil {
+				return nil, err
+			}
+
+			if !found {
+				index.remove(mailbox, key, candidate.UID)
+				continue
+			}
+
+			log.Debugw("Found earlier copy of message", "uid", msg.RawMessage.Uid, "copy_mailbox", mailbox, "copy_uid", candidate.UID)
+			msg.duplicate = &DuplicateCopy{Mailbox: mailbox, UID: candidate.UID, Date: candidate.Date}
+			msg.duplicateChecked = true
+			return msg.duplicate, nil
+		}
+	}
+
+	msg.duplicateChecked = true
+	return nil, nil
+}
+
+// Save writes the store to its file if it changed. Messages that arrived longer ago than the window are dropped.
+func (index *DuplicateIndex) Save() error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if index.path == "" || !index.changed {
+		return nil
+	}
+
+	for _, mailboxStore := range index.store.Mailboxes {
+		for key, copies := range mailboxStore.Copies {
+			var kept []duplicateCopy
+			for _, c := range copies {
+				if time.Since(c.Date) <= index.Window {
+					kept = append(kept, c)
+				}
+			}
+
+			if len(kept) == 0 {
+				delete(mailboxStore.Copies, key)
+			} else {
+				mailboxStore.Copies[key] = kept
+			}
+		}
+	}
+
+	data, err := json.Marshal(index.store)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(index.path, data); err != nil {
+		return err
+	}
+
+	index.changed = false
+	return nil
+}
+
+func (index *DuplicateIndex) reset() {
+	key := "message-id"
+	if len(index.Headers) > 0 {
+		key = "hash:" + strings.Join(index.Headers, ",")
+		if index.Body {
+			key += "+body"
+		}
+	}
+
+	index.store = duplicateStore{Version: duplicateStoreVersion, Key: key, Mailboxes: map[string]*duplicateMailboxStore{}}
+}
+
+// update indexes the messages that were added to the mailbox since it was indexed last. The mailbox is indexed from scratch if its UIDVALIDITY changed,
+// then only messages that arrived within the window are fetched.
+func (index *DuplicateIndex) update(conn *Connection, mailbox string) error {
+	status, err := conn.Select(mailbox, true, false)
+	if err != nil {
+		return err
+	}
+
+	index.mu.Lock()
+	mailboxStore := index.store.Mailboxes[mailbox]
+	if mailboxStore == nil || mailboxStore.UIDValidity != status.UidValidity {
+		if mailboxStore != nil {
+			log.Infow("UIDVALIDITY of mailbox changed, indexing duplicates from scratch", "mailbox", mailbox)
+		}
+
+		mailboxStore = &duplicateMailboxStore{UIDValidity: status.UidValidity, Copies: map[string][]duplicateCopy{}}
+		index.store.Mailboxes[mailbox] = mailboxStore
+		index.changed = true
+	}
+	lastUID := mailboxStore.LastUID
+	index.mu.Unlock()
+
+	criteria := imapUtil.NewSearchCriteria()
+	if lastUID == 0 {
+		criteria.Since = time.Now().Add(-index.Window)
+	} else {
+		criteria.Uid = new(imapUtil.SeqSet)
+		criteria.Uid.AddRange(lastUID+1, 0)
+	}
+
+	uids, err := conn.SearchCriteria(mailbox, criteria)
+	if err != nil {
+		return err
+	}
+
+	// UID ranges like 42:* always contain the highest UID, even if it's lower than 42
+	var newUIDs []uint32
+	for _, uid := range uids {
+		if uid > lastUID {
+			newUIDs = append(newUIDs, uid)
+		}
+	}
+
+	sort.Slice(newUIDs, func(i, j int) bool { return newUIDs[i] < newUIDs[j] })
+
+	for start := 0; start < len(newUIDs); start += duplicateFetchBatchSize {
+		end := start + duplicateFetchBatchSize
+		if end > len(newUIDs) {
+			end = len(newUIDs)
+		}
+
+		msgs, err := conn.Fetch(mailbox, newUIDs[start:end])
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			key, err := index.Key(msg)
+			if err != nil {
+				return err
+			}
+
+			if key == "" {
+				continue
+			}
+
+			index.mu.Lock()
+			mailboxStore.Copies[key] = append(mailboxStore.Copies[key], duplicateCopy{UID: msg.RawMessage.Uid, Date: msg.InternalDate})
+			index.mu.Unlock()
+		}
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if len(newUIDs) > 0 {
+		mailboxStore.LastUID = newUIDs[len(newUIDs)-1]
+		index.changed = true
+	}
+
+	// Skip messages that arrived before the window next time
+	if status.UidNext > 0 && status.UidNext-1 > mailboxStore.LastUID {
+		mailboxStore.LastUID = status.UidNext - 1
+		index.changed = true
+	}
+
+	return nil
+}
+
+func (index *DuplicateIndex) copies(mailbox string, key string) []duplicateCopy {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	mailboxStore := index.store.Mailboxes[mailbox]
+	if mailboxStore == nil {
+		return nil
+	}
+
+	copies := append([]duplicateCopy{}, mailboxStore.Copies[key]...)
+	sort.Slice(copies, func(i, j int) bool { return copies[i].UID < copies[j].UID })
+	return copies
+}
+
+func (index *DuplicateIndex) remove(mailbox string, key string, uid uint32) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	mailboxStore := index.store.Mailboxes[mailbox]
+	if mailboxStore == nil {
+		return
+	}
+
+	var kept []duplicateCopy
+	for _, c := range mailboxStore.Copies[key] {
+		if c.UID != uid {
+			kept = append(kept, c)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(mailboxStore.Copies, key)
+	} else {
+		mailboxStore.Copies[key] = kept
+	}
+
+	index.changed = true
+}
+
+func (index *DuplicateIndex) exists(conn *Connection, mailbox string, uid uint32) (bool, error) {
+	criteria := imapUtil.NewSearchCriteria()
+	criteria.Uid = new(imapUtil.SeqSet)
+	criteria.Uid.AddNum(uid)
+
+	uids, err := conn.SearchCriteria(mailbox, criteria)
+	if err != nil {
+		return false, err
+	}
+
+	for _, found := range uids {
+		if found == uid {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
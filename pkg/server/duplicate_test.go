@@ -0,0 +1,100 @@
+package server_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDuplicateIndex(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	byMessageID, err := server.NewDuplicateIndex(nil, nil, false, 0, "")
+	require.NoError(err)
+	require.Equal(server.DefaultDuplicateWindow, byMessageID.Window)
+
+	byHash, err := server.NewDuplicateIndex([]string{"Lists/*"}, []string{"From", "Subject"}, false, 48*time.Hour, "")
+	require.NoError(err)
+	require.Equal([]string{"from", "subject"}, byHash.Headers)
+
+	// Copies share the key, the Message-ID is compared case-insensitively
+	msg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"message-id": "<A@example.com>", "from": "jane <jane@example.com>", "subject": "hello", "x-list": "a"})
+	crossPosted := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"message-id": "<a@example.com>", "from": "jane <jane@example.com>", "subject": "hello", "x-list": "b"})
+	other := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"message-id": "<b@example.com>", "from": "jane <jane@example.com>", "subject": "hello again"})
+
+	keyTests := []struct {
+		index    *server.DuplicateIndex
+		msg      *server.Message
+		other    *server.Message
+		expected bool
+	}{
+		{index: byMessageID, msg: msg, other: crossPosted, expected: true},
+		{index: byMessageID, msg: msg, other: other, expected: false},
+		{index: byHash, msg: msg, other: crossPosted, expected: true},
+		{index: byHash, msg: msg, other: other, expected: false},
+	}
+
+	for i, test := range keyTests {
+		key, err := test.index.Key(test.msg)
+		require.NoError(err)
+		require.NotEmpty(key)
+
+		otherKey, err := test.index.Key(test.other)
+		require.NoError(err)
+		require.Equal(test.expected, key == otherKey, "Test #%v", i+1)
+	}
+
+	key, err := byMessageID.Key(msg)
+	require.NoError(err)
+	require.Equal("<a@example.com>", key)
+
+	// Messages without Message-ID have no duplicates and don't need a lookup
+	original, err := byMessageID.Lookup(server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{}))
+	require.NoError(err)
+	require.Nil(original)
+
+	_, err = byMessageID.Lookup(msg)
+	require.EqualError(err, "duplicates can't be looked up without a server connection")
+
+	// Hashing the body fetches it
+	byBody, err := server.NewDuplicateIndex(nil, []string{"subject"}, true, 0, "")
+	require.NoError(err)
+
+	_, err = byBody.Key(msg)
+	require.EqualError(err, "message text can't be fetched without a server connection")
+
+	msg.SetText("Hello\n\n  Jane")
+	crossPosted.SetText("Hello Jane")
+	key, err = byBody.Key(msg)
+	require.NoError(err)
+	otherKey, err := byBody.Key(crossPosted)
+	require.NoError(err)
+	require.Equal(key, otherKey)
+
+	// Stores built with other settings are rebuilt, broken stores are errors
+	storePath := filepath.Join(t.TempDir(), "duplicates.json")
+	require.NoError(os.WriteFile(storePath, []byte(`{"version": 1, "key": "message-id", "mailboxes": {"INBOX": {"uid_validity": 1, "last_uid": 3, "copies": {}}}}`), 0600))
+
+	_, err = server.NewDuplicateIndex(nil, nil, false, 0, storePath)
+	require.NoError(err)
+
+	_, err = server.NewDuplicateIndex(nil, []string{"subject"}, false, 0, storePath)
+	require.NoError(err)
+
+	require.NoError(os.WriteFile(storePath, []byte("{"), 0600))
+	_, err = server.NewDuplicateIndex(nil, nil, false, 0, storePath)
+	require.EqualError(err, `failed to parse duplicate store "`+storePath+`": unexpected end of JSON input`)
+
+	// Invalid settings
+	_, err = server.NewDuplicateIndex(nil, nil, true, 0, "")
+	require.EqualError(err, "hashing the body requires headers to hash")
+
+	_, err = server.NewDuplicateIndex(nil, nil, false, -time.Hour, "")
+	require.EqualError(err, "window must not be negative")
+}
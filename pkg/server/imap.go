@@ -7,6 +7,7 @@ import (
 	"github.com/arnisoph/postisto/pkg/log"
 	imapUtil "github.com/emersion/go-imap"
 	imapMoveUtil "github.com/emersion/go-imap-move"
+	imapCommands "github.com/emersion/go-imap/commands"
 	"os"
 	"strings"
 	"time"
@@ -80,6 +81,20 @@ func (conn *Connection) Upload(file string, mailbox string, flags []string) erro
 }
 
 func (conn *Connection) Search(mailbox string, withFlags []string, withoutFlags []string) ([]uint32, error) {
+	// Define search criteria
+	criteria := imapUtil.NewSearchCriteria()
+	if len(withFlags) > 0 {
+		criteria.WithFlags = withFlags
+	}
+	if len(withoutFlags) > 0 {
+		criteria.WithoutFlags = withoutFlags
+	}
+
+	return conn.SearchCriteria(mailbox, criteria)
+}
+
+// SearchCriteria returns the UIDs of the messages in the mailbox that match arbitrary search criteria, e.g. headers.
+func (conn *Connection) SearchCriteria(mailbox string, criteria *imapUtil.SearchCriteria) ([]uint32, error) {
 	// Re-login if necessary
 	if err := conn.ensureConnected(); err != nil {
 		return nil, err
@@ -91,15 +106,6 @@ func (conn *Connection) Search(mailbox string, withFlags []string, withoutFlags
 		return nil, err
 	}
 
-	// Define search criteria
-	criteria := imapUtil.NewSearchCriteria()
-	if len(withFlags) > 0 {
-		criteria.WithFlags = withFlags
-	}
-	if len(withoutFlags) > 0 {
-		criteria.WithoutFlags = withoutFlags
-	}
-
 	// Actually search
 	return conn.imapClient.UidSearch(criteria)
 }
@@ -125,7 +131,7 @@ func (conn *Connection) Fetch(mailbox string, uids []uint32) ([]*Message, error)
 
 	var section imapUtil.BodySectionName
 	section.Specifier = imapUtil.HeaderSpecifier // Loads all headers only (no body)
-	items := []imapUtil.FetchItem{section.FetchItem(), imapUtil.FetchUid, imapUtil.FetchEnvelope}
+	items := []imapUtil.FetchItem{section.FetchItem(), imapUtil.FetchUid, imapUtil.FetchEnvelope, imapUtil.FetchInternalDate, imapUtil.FetchRFC822Size, imapUtil.FetchBodyStructure, imapUtil.FetchFlags}
 
 	imapMessages := make(chan *imapUtil.Message, len(uids))
 	errs := make(chan error, 1)
@@ -139,12 +145,24 @@ func (conn *Connection) Fetch(mailbox string, uids []uint32) ([]*Message, error)
 	}
 
 	for imapMessage := range imapMessages {
-		parsedHeaders, err := parseMessageHeaders(imapMessage)
+		header, err := readHeaderSection(imapMessage)
+		if err != nil {
+			log.Errorw("Failed to read message headers", err, "mailbox", mailbox, "message_subject", imapMessage.Envelope.Subject, "message_id", imapMessage.Envelope.MessageId)
+			return nil, err
+		}
+
+		parsedHeaders, parsedAddresses, err := parseMessageHeaders(imapMessage, header)
 		if err != nil {
 			log.Errorw("Failed to parse message headers", err, "mailbox", mailbox, "message_subject", imapMessage.Envelope.Subject, "message_id", imapMessage.Envelope.MessageId)
 			return nil, err
 		}
-		fetchedMails = append(fetchedMails, NewMessage(imapMessage, parsedHeaders))
+		msg := NewMessage(imapMessage, parsedHeaders)
+		msg.Addresses = parsedAddresses
+		msg.header = header
+		msg.conn = conn
+		msg.mailbox = mailbox
+
+		fetchedMails = append(fetchedMails, msg)
 	}
 
 	return fetchedMails, nil
@@ -169,6 +187,55 @@ func (conn *Connection) DeleteMsgs(mailbox string, uids []uint32, expunge bool)
 	return conn.SetFlags(mailbox, uids, "+FLAGS", []interface{}{imapUtil.DeletedFlag}, expunge)
 }
 
+// SupportsUIDPlus returns whether the server supports UIDPLUS, which ExpungeMsgs requires.
+func (conn *Connection) SupportsUIDPlus() (bool, error) {
+	// Re-login if necessary
+	if err := conn.ensureConnected(); err != nil {
+		return false, err
+	}
+
+	return conn.imapClient.Support("UIDPLUS")
+}
+
+// ExpungeMsgs deletes messages for good. It requires UIDPLUS since a plain EXPUNGE would also remove all other messages flagged as \Deleted in the mailbox.
+func (conn *Connection) ExpungeMsgs(mailbox string, uids []uint32) error {
+	// Re-login if necessary
+	if err := conn.ensureConnected(); err != nil {
+		return err
+	}
+
+	uidPlus, err := conn.SupportsUIDPlus()
+	if err != nil {
+		return err
+	}
+
+	if !uidPlus {
+		return fmt.Errorf("server doesn't support UIDPLUS, so messages can't be expunged without expunging all deleted messages of the mailbox")
+	}
+
+	if err := conn.DeleteMsgs(mailbox, uids, false); err != nil {
+		return err
+	}
+
+	seqset := imapUtil.SeqSet{}
+	for _, uid := range uids {
+		seqset.AddNum(uid)
+	}
+
+	cmd := &imapCommands.Uid{Cmd: &imapUtil.Command{Name: "EXPUNGE", Arguments: []interface{}{&seqset}}}
+	status, err := conn.imapClient.Execute(cmd, nil)
+	if err == nil {
+		err = status.Err()
+	}
+
+	if err != nil {
+		log.Errorw("Failed to expunge messages", err, "mailbox", mailbox, "uids", uids)
+		return err
+	}
+
+	return nil
+}
+
 func (conn *Connection) SetFlags(mailbox string, uids []uint32, flagOp string, flags []interface{}, expunge bool) error {
 	// Re-login if necessary
 	if err := conn.ensureConnected(); err != nil {
@@ -312,6 +379,38 @@ func (conn *Connection) List() (map[string]imapUtil.MailboxInfo, error) {
 	return mailboxes, nil
 }
 
+// Delimiter returns the hierarchy delimiter of the server's mailbox names like "/" or ".", or an empty string if the server has no hierarchy.
+func (conn *Connection) Delimiter() (string, error) {
+	if conn.delimiter != nil {
+		return *conn.delimiter, nil
+	}
+
+	// Re-login if necessary
+	if err := conn.ensureConnected(); err != nil {
+		return "", err
+	}
+
+	// LIST with an empty mailbox name returns the delimiter only
+	mailboxesChan := make(chan *imapUtil.MailboxInfo)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- conn.imapClient.List("", "", mailboxesChan)
+	}()
+
+	var delimiter string
+	for mailbox := range mailboxesChan {
+		delimiter = mailbox.Delimiter
+	}
+
+	if err := <-errs; err != nil {
+		log.Error("Failed to query hierarchy delimiter", err)
+		return "", err
+	}
+
+	conn.delimiter = &delimiter
+	return delimiter, nil
+}
+
 //func MoveMail(acc *config.Account, mailbox string, uid uint32) error {
 //	// Move BY COPYing and Deleting it
 //	var err error
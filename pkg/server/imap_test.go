@@ -110,6 +110,11 @@ func TestSetMailFlags(t *testing.T) {
 	flags, err = acc.Connection.GetFlags("INBOX", fetchedMails[0].RawMessage.Uid)
 	require.NoError(err)
 	require.ElementsMatch([]string{"123", "forty-two"}, flags)
+
+	// Flags are fetched along with the message
+	fetchedMails, err = acc.Connection.SearchAndFetch("INBOX", nil, nil)
+	require.NoError(err)
+	require.ElementsMatch([]string{"123", "forty-two"}, fetchedMails[0].Flags)
 }
 
 func TestMoveMails(t *testing.T) {
@@ -276,6 +281,13 @@ func TestParseMailHeaders(t *testing.T) {
 	require.Equal("2392014", fetchedMails[4].Headers["x-mailer-recptid"])
 	require.Equal("foo <a@b.c>, baz <d@e.f>", fetchedMails[4].Headers["cc"])
 	require.ElementsMatch(parserTests[4].received, fetchedMails[4].Headers["received"])
+
+	// Structured addresses
+	require.Equal([]server.Address{{Name: "bigrock.com sales team", Address: "automail@bigrock.com"}}, fetchedMails[3].Addresses["from"])
+	require.Equal("bigrock.com", fetchedMails[3].Addresses["from"][0].Domain())
+	require.Equal("automail", fetchedMails[3].Addresses["from"][0].LocalPart())
+	require.Nil(fetchedMails[4].Addresses["from"]) // invalid-address
+	require.Equal([]server.Address{{Name: "foo", Address: "a@b.c"}, {Name: "baz", Address: "d@e.f"}}, fetchedMails[4].Addresses["cc"])
 }
 
 func TestConnection_List(t *testing.T) {
@@ -306,3 +318,31 @@ func TestConnection_List(t *testing.T) {
 	}
 	require.Equal(mailboxesExpected, mailboxes)
 }
+
+func TestFetchMessageStructure(t *testing.T) {
+	require := require.New(t)
+
+	testContainer := integration.NewTestContainer()
+	acc := integration.NewAccount(t, testContainer.IP, "", "test", testContainer.Imap, true, false, true, nil, testContainer.Redis)
+
+	require.NoError(acc.Connection.Connect())
+	defer func() {
+		require.Nil(acc.Connection.Disconnect())
+	}()
+
+	require.Nil(acc.Connection.Upload("../../test/data/mails/log14.txt", "INBOX", []string{}))
+
+	// ACTUAL TESTS BELOW
+
+	fetchedMails, err := acc.Connection.SearchAndFetch("INBOX", nil, nil)
+	require.NoError(err)
+	require.Len(fetchedMails, 1)
+	require.NotNil(fetchedMails[0].Structure)
+	require.Equal("multipart/mixed", fetchedMails[0].Structure.MIMEType)
+
+	attachments := fetchedMails[0].Attachments()
+	require.Len(attachments, 1)
+	require.Equal("application/pdf", attachments[0].MIMEType)
+	require.Equal("Shubham_Sharma.pdf", attachments[0].Filename)
+	require.Equal([]int{2}, attachments[0].Path)
+}
@@ -1,44 +1,168 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/arnisoph/postisto/pkg/log"
 	imapUtil "github.com/emersion/go-imap"
 	"github.com/emersion/go-message"
 	mailUtil "github.com/emersion/go-message/mail"
+	"io"
 	"strings"
+	"time"
 )
 
 type RawMessage imapUtil.Message
 
 type Message struct {
-	RawMessage imapUtil.Message
-	Headers    MessageHeaders
+	RawMessage   imapUtil.Message
+	Headers      MessageHeaders
+	Date         time.Time            // parsed Date header, zero if missing or unparsable
+	InternalDate time.Time            // INTERNALDATE as reported by the server
+	Size         uint32               // RFC822.SIZE in bytes
+	Flags        []string             // FLAGS at fetch time, system flags like \Seen and keywords like $Junk
+	Addresses    map[string][]Address // parsed address lists of the From, To, Cc and Reply-To headers
+	Structure    *MessagePart         // MIME part tree from BODYSTRUCTURE, nil if it wasn't fetched
+
+	conn            *Connection
+	mailbox         string
+	originalHeaders MessageHeaders // header values in their original case, Headers holds them lowercased for matching
+	text            *string
+	header          []byte
+	source          []byte
+
+	threadChecked    bool
+	thread           string // mailbox of the thread found by ThreadIndex.Lookup
+	duplicateChecked bool
+	duplicate        *DuplicateCopy // earlier copy found by DuplicateIndex.Lookup
 }
 type MessageHeaders map[string]interface{}
 
+// NewMessage creates a message with the given headers. Header values are lowercased for matching, OriginalHeader keeps their case.
 func NewMessage(rawMail *imapUtil.Message, headers MessageHeaders) *Message {
-	return &Message{RawMessage: *rawMail, Headers: headers}
+	msg := &Message{RawMessage: *rawMail, Headers: lowerHeaders(headers), originalHeaders: headers, InternalDate: rawMail.InternalDate, Size: rawMail.Size, Flags: rawMail.Flags}
+
+	if rawMail.Envelope != nil {
+		msg.Date = rawMail.Envelope.Date
+	}
+
+	if rawMail.BodyStructure != nil {
+		msg.Structure = newMessagePart(rawMail.BodyStructure, nil)
+	}
+
+	return msg
 }
 
-func parseMessageHeaders(rawMessage *imapUtil.Message) (MessageHeaders, error) {
-	headers := MessageHeaders{}
+// Text returns the decoded text of the message body. It is fetched from the server only once it is needed for the first time.
+func (msg *Message) Text() (string, error) {
+	if msg.text != nil {
+		return *msg.text, nil
+	}
+
+	if msg.conn == nil {
+		return "", fmt.Errorf("message text can't be fetched without a server connection")
+	}
+
+	var text string
 	var err error
+	if msg.RawMessage.BodyStructure != nil {
+		// The structure was fetched together with the headers already
+		text, err = msg.conn.fetchTextParts(msg.mailbox, msg.RawMessage.Uid, msg.RawMessage.BodyStructure, msg.conn.BodyMaxSize)
+	} else {
+		text, err = msg.conn.FetchText(msg.mailbox, msg.RawMessage.Uid, msg.conn.BodyMaxSize)
+	}
 
-	// Create for mail parsing
+	if err != nil {
+		return "", err
+	}
+
+	msg.SetText(text)
+	return text, nil
+}
+
+// SetText sets the decoded text of the message body so that it doesn't need to be fetched from the server anymore.
+func (msg *Message) SetText(text string) {
+	msg.text = &text
+}
+
+// Mailbox returns the name of the mailbox the message was fetched from, empty if it wasn't fetched from a server.
+func (msg *Message) Mailbox() string {
+	return msg.mailbox
+}
+
+// RawHeader returns the undecoded header section of the message as it was fetched together with the parsed headers.
+func (msg *Message) RawHeader() ([]byte, error) {
+	if msg.header != nil {
+		return msg.header, nil
+	}
+
+	if msg.source != nil {
+		return splitHeader(msg.source), nil
+	}
+
+	return nil, fmt.Errorf("message header wasn't fetched")
+}
+
+// RFC822 returns the whole undecoded message including attachments. It is fetched from the server only once it is needed for the first time.
+func (msg *Message) RFC822() ([]byte, error) {
+	if msg.source != nil {
+		return msg.source, nil
+	}
+
+	if msg.conn == nil {
+		return nil, fmt.Errorf("message can't be fetched without a server connection")
+	}
+
+	source, err := msg.conn.FetchRaw(msg.mailbox, msg.RawMessage.Uid, imapUtil.EntireSpecifier)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.SetRFC822(source)
+	return source, nil
+}
+
+// SetRFC822 sets the whole undecoded message so that it doesn't need to be fetched from the server anymore.
+func (msg *Message) SetRFC822(source []byte) {
+	msg.source = source
+}
+
+// splitHeader returns the header section of a message including the empty line that ends it
+func splitHeader(source []byte) []byte {
+	end := len(source)
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(source, []byte(sep)); i >= 0 && i+len(sep) < end {
+			end = i + len(sep)
+		}
+	}
+
+	return source[:end]
+}
+
+// readHeaderSection reads the undecoded header section that was fetched along with the message
+func readHeaderSection(rawMessage *imapUtil.Message) ([]byte, error) {
 	var section imapUtil.BodySectionName
 	section.Specifier = imapUtil.HeaderSpecifier // Loads all headers only (no body)
 
 	msgBody := rawMessage.GetBody(&section)
 	if msgBody == nil {
-		return headers, fmt.Errorf("server didn't returned message body for mail")
+		return nil, fmt.Errorf("server didn't returned message body for mail")
 	}
 
-	mr, err := mailUtil.CreateReader(msgBody)
+	return io.ReadAll(msgBody)
+}
+
+func parseMessageHeaders(rawMessage *imapUtil.Message, header []byte) (MessageHeaders, map[string][]Address, error) {
+	headers := MessageHeaders{}
+	addresses := map[string][]Address{}
+	var err error
+
+	// Create for mail parsing
+	mr, err := mailUtil.CreateReader(bytes.NewReader(header))
 
 	if err != nil && !message.IsUnknownCharset(err) {
 		log.Errorw("Failed to create message reader", err, "message_id", rawMessage.Envelope.MessageId)
-		return headers, err
+		return headers, addresses, err
 	} else {
 		// The error is not an error because the charset could be determined automatically. Weird logic...
 		err = nil
@@ -47,10 +171,10 @@ func parseMessageHeaders(rawMessage *imapUtil.Message) (MessageHeaders, error) {
 	// Address Lists in headers
 	addrFields := []string{"from", "to", "cc", "reply-to"}
 	for _, fieldName := range addrFields {
-		parsedList, err := parseAddrList(mr, fieldName, mr.Header.Get(fieldName))
+		parsedList, parsedAddrs, err := parseAddrList(mr, fieldName, mr.Header.Get(fieldName))
 
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		} else {
 			if parsedList == "" {
 				// no need to set non-existent fields
@@ -58,13 +182,23 @@ func parseMessageHeaders(rawMessage *imapUtil.Message) (MessageHeaders, error) {
 			}
 
 			headers[fieldName] = parsedList
+			addresses[fieldName] = parsedAddrs
 		}
 	}
 
-	// Some other standard envelope headers
-	headers["subject"] = strings.ToLower(fmt.Sprintf("%v", rawMessage.Envelope.Subject))
-	headers["date"] = strings.ToLower(fmt.Sprintf("%v", rawMessage.Envelope.Date))
-	headers["message-id"] = strings.ToLower(fmt.Sprintf("%v", rawMessage.Envelope.MessageId))
+	// Some other standard envelope headers. Only set them if they are actually present so that rules can test for their existence.
+	envelopeFields := map[string]interface{}{
+		"subject":    rawMessage.Envelope.Subject,
+		"date":       rawMessage.Envelope.Date,
+		"message-id": rawMessage.Envelope.MessageId,
+	}
+	for fieldName, fieldValue := range envelopeFields {
+		if !mr.Header.Has(fieldName) {
+			continue
+		}
+
+		headers[fieldName] = fmt.Sprintf("%v", fieldValue)
+	}
 
 	// All the other headers
 	alreadyHandled := []string{"subject", "date", "message-id"}
@@ -77,7 +211,7 @@ func parseMessageHeaders(rawMessage *imapUtil.Message) (MessageHeaders, error) {
 		}
 
 		fieldName := strings.ToLower(fields.Key())
-		fieldValue := strings.ToLower(fields.Value())
+		fieldValue := fields.Value()
 
 		if contains(alreadyHandled, fieldName) {
 			// we maintain these headers elsewhere
@@ -96,61 +230,83 @@ func parseMessageHeaders(rawMessage *imapUtil.Message) (MessageHeaders, error) {
 		}
 	}
 
-	/*
-		// Process each message's part
-		for {
-			p, err := m.NextPart()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				log.Fatal(err)
-			}
-
-			switch h := p.Header.(type) {
-			case *mail.InlineHeader:
-				// This is the message's text (can be plain-text or HTML)
-				b, _ := ioutil.ReadAll(p.Body)
-				log.Printf("Got text: %v", string(b))
-			case *mail.AttachmentHeader:
-				// This is an attachment
-				filename, _ := h.Filename()
-				log.Printf("Got attachment: %v", filename)
-			}
-
-		}
-	*/
-
-	return headers, err
+	return headers, addresses, err
 }
 
-func parseAddrList(mr *mailUtil.Reader, fieldName string, fallback string) (string, error) {
+// parseAddrList returns the formatted address list of a header along with its structured addresses. Unparsable lists only return the fallback.
+func parseAddrList(mr *mailUtil.Reader, fieldName string, fallback string) (string, []Address, error) {
 	var fieldValue string
+	var parsedAddrs []Address
 	addrs, err := mr.Header.AddressList(fieldName)
 
 	if addrs == nil {
 		// parsing failed, so return own or externally set fallback
 		f := mr.Header.FieldsByKey(fieldName)
 		if !f.Next() {
-			return "", err
+			return "", nil, err
 		} else {
-			return strings.TrimSpace(fallback), nil
+			return strings.TrimSpace(fallback), nil, nil
 		}
 	}
 
 	if err != nil && err.Error() != "mail: missing '@' or angle-addr" { //ignore bad formated addrs
 		// oh, real error
-		return "", err
+		return "", nil, err
 	}
 
 	for _, addr := range addrs {
-		formattedAddr := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v <%v>", addr.Name, addr.Address)))
+		parsedAddr := newAddress(addr)
+		parsedAddrs = append(parsedAddrs, parsedAddr)
+
 		if fieldValue != "" {
 			fieldValue += ", "
 		}
-		fieldValue += formattedAddr
+		// the header keeps the case of the address, it's lowercased for matching like any other header
+		fieldValue += strings.TrimSpace(fmt.Sprintf("%v <%v>", strings.TrimSpace(addr.Name), strings.TrimSpace(addr.Address)))
+	}
+
+	return strings.TrimSpace(fieldValue), parsedAddrs, err
+}
+
+// OriginalHeader returns the values of a header in their original case, e.g. for filing into mailboxes named after them.
+func (msg *Message) OriginalHeader(fieldName string) []string {
+	headers := msg.originalHeaders
+	if headers == nil {
+		headers = msg.Headers
+	}
+
+	switch val := headers[fieldName].(type) {
+	case string:
+		return []string{val}
+	case []string:
+		return val
+	}
+
+	return nil
+}
+
+func lowerHeaders(headers MessageHeaders) MessageHeaders {
+	if headers == nil {
+		return nil
+	}
+
+	lowered := make(MessageHeaders, len(headers))
+	for fieldName, fieldValue := range headers {
+		switch val := fieldValue.(type) {
+		case string:
+			lowered[fieldName] = strings.ToLower(val)
+		case []string:
+			values := make([]string, 0, len(val))
+			for _, v := range val {
+				values = append(values, strings.ToLower(v))
+			}
+			lowered[fieldName] = values
+		default:
+			lowered[fieldName] = val
+		}
 	}
 
-	return strings.TrimSpace(fieldValue), err
+	return lowered
 }
 
 func contains(s []string, e string) bool { //TODO do we really need to implement this?
@@ -0,0 +1,79 @@
+package server
+
+import (
+	imapUtil "github.com/emersion/go-imap"
+	"strings"
+)
+
+// MessagePart is a node of the MIME structure of a message as reported by the server (BODYSTRUCTURE). It is known without downloading the message.
+type MessagePart struct {
+	Path        []int  // IMAP part path, e.g. [2 1] for BODY[2.1]
+	MIMEType    string // lowercased, e.g. "application/pdf"
+	Params      map[string]string
+	Disposition string // lowercased, e.g. "attachment"
+	Filename    string
+	Encoding    string
+	Size        uint32 // encoded size in bytes
+	Parts       []*MessagePart
+}
+
+func newMessagePart(bodyStructure *imapUtil.BodyStructure, path []int) *MessagePart {
+	// Non-multipart messages only have part 1
+	if path == nil && len(bodyStructure.Parts) == 0 {
+		path = []int{1}
+	}
+
+	part := &MessagePart{
+		Path:        path,
+		MIMEType:    strings.ToLower(bodyStructure.MIMEType + "/" + bodyStructure.MIMESubType),
+		Params:      bodyStructure.Params,
+		Disposition: strings.ToLower(bodyStructure.Disposition),
+		Encoding:    strings.ToLower(bodyStructure.Encoding),
+		Size:        bodyStructure.Size,
+	}
+
+	// Undecodable filenames are kept as they are
+	part.Filename, _ = bodyStructure.Filename()
+
+	for i, subStructure := range bodyStructure.Parts {
+		subPath := append(append([]int(nil), path...), i+1)
+		part.Parts = append(part.Parts, newMessagePart(subStructure, subPath))
+	}
+
+	return part
+}
+
+// IsAttachment reports whether the part is an attachment. Inline parts with a filename count as attachments too since some mail clients send them that way.
+func (part *MessagePart) IsAttachment() bool {
+	if strings.HasPrefix(part.MIMEType, "multipart/") {
+		return false
+	}
+
+	return part.Disposition == "attachment" || part.Filename != ""
+}
+
+// Walk calls f for the part and all of its sub parts in depth-first pre-order.
+func (part *MessagePart) Walk(f func(part *MessagePart)) {
+	f(part)
+
+	for _, subPart := range part.Parts {
+		subPart.Walk(f)
+	}
+}
+
+// Attachments returns all attachments of the message based on its structure.
+func (msg *Message) Attachments() []*MessagePart {
+	var attachments []*MessagePart
+
+	if msg.Structure == nil {
+		return attachments
+	}
+
+	msg.Structure.Walk(func(part *MessagePart) {
+		if part.IsAttachment() {
+			attachments = append(attachments, part)
+		}
+	})
+
+	return attachments
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	imapUtil "github.com/emersion/go-imap"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxThreadReferences limits how many Message-IDs of the References header are looked up, the nearest ones are the last ones
+	maxThreadReferences = 10
+	// threadCacheMaxAge is how long cached Message-IDs are kept after they were last seen
+	threadCacheMaxAge = 180 * 24 * time.Hour
+)
+
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// ThreadIndex finds the mailbox of the message a reply refers to by its In-Reply-To and References headers.
+// The mailboxes are searched with IMAP SEARCH HEADER, found Message-IDs are cached so that later replies of the thread don't need to be searched again.
+type ThreadIndex struct {
+	Mailboxes []string // names of the searched mailboxes, * matches any characters like in Projects/*
+
+	path    string
+	mu      sync.Mutex
+	entries map[string]threadCacheEntry
+	changed bool
+}
+
+type threadCacheEntry struct {
+	Mailbox  string    `json:"mailbox"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// NewThreadIndex creates an index that searches the mailboxes. The cache is kept in memory only if path is empty, otherwise it's loaded from the JSON file at path if it exists already.
+func NewThreadIndex(mailboxes []string, path string) (*ThreadIndex, error) {
+	if len(mailboxes) == 0 {
+		return nil, fmt.Errorf("no mailboxes to search for threads configured")
+	}
+
+	index := &ThreadIndex{Mailboxes: mailboxes, path: path, entries: map[string]threadCacheEntry{}}
+	if path == "" {
+		return index, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &index.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse thread cache %q: %v", path, err)
+	}
+
+	return index, nil
+}
+
+// References returns the Message-IDs the message refers to, nearest parent first: In-Reply-To followed by the References from last to first.
+func (msg *Message) References() []string {
+	var ids []string
+	seen := map[string]bool{}
+
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	for _, value := range msg.headerValues("in-reply-to") {
+		for _, id := range messageIDPattern.FindAllString(value, -1) {
+			add(id)
+		}
+	}
+
+	var references []string
+	for _, value := range msg.headerValues("references") {
+		references = append(references, messageIDPattern.FindAllString(value, -1)...)
+	}
+
+	for i := len(references) - 1; i >= 0 && i >= len(references)-maxThreadReferences; i-- {
+		add(references[i])
+	}
+
+	return ids
+}
+
+// Lookup returns the mailbox of the nearest message the message refers to, or an empty string if none of them is found in the searched mailboxes.
+// The mailbox the message is currently in is never returned. The result is remembered for the message.
+func (index *ThreadIndex) Lookup(msg *Message) (string, error) {
+	if msg.threadChecked {
+		return msg.thread, nil
+	}
+
+	mailbox, err := index.lookup(msg)
+	if err != nil {
+		return "", err
+	}
+
+	msg.thread = mailbox
+	msg.threadChecked = true
+
+	return mailbox, nil
+}
+
+func (index *ThreadIndex) lookup(msg *Message) (string, error) {
+	refs := msg.References()
+	if len(refs) == 0 {
+		return "", nil
+	}
+
+	if msg.conn == nil {
+		return "", fmt.Errorf("threads can't be looked up without a server connection")
+	}
+
+	existing, err := msg.conn.List()
+	if err != nil {
+		return "", err
+	}
+
+	// Cached mailboxes are verified since the parent may have been moved since
+	for _, id := range refs {
+		mailbox, ok := index.cached(id)
+		if !ok || mailbox == msg.mailbox {
+			continue
+		}
+
+		if _, ok := existing[mailbox]; ok {
+			uids, err := index.search(msg.conn, mailbox, []string{id})
+			if err != nil {
+				return "", err
+			}
+
+			if len(uids) > 0 {
+				index.Add(id, mailbox)
+				return mailbox, nil
+			}
+		}
+
+		// the parent was moved or its mailbox was deleted since
+		index.remove(id)
+	}
+
+	// All references are searched at once per mailbox. If several mailboxes have referenced messages, the one with the nearest parent wins.
+	var found, foundID string
+	foundRank := len(refs)
+	for _, mailbox := range matchMailboxes(existing, index.Mailboxes) {
+		if mailbox == msg.mailbox {
+			continue
+		}
+
+		uids, err := index.search(msg.conn, mailbox, refs[:foundRank])
+		if err != nil {
+			return "", err
+		}
+
+		if len(uids) == 0 {
+			continue
+		}
+
+		parents, err := msg.conn.Fetch(mailbox, uids)
+		if err != nil {
+			return "", err
+		}
+
+		for _, parent := range parents {
+			id := strings.ToLower(strings.TrimSpace(parent.RawMessage.Envelope.MessageId))
+			for rank, ref := range refs[:foundRank] {
+				if id == strings.ToLower(ref) {
+					found, foundID, foundRank = mailbox, ref, rank
+					break
+				}
+			}
+		}
+
+		if foundRank == 0 {
+			break
+		}
+	}
+
+	if found != "" {
+		log.Debugw("Found parent message of thread", "message_id", foundID, "mailbox", found)
+		index.Add(foundID, found)
+	}
+
+	return found, nil
+}
+
+// Add caches the mailbox of a message, e.g. after it was moved there.
+func (index *ThreadIndex) Add(messageID string, mailbox string) {
+	messageID = strings.ToLower(strings.TrimSpace(messageID))
+	if messageID == "" || mailbox == "" {
+		return
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.entries[messageID] = threadCacheEntry{Mailbox: mailbox, LastSeen: time.Now()}
+	index.changed = true
+}
+
+// Save writes the cache to its file if it changed. Entries that weren't seen for a long time are dropped.
+func (index *ThreadIndex) Save() error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if index.path == "" || !index.changed {
+		return nil
+	}
+
+	for id, entry := range index.entries {
+		if time.Since(entry.LastSeen) > threadCacheMaxAge {
+			delete(index.entries, id)
+		}
+	}
+
+	data, err := json.Marshal(index.entries)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(index.path, data); err != nil {
+		return err
+	}
+
+	index.changed = false
+	return nil
+}
+
+func (index *ThreadIndex) cached(messageID string) (string, bool) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	entry, ok := index.entries[strings.ToLower(messageID)]
+	return entry.Mailbox, ok
+}
+
+func (index *ThreadIndex) remove(messageID string) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	delete(index.entries, strings.ToLower(messageID))
+	index.changed = true
+}
+
+// resolveMailboxes expands mailbox patterns like Projects/* to the existing mailboxes, in the order of the patterns. Mailboxes that don't exist are skipped.
+func resolveMailboxes(conn *Connection, patterns []string) ([]string, error) {
+	existing, err := conn.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return matchMailboxes(existing, patterns), nil
+}
+
+// matchMailboxes expands mailbox patterns like resolveMailboxes against mailboxes listed before
+func matchMailboxes(existing map[string]imapUtil.MailboxInfo, patterns []string) []string {
+	var mailboxes []string
+	seen := map[string]bool{}
+	for _, name := range patterns {
+		pattern := regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(name), `\*`, ".*") + "$")
+
+		var matched []string
+		for existingName, info := range existing {
+			if pattern.MatchString(existingName) && !seen[existingName] && !hasAttr(info.Attributes, imapUtil.NoSelectAttr) {
+				matched = append(matched, existingName)
+			}
+		}
+
+		sort.Strings(matched)
+		for _, existingName := range matched {
+			seen[existingName] = true
+			mailboxes = append(mailboxes, existingName)
+		}
+	}
+
+	return mailboxes
+}
+
+// search returns the UIDs of the messages in the mailbox with any of the Message-IDs
+func (index *ThreadIndex) search(conn *Connection, mailbox string, messageIDs []string) ([]uint32, error) {
+	return conn.SearchCriteria(mailbox, messageIDCriteria(messageIDs))
+}
+
+// messageIDCriteria searches for any of the Message-IDs with nested ORs, since IMAP SEARCH OR only takes two keys
+func messageIDCriteria(messageIDs []string) *imapUtil.SearchCriteria {
+	criteria := imapUtil.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageIDs[0])
+
+	if len(messageIDs) == 1 {
+		return criteria
+	}
+
+	or := imapUtil.NewSearchCriteria()
+	or.Or = [][2]*imapUtil.SearchCriteria{{criteria, messageIDCriteria(messageIDs[1:])}}
+	return or
+}
+
+// writeFileAtomic writes to a temporary file first so that the file doesn't get corrupted if we're interrupted
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+
+	return false
+}
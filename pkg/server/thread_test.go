@@ -0,0 +1,88 @@
+package server_test
+
+import (
+	"encoding/json"
+	"github.com/arnisoph/postisto/pkg/server"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThreadIndex(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	// Referenced Message-IDs, nearest parent first
+	referencesTests := []struct {
+		headers    server.MessageHeaders
+		references []string
+	}{
+		{headers: server.MessageHeaders{}, references: nil},
+		{headers: server.MessageHeaders{"in-reply-to": "<b@example.com>"}, references: []string{"<b@example.com>"}},
+		{
+			headers:    server.MessageHeaders{"in-reply-to": "<c@example.com> (sent by jane)", "references": "<a@example.com>\r\n <b@example.com> <c@example.com>"},
+			references: []string{"<c@example.com>", "<b@example.com>", "<a@example.com>"},
+		},
+		{
+			headers:    server.MessageHeaders{"references": []string{"<a@example.com>", "<b@example.com>"}},
+			references: []string{"<b@example.com>", "<a@example.com>"},
+		},
+		{headers: server.MessageHeaders{"in-reply-to": "no message-id"}, references: nil},
+	}
+
+	for i, test := range referencesTests {
+		msg := server.NewMessage(&imapUtil.Message{}, test.headers)
+		require.Equal(test.references, msg.References(), "Test #%v", i+1)
+	}
+
+	// Only the nearest references are looked up
+	var references string
+	for _, c := range "abcdefghijkl" {
+		references += "<" + string(c) + "@example.com> "
+	}
+	msg := server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"references": references})
+	require.Len(msg.References(), 10)
+	require.Equal("<l@example.com>", msg.References()[0])
+
+	// Messages without references don't need a lookup
+	index, err := server.NewThreadIndex([]string{"Projects/*"}, "")
+	require.NoError(err)
+
+	mailbox, err := index.Lookup(server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{}))
+	require.NoError(err)
+	require.Empty(mailbox)
+
+	_, err = index.Lookup(server.NewMessage(&imapUtil.Message{}, server.MessageHeaders{"in-reply-to": "<a@example.com>"}))
+	require.EqualError(err, "threads can't be looked up without a server connection")
+
+	// The cache is saved to and loaded from a file
+	cachePath := filepath.Join(t.TempDir(), "threads.json")
+	index, err = server.NewThreadIndex([]string{"Projects/*"}, cachePath)
+	require.NoError(err)
+	require.NoError(index.Save())
+	require.NoFileExists(cachePath)
+
+	index.Add("<A@Example.com>", "Projects/Alpha")
+	require.NoError(index.Save())
+
+	data, err := os.ReadFile(cachePath)
+	require.NoError(err)
+
+	var entries map[string]map[string]interface{}
+	require.NoError(json.Unmarshal(data, &entries))
+	require.Equal("Projects/Alpha", entries["<a@example.com>"]["mailbox"])
+
+	_, err = server.NewThreadIndex([]string{"Projects/*"}, cachePath)
+	require.NoError(err)
+
+	// Invalid configs
+	_, err = server.NewThreadIndex(nil, "")
+	require.EqualError(err, "no mailboxes to search for threads configured")
+
+	require.NoError(os.WriteFile(cachePath, []byte("{"), 0600))
+	_, err = server.NewThreadIndex([]string{"Projects/*"}, cachePath)
+	require.EqualError(err, `failed to parse thread cache "`+cachePath+`": unexpected end of JSON input`)
+}
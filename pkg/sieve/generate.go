@@ -0,0 +1,525 @@
+package sieve
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// sieveTest is a test of a generated script. Tests with sub tests are allof, anyof or not.
+type sieveTest struct {
+	name  string
+	args  []string
+	tests []*sieveTest
+}
+
+// generator collects the extensions that the generated script needs to require
+type generator struct {
+	extensions map[string]bool
+}
+
+// Go regular expressions that POSIX extended regular expressions (used by the Sieve regex extension) don't support
+var unsupportedRegExSyntax = regexp.MustCompile(`\(\?|\\[dDwWsSbBAzpPQE]|[*+?}]\?`)
+
+// Generate translates filters into a Sieve script (RFC 5228 with the fileinto, imap4flags, regex and body extensions).
+// Filters are ordered like postisto evaluates them. Conditions and commands that Sieve can't express equivalently are reported as error.
+func Generate(filters map[string]filter.Filter) (string, error) {
+	g := &generator{extensions: map[string]bool{}}
+	filterSet := filter.FilterSet(filters)
+	names := filterSet.Names()
+
+	var blocks []string
+	for i, name := range names {
+		f := filterSet[name]
+
+		test, err := g.ruleSet(f.RuleSet)
+		if err != nil {
+			return "", fmt.Errorf("filter %q: %v", name, err)
+		}
+
+		// Conditions that depend on account settings like lists can't be translated anyway, so the remaining ones compile without them
+		if _, err := filter.CompileRuleSet(f.RuleSet); err != nil {
+			return "", fmt.Errorf("filter %q: %v", name, err)
+		}
+
+		actions, err := g.actions(f.Commands)
+		if err != nil {
+			return "", fmt.Errorf("filter %q: %v", name, err)
+		}
+
+		if f.Continue && f.Commands.Move != "" && i < len(names)-1 {
+			// postisto only applies the last move of all matching filters but fileinto files the message right away
+			return "", fmt.Errorf("filter %q: move can't be combined with continue in Sieve", name)
+		}
+
+		if !f.Continue {
+			actions = append(actions, "stop;")
+		}
+
+		block := fmt.Sprintf("# rule:[%v]\nif %v {\n", name, test.render(0))
+		for _, action := range actions {
+			block += "    " + action + "\n"
+		}
+		block += "}\n"
+
+		blocks = append(blocks, block)
+	}
+
+	var script strings.Builder
+	script.WriteString("# Generated by postisto\n")
+
+	if len(g.extensions) > 0 {
+		var extensions []string
+		for extension := range g.extensions {
+			extensions = append(extensions, extension)
+		}
+		sort.Strings(extensions)
+
+		script.WriteString(fmt.Sprintf("require %v;\n", quoteList(extensions)))
+	}
+
+	for _, block := range blocks {
+		script.WriteString("\n" + block)
+	}
+
+	return script.String(), nil
+}
+
+func (g *generator) actions(cmds filter.Commands) ([]string, error) {
+	var actions []string
+
+	if cmds.MoveToThread {
+		return nil, fmt.Errorf("command \"move_to_thread\" can't be expressed in Sieve")
+	}
+
+	if cmds.Dedupe != "" {
+		return nil, fmt.Errorf("command \"dedupe\" can't be expressed in Sieve")
+	}
+
+	// same order as RunCommands applies them
+	for _, flagCmd := range []struct {
+		action string
+		flags  []string
+	}{
+		{action: "addflag", flags: cmds.AddFlags},
+		{action: "removeflag", flags: cmds.RemoveFlags},
+		{action: "setflag", flags: cmds.ReplaceAllFlags},
+	} {
+		if flagCmd.flags == nil {
+			continue
+		}
+
+		g.extensions["imap4flags"] = true
+		actions = append(actions, fmt.Sprintf("%v %v;", flagCmd.action, quoteList(flagCmd.flags)))
+	}
+
+	if cmds.Move != "" {
+		if strings.Contains(cmds.Move, "{{") {
+			return nil, fmt.Errorf("command \"move\": templates can't be expressed in Sieve")
+		}
+
+		g.extensions["fileinto"] = true
+		actions = append(actions, fmt.Sprintf("fileinto %v;", quote(cmds.Move)))
+	}
+
+	return actions, nil
+}
+
+func (g *generator) ruleSet(ruleSet filter.RuleSet) (*sieveTest, error) {
+	var tests []*sieveTest
+
+	for i, rule := range ruleSet {
+		for op, patterns := range rule {
+			test, err := g.group(op, patterns)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%v: %v", i+1, err)
+			}
+
+			tests = append(tests, test)
+		}
+	}
+
+	if len(tests) == 0 {
+		return &sieveTest{name: "false"}, nil
+	}
+
+	return anyOf(tests), nil
+}
+
+func (g *generator) group(op string, patterns []map[string]interface{}) (*sieveTest, error) {
+	var tests []*sieveTest
+
+	for _, pattern := range patterns {
+		// sort for a deterministic script
+		var keys []string
+		for key := range pattern {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			test, err := g.condition(key, pattern[key])
+			if err != nil {
+				return nil, err
+			}
+
+			tests = append(tests, test)
+		}
+	}
+
+	switch strings.ToLower(op) {
+	case "and":
+		return allOf(tests), nil
+	case "or":
+		return anyOf(tests), nil
+	default:
+		// not matches if none of its patterns match
+		return &sieveTest{name: "not", tests: []*sieveTest{anyOf(tests)}}, nil
+	}
+}
+
+func (g *generator) condition(key string, values interface{}) (*sieveTest, error) {
+	name := strings.ToLower(key)
+
+	if filter.IsGroupOperator(name) {
+		var patterns []map[string]interface{}
+
+		switch v := values.(type) {
+		case []map[string]interface{}:
+			patterns = v
+		case []interface{}:
+			for _, val := range v {
+				if pattern, ok := val.(map[string]interface{}); ok {
+					patterns = append(patterns, pattern)
+				}
+			}
+		}
+
+		return g.group(name, patterns)
+	}
+
+	if spec, ok := values.(map[string]interface{}); ok {
+		if _, ok := spec["in_list"]; ok {
+			return nil, fmt.Errorf("header %q: in_list conditions can't be expressed in Sieve", name)
+		}
+	}
+
+	if strings.Contains(name, ":") {
+		test, err := g.address(name, values)
+		if err != nil {
+			return nil, fmt.Errorf("address %q: %v", name, err)
+		}
+
+		return test, nil
+	}
+
+	switch name {
+	case "exists", "missing":
+		var headers []string
+		switch v := values.(type) {
+		case string:
+			headers = append(headers, strings.ToLower(v))
+		case []string:
+			for _, val := range v {
+				headers = append(headers, strings.ToLower(val))
+			}
+		case []interface{}:
+			for _, val := range v {
+				headers = append(headers, strings.ToLower(fmt.Sprintf("%v", val)))
+			}
+		}
+
+		if name == "exists" {
+			return &sieveTest{name: "exists", args: []string{quoteList(headers)}}, nil
+		}
+
+		// missing matches if none of the headers exist
+		var tests []*sieveTest
+		for _, header := range headers {
+			tests = append(tests, &sieveTest{name: "not", tests: []*sieveTest{{name: "exists", args: []string{quote(header)}}}})
+		}
+
+		return allOf(tests), nil
+	case "size":
+		spec, ok := values.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("condition %q: size requires comparisons like {gt: 10MB}", name)
+		}
+
+		test, err := g.size(spec)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", name, err)
+		}
+
+		return test, nil
+	case "body":
+		g.extensions["body"] = true
+
+		test, err := g.patterns("body", []string{":text"}, "", values, false)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", name, err)
+		}
+
+		return test, nil
+	case "date":
+		// postisto matches date patterns against the parsed date of the envelope, not the Date header Sieve sees
+		return nil, fmt.Errorf("condition %q can't be expressed in Sieve", name)
+	case "attachment", "flag", "keyword", "dkim", "spf", "dmarc", "arc", "thread", "classifier", "program", "duplicate":
+		return nil, fmt.Errorf("condition %q can't be expressed in Sieve", name)
+	}
+
+	test, err := g.patterns("header", nil, quote(name), values, false)
+	if err != nil {
+		return nil, fmt.Errorf("header %q: %v", name, err)
+	}
+
+	return test, nil
+}
+
+func (g *generator) address(key string, values interface{}) (*sieveTest, error) {
+	fields := strings.SplitN(key, ":", 2)
+	header := quote(fields[0])
+
+	switch fields[1] {
+	case "address":
+		return g.patterns("address", []string{":all"}, header, values, true)
+	case "localpart", "domain":
+		return g.patterns("address", []string{":" + fields[1]}, header, values, true)
+	case "subdomains":
+		patterns, err := filter.ParsePatterns(values)
+		if err != nil {
+			return nil, err
+		}
+
+		var tests []*sieveTest
+		for _, p := range patterns {
+			if p.Mode != filter.MatchModeAuto && p.Mode != filter.MatchModeExact {
+				return nil, fmt.Errorf("match mode %q can't be expressed in Sieve", p.Mode)
+			}
+
+			domain := strings.ToLower(p.Value)
+			tests = append(tests,
+				&sieveTest{name: "address", args: []string{":domain", ":is", header, quote(domain)}},
+				&sieveTest{name: "address", args: []string{":domain", ":matches", header, quote("*." + escapeWildcards(domain))}},
+			)
+		}
+
+		return anyOf(tests), nil
+	default:
+		return nil, fmt.Errorf("address part %q can't be expressed in Sieve", fields[1])
+	}
+}
+
+// patterns translates header, address or body patterns. Patterns with the same match mode are combined into one test with a key list.
+func (g *generator) patterns(testName string, testArgs []string, header string, values interface{}, exactByDefault bool) (*sieveTest, error) {
+	patterns, err := filter.ParsePatterns(values)
+	if err != nil {
+		return nil, err
+	}
+
+	var modes []string
+	keys := map[string][]string{}
+	for _, p := range patterns {
+		// the default comparator of Sieve compares case-insensitively already, lowercasing would change escapes like \D in regular expressions
+		mode := p.Mode
+		value := p.Value
+
+		if mode == filter.MatchModeAuto && exactByDefault {
+			mode = filter.MatchModeExact
+		}
+
+		switch mode {
+		case filter.MatchModeAuto:
+			// auto mode matches on equality, substrings and regular expressions
+			if value == "" {
+				mode = ":is"
+			} else if regexp.QuoteMeta(value) == value {
+				mode = ":contains"
+			} else {
+				if err := checkRegEx(value); err != nil {
+					return nil, err
+				}
+
+				modes, keys = addKey(modes, keys, ":contains", value)
+				mode = ":regex"
+			}
+		case filter.MatchModeExact:
+			mode = ":is"
+		case filter.MatchModeContains:
+			mode = ":contains"
+		case filter.MatchModePrefix:
+			mode = ":matches"
+			value = escapeWildcards(value) + "*"
+		case filter.MatchModeSuffix:
+			mode = ":matches"
+			value = "*" + escapeWildcards(value)
+		case filter.MatchModeGlob:
+			// postisto globs don't know escaping
+			mode = ":matches"
+			value = strings.ReplaceAll(value, `\`, `\\`)
+		case filter.MatchModeRegex:
+			if err := checkRegEx(value); err != nil {
+				return nil, err
+			}
+
+			mode = ":regex"
+		case filter.MatchModeNumeric:
+			return nil, fmt.Errorf("numeric comparisons can't be expressed in Sieve, it only compares non-negative integers")
+		}
+
+		modes, keys = addKey(modes, keys, mode, value)
+	}
+
+	var tests []*sieveTest
+	for _, mode := range modes {
+		if mode == ":regex" {
+			g.extensions["regex"] = true
+		}
+
+		args := append(append([]string{}, testArgs...), mode)
+		if header != "" {
+			args = append(args, header)
+		}
+
+		tests = append(tests, &sieveTest{name: testName, args: append(args, quoteList(keys[mode]))})
+	}
+
+	return anyOf(tests), nil
+}
+
+func addKey(modes []string, keys map[string][]string, mode string, key string) ([]string, map[string][]string) {
+	if _, ok := keys[mode]; !ok {
+		modes = append(modes, mode)
+	}
+
+	for _, existing := range keys[mode] {
+		if existing == key {
+			return modes, keys
+		}
+	}
+
+	keys[mode] = append(keys[mode], key)
+	return modes, keys
+}
+
+func (g *generator) size(spec map[string]interface{}) (*sieveTest, error) {
+	var ops []string
+	for op := range spec {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var tests []*sieveTest
+	for _, op := range ops {
+		size, err := filter.ParseSize(spec[op])
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(op) {
+		case "gt":
+			tests = append(tests, sizeTest(":over", math.Floor(size)))
+		case "ge":
+			if math.Ceil(size) == 0 {
+				tests = append(tests, &sieveTest{name: "true"})
+			} else {
+				tests = append(tests, sizeTest(":over", math.Ceil(size)-1))
+			}
+		case "lt":
+			tests = append(tests, sizeTest(":under", math.Ceil(size)))
+		case "le":
+			tests = append(tests, sizeTest(":under", math.Floor(size)+1))
+		case "eq":
+			if size != math.Trunc(size) {
+				return nil, fmt.Errorf("size %v is not a whole number of bytes", size)
+			}
+
+			tests = append(tests,
+				&sieveTest{name: "not", tests: []*sieveTest{sizeTest(":over", size)}},
+				&sieveTest{name: "not", tests: []*sieveTest{sizeTest(":under", size)}},
+			)
+		}
+	}
+
+	return allOf(tests), nil
+}
+
+func sizeTest(tag string, size float64) *sieveTest {
+	return &sieveTest{name: "size", args: []string{tag, fmt.Sprintf("%.0f", size)}}
+}
+
+func checkRegEx(expr string) error {
+	if unsupportedRegExSyntax.MatchString(expr) {
+		return fmt.Errorf("regular expression %q can't be expressed in Sieve, it only supports POSIX extended regular expressions", expr)
+	}
+
+	return nil
+}
+
+func allOf(tests []*sieveTest) *sieveTest {
+	return combine("allof", tests)
+}
+
+func anyOf(tests []*sieveTest) *sieveTest {
+	return combine("anyof", tests)
+}
+
+// combine joins tests with allof or anyof. Nested tests of the same kind are flattened.
+func combine(name string, tests []*sieveTest) *sieveTest {
+	if len(tests) == 1 {
+		return tests[0]
+	}
+
+	combined := &sieveTest{name: name}
+	for _, test := range tests {
+		if test.name == name {
+			combined.tests = append(combined.tests, test.tests...)
+		} else {
+			combined.tests = append(combined.tests, test)
+		}
+	}
+
+	return combined
+}
+
+func (test *sieveTest) render(indent int) string {
+	switch test.name {
+	case "allof", "anyof":
+		prefix := strings.Repeat("    ", indent+1)
+
+		var tests []string
+		for _, subTest := range test.tests {
+			tests = append(tests, prefix+subTest.render(indent+1))
+		}
+
+		return fmt.Sprintf("%v (\n%v\n%v)", test.name, strings.Join(tests, ",\n"), strings.Repeat("    ", indent))
+	case "not":
+		return "not " + test.tests[0].render(indent)
+	}
+
+	return strings.Join(append([]string{test.name}, test.args...), " ")
+}
+
+func escapeWildcards(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(s)
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func quoteList(list []string) string {
+	if len(list) == 1 {
+		return quote(list[0])
+	}
+
+	var quoted []string
+	for _, s := range list {
+		quoted = append(quoted, quote(s))
+	}
+
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,151 @@
+package sieve_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/sieve"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	require := require.New(t)
+
+	newFilter := func(commands filter.Commands, conditions ...map[string]interface{}) filter.Filter {
+		return filter.Filter{Commands: commands, RuleSet: filter.RuleSet{{"and": conditions}}}
+	}
+	moveToLists := filter.Commands{Move: "Lists"}
+
+	// ACTUAL TESTS BELOW
+
+	cfg, err := config.NewConfigFromFile("../../test/data/configs/valid/test/TestGenerate.yaml")
+	require.NoError(err)
+
+	script, err := sieve.Generate(cfg.Filters["test"])
+	require.NoError(err)
+
+	expected, err := os.ReadFile("../../test/data/sieve/TestGenerate.sieve")
+	require.NoError(err)
+	require.Equal(string(expected), script)
+
+	// The generated script can be imported again, except for the body test
+	result, err := sieve.Import(script)
+	require.NoError(err)
+	require.Equal([]sieve.Problem{{Line: 48, Message: `test "body" is unsupported`}}, result.Problems)
+
+	var names []string
+	for _, f := range result.Filters {
+		names = append(names, f.Name)
+	}
+	require.Equal([]string{"boss", "mailing-lists", "shops", "vendor-without-invoices"}, names)
+
+	for _, f := range result.Filters {
+		require.Equal(cfg.Filters["test"][f.Name].Continue, f.Continue, "filter %q", f.Name)
+		require.Equal(cfg.Filters["test"][f.Name].Commands, f.Commands, "filter %q", f.Name)
+	}
+
+	// Generated tests
+	generateTests := []struct {
+		condition map[string]interface{}
+		test      string
+	}{
+		{condition: map[string]interface{}{"list-id": ""}, test: `header :is "list-id" ""`},
+		{condition: map[string]interface{}{"subject": []interface{}{"a", "b", map[string]interface{}{"exact": "c"}}}, test: `anyof (
+    header :contains "subject" ["a", "b"],
+    header :is "subject" "c"
+)`},
+		{condition: map[string]interface{}{"subject": map[string]interface{}{"suffix": `100%?`}}, test: `header :matches "subject" "*100%\\?"`},
+		{condition: map[string]interface{}{"subject": map[string]interface{}{"glob": `C:\*`}}, test: `header :matches "subject" "C:\\\\*"`},
+		{condition: map[string]interface{}{"to:localpart": "Info"}, test: `address :localpart :is "to" "Info"`},
+		{condition: map[string]interface{}{"size": map[string]interface{}{"eq": 100}}, test: `allof (
+    not size :over 100,
+    not size :under 100
+)`},
+		{condition: map[string]interface{}{"size": map[string]interface{}{"gt": "1.5K", "lt": 2047.5}}, test: `allof (
+    size :over 1536,
+    size :under 2048
+)`},
+	}
+
+	for i, test := range generateTests {
+		script, err := sieve.Generate(map[string]filter.Filter{"test": newFilter(moveToLists, test.condition)})
+		require.NoError(err, "Test #%v", i+1)
+		require.Equal("# Generated by postisto\nrequire \"fileinto\";\n\n# rule:[test]\nif "+test.test+" {\n    fileinto \"Lists\";\n    stop;\n}\n", script, "Test #%v", i+1)
+	}
+
+	// Features Sieve can't express
+	continueWithMove := newFilter(moveToLists, map[string]interface{}{"exists": "list-id"})
+	continueWithMove.Continue = true
+
+	invalidTests := []struct {
+		filters map[string]filter.Filter
+		err     string
+	}{
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"x-spam-score": map[string]interface{}{"ge": 5}})},
+			err:     `filter "test": rule #1: header "x-spam-score": numeric comparisons can't be expressed in Sieve, it only compares non-negative integers`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"subject": map[string]interface{}{"regex": `^\d+$`}})},
+			err:     `filter "test": rule #1: header "subject": regular expression "^\\d+$" can't be expressed in Sieve, it only supports POSIX extended regular expressions`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"subject": `^Re:\D`})},
+			err:     `filter "test": rule #1: header "subject": regular expression "^Re:\\D" can't be expressed in Sieve, it only supports POSIX extended regular expressions`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"from:name": "Jane"})},
+			err:     `filter "test": rule #1: address "from:name": address part "name" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"attachment": map[string]interface{}{"type": "application/pdf"}})},
+			err:     `filter "test": rule #1: condition "attachment" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"date": map[string]interface{}{"older_than": "1d"}})},
+			err:     `filter "test": rule #1: condition "date" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"date": map[string]interface{}{"contains": "2024"}})},
+			err:     `filter "test": rule #1: condition "date" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"not": []map[string]interface{}{{"flag": `\Seen`}}})},
+			err:     `filter "test": rule #1: condition "flag" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"dmarc": "fail"})},
+			err:     `filter "test": rule #1: condition "dmarc" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"from": map[string]interface{}{"in_list": "vip"}})},
+			err:     `filter "test": rule #1: header "from": in_list conditions can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"a": continueWithMove, "b": newFilter(moveToLists, map[string]interface{}{"exists": "list-id"})},
+			err:     `filter "a": move can't be combined with continue in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(filter.Commands{Move: "Lists/{{ header 'list-id' | listname }}"}, map[string]interface{}{"exists": "list-id"})},
+			err:     `filter "test": command "move": templates can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(filter.Commands{MoveToThread: true}, map[string]interface{}{"exists": "list-id"})},
+			err:     `filter "test": command "move_to_thread" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(filter.Commands{Dedupe: "delete"}, map[string]interface{}{"exists": "list-id"})},
+			err:     `filter "test": command "dedupe" can't be expressed in Sieve`,
+		},
+		{
+			filters: map[string]filter.Filter{"test": newFilter(moveToLists, map[string]interface{}{"subject": map[string]interface{}{"regex": "("}})},
+			err:     "filter \"test\": rule #1: header \"subject\": pattern \"(\": error parsing regexp: missing closing ): `(?i)(`",
+		},
+	}
+
+	for i, test := range invalidTests {
+		_, err := sieve.Generate(test.filters)
+		require.EqualError(err, test.err, "Test #%v", i+1)
+	}
+}
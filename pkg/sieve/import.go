@@ -0,0 +1,472 @@
+package sieve
+
+import (
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strings"
+)
+
+// Problem is a construct of a Sieve script that can't be expressed by postisto filters.
+type Problem struct {
+	Line    int
+	Message string
+}
+
+func (problem Problem) String() string {
+	return fmt.Sprintf("line %v: %v", problem.Line, problem.Message)
+}
+
+// NamedFilter is a filter with its name, as used by the ordered list form of filter sets.
+type NamedFilter struct {
+	Name          string `yaml:"name"`
+	filter.Filter `yaml:",inline"`
+}
+
+// ImportResult contains the translated filters in script order and the problems of the parts that were skipped.
+type ImportResult struct {
+	Filters  []NamedFilter
+	Problems []Problem
+}
+
+// Roundcube and other managesieve clients name their rules with a comment like "# rule:[Newsletters]"
+var ruleNameRegEx = regexp.MustCompile(`^rule:\[(.*)\]$`)
+
+// unsupportedError marks parts of a script that can't be translated. Other errors are syntax errors.
+type unsupportedError struct {
+	line int
+	msg  string
+}
+
+func (err *unsupportedError) Error() string {
+	return fmt.Sprintf("line %v: %v", err.line, err.msg)
+}
+
+func unsupported(line int, format string, a ...interface{}) error {
+	return &unsupportedError{line: line, msg: fmt.Sprintf(format, a...)}
+}
+
+// Import translates a Sieve script (RFC 5228 with the fileinto, imap4flags and regex extensions) into postisto filters.
+// Every if, elsif and else block becomes a filter. Blocks without stop continue with the next filters like Sieve does.
+// Blocks using unsupported commands or tests are skipped and reported as problems. Syntax errors fail the whole import.
+func Import(script string) (*ImportResult, error) {
+	parsed, err := Parse(script)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	names := map[string]bool{}
+
+	// conditions of the previous if and elsif blocks of the current chain. Once a block of the chain can't be imported, the rest can't either.
+	var chain []map[string]interface{}
+	chainBroken := true
+	chainName := ""
+
+	for _, command := range parsed.Commands {
+		var condition map[string]interface{}
+		var ruleSet filter.RuleSet
+		var name string
+		err = nil
+
+		switch command.Name {
+		case "require", "keep":
+			continue
+		case "stop":
+			// nothing after an unconditional stop is ever executed
+			return result, nil
+		case "if":
+			chain = nil
+			chainBroken = false
+			chainName = ruleName(parsed, command)
+			name = chainName
+
+			if condition, err = translateTest(command.Tests, command.Line); err != nil {
+				chainBroken = true
+				break
+			}
+
+			ruleSet = filter.RuleSet{newRule(condition)}
+			chain = append(chain, condition)
+		case "elsif":
+			if chainBroken {
+				err = unsupported(command.Line, "elsif depends on a block that can't be imported")
+				break
+			}
+
+			if condition, err = translateTest(command.Tests, command.Line); err != nil {
+				chainBroken = true
+				break
+			}
+
+			ruleSet = filter.RuleSet{newRule(map[string]interface{}{"and": []map[string]interface{}{{"not": chain}, condition}})}
+			name = fmt.Sprintf("%v-elsif-%v", chainName, len(chain))
+			chain = append(chain, condition)
+		case "else":
+			if chainBroken {
+				err = unsupported(command.Line, "else depends on a block that can't be imported")
+				break
+			}
+
+			ruleSet = filter.RuleSet{{"not": chain}}
+			name = chainName + "-else"
+			chainBroken = true
+		default:
+			chainBroken = true
+			err = unsupported(command.Line, "command %q is only supported inside of if blocks", command.Name)
+		}
+
+		if err == nil && command.Block == nil {
+			err = fmt.Errorf("line %v: %v requires a block", command.Line, command.Name)
+		}
+
+		var f filter.Filter
+		if err == nil {
+			f, err = translateBlock(command.Block)
+		}
+
+		if err != nil {
+			if unsupportedErr, ok := err.(*unsupportedError); ok {
+				result.Problems = append(result.Problems, Problem{Line: unsupportedErr.line, Message: unsupportedErr.msg})
+				continue
+			}
+
+			return nil, err
+		}
+
+		f.RuleSet = ruleSet
+		result.Filters = append(result.Filters, NamedFilter{Name: uniqueName(name, names), Filter: f})
+	}
+
+	return result, nil
+}
+
+// ruleName takes the name of an if block from a rule comment on the line before or uses its line number otherwise.
+func ruleName(script *Script, command *Command) string {
+	if matches := ruleNameRegEx.FindStringSubmatch(script.Comments[command.Line-1]); matches != nil && matches[1] != "" {
+		return matches[1]
+	}
+
+	return fmt.Sprintf("sieve-line-%v", command.Line)
+}
+
+// uniqueName appends a number to names that are used already since filter names must be unique.
+func uniqueName(name string, names map[string]bool) string {
+	unique := name
+	for i := 2; names[unique]; i++ {
+		unique = fmt.Sprintf("%v-%v", name, i)
+	}
+	names[unique] = true
+
+	return unique
+}
+
+func newRule(condition map[string]interface{}) filter.Rule {
+	if len(condition) == 1 {
+		for op, conditions := range condition {
+			if subConditions, ok := conditions.([]map[string]interface{}); ok && (op == "and" || op == "or" || op == "not") {
+				return filter.Rule{op: subConditions}
+			}
+		}
+	}
+
+	return filter.Rule{"and": []map[string]interface{}{condition}}
+}
+
+func translateBlock(block []*Command) (filter.Filter, error) {
+	f := filter.Filter{Continue: true}
+
+	for _, command := range block {
+		switch command.Name {
+		case "keep":
+			// messages stay in the input mailbox unless they are moved
+		case "stop":
+			f.Continue = false
+		case "fileinto":
+			args, err := plainArguments(command, 1)
+			if err != nil {
+				return f, err
+			}
+
+			if f.Commands.Move != "" {
+				return f, unsupported(command.Line, "filing a message into several mailboxes is unsupported")
+			}
+
+			f.Commands.Move = args[0][0]
+		case "addflag", "setflag", "removeflag":
+			args, err := plainArguments(command, 1)
+			if err != nil {
+				return f, err
+			}
+
+			flags := []string{}
+			for _, flagList := range args[0] {
+				// imap4flags allows several flags separated by spaces in one string
+				for _, flag := range strings.Fields(flagList) {
+					flags = append(flags, flag)
+				}
+			}
+
+			switch command.Name {
+			case "addflag":
+				f.Commands = filter.MergeCommands(f.Commands, filter.Commands{AddFlags: flags})
+			case "setflag":
+				f.Commands = filter.MergeCommands(f.Commands, filter.Commands{ReplaceAllFlags: flags})
+			case "removeflag":
+				f.Commands = filter.MergeCommands(f.Commands, filter.Commands{RemoveFlags: flags})
+			}
+		case "if", "elsif", "else":
+			return f, unsupported(command.Line, "nested %v blocks are unsupported", command.Name)
+		default:
+			return f, unsupported(command.Line, "action %q is unsupported", command.Name)
+		}
+	}
+
+	return f, nil
+}
+
+// plainArguments returns the string list arguments of a command that must not have tags, numbers or tests.
+func plainArguments(command *Command, num int) ([][]string, error) {
+	var args [][]string
+
+	for _, arg := range command.Arguments {
+		if arg.Tag != "" {
+			return nil, unsupported(arg.Line, "%v %v is unsupported", command.Name, arg.Tag)
+		}
+
+		if arg.Strings == nil {
+			return nil, fmt.Errorf("line %v: %v expects strings", arg.Line, command.Name)
+		}
+
+		args = append(args, arg.Strings)
+	}
+
+	if len(command.Tests) > 0 {
+		return nil, fmt.Errorf("line %v: %v doesn't take tests", command.Line, command.Name)
+	}
+
+	if len(args) != num {
+		if command.Name != "fileinto" && len(args) == num+1 {
+			return nil, unsupported(command.Line, "%v with a variable name is unsupported", command.Name)
+		}
+
+		return nil, fmt.Errorf("line %v: %v expects %v argument(s), got %v", command.Line, command.Name, num, len(args))
+	}
+
+	return args, nil
+}
+
+func translateTest(tests []*Test, line int) (map[string]interface{}, error) {
+	if len(tests) != 1 {
+		return nil, fmt.Errorf("line %v: expected exactly one test, got %v", line, len(tests))
+	}
+
+	test := tests[0]
+
+	switch test.Name {
+	case "allof", "anyof":
+		if len(test.Tests) == 0 || len(test.Arguments) > 0 {
+			return nil, fmt.Errorf("line %v: %v expects a test list", test.Line, test.Name)
+		}
+
+		var conditions []map[string]interface{}
+		for _, subTest := range test.Tests {
+			condition, err := translateTest([]*Test{subTest}, subTest.Line)
+			if err != nil {
+				return nil, err
+			}
+
+			conditions = append(conditions, condition)
+		}
+
+		if test.Name == "allof" {
+			return map[string]interface{}{"and": conditions}, nil
+		}
+
+		return map[string]interface{}{"or": conditions}, nil
+	case "not":
+		if len(test.Tests) != 1 || len(test.Arguments) > 0 {
+			return nil, fmt.Errorf("line %v: not expects one test", test.Line)
+		}
+
+		condition, err := translateTest(test.Tests, test.Line)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{"not": []map[string]interface{}{condition}}, nil
+	case "header", "address":
+		return translateHeaderTest(test)
+	case "exists":
+		args, err := testArguments(test)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(args.strings) != 1 || len(args.tags) > 0 {
+			return nil, fmt.Errorf("line %v: exists expects a list of header names", test.Line)
+		}
+
+		return map[string]interface{}{"exists": lowerAll(args.strings[0])}, nil
+	case "size":
+		args, err := testArguments(test)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(args.tags) != 1 || (args.tags[0] != ":over" && args.tags[0] != ":under") || args.number == "" || len(args.strings) > 0 {
+			return nil, fmt.Errorf("line %v: size expects :over or :under and a number", test.Line)
+		}
+
+		op := "gt"
+		if args.tags[0] == ":under" {
+			op = "lt"
+		}
+
+		return map[string]interface{}{"size": map[string]interface{}{op: args.number}}, nil
+	default:
+		return nil, unsupported(test.Line, "test %q is unsupported", test.Name)
+	}
+}
+
+type testArgs struct {
+	tags       []string
+	comparator string
+	number     string
+	strings    [][]string
+}
+
+func testArguments(test *Test) (testArgs, error) {
+	var args testArgs
+
+	if len(test.Tests) > 0 {
+		return args, fmt.Errorf("line %v: %v doesn't take tests", test.Line, test.Name)
+	}
+
+	for i := 0; i < len(test.Arguments); i++ {
+		arg := test.Arguments[i]
+
+		switch {
+		case arg.Tag == ":comparator":
+			if i+1 >= len(test.Arguments) || len(test.Arguments[i+1].Strings) != 1 {
+				return args, fmt.Errorf("line %v: :comparator expects a string", arg.Line)
+			}
+
+			i++
+			args.comparator = strings.ToLower(test.Arguments[i].Strings[0])
+		case arg.Tag != "":
+			args.tags = append(args.tags, arg.Tag)
+		case arg.Number != "":
+			args.number = arg.Number
+		default:
+			args.strings = append(args.strings, arg.Strings)
+		}
+	}
+
+	return args, nil
+}
+
+func translateHeaderTest(test *Test) (map[string]interface{}, error) {
+	args, err := testArguments(test)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.comparator != "" && args.comparator != "i;ascii-casemap" {
+		return nil, unsupported(test.Line, "comparator %q is unsupported, matching is always case-insensitive", args.comparator)
+	}
+
+	mode := "exact"
+	addressPart := "address"
+	for _, tag := range args.tags {
+		switch tag {
+		case ":is":
+			mode = "exact"
+		case ":contains":
+			mode = "contains"
+		case ":matches":
+			mode = "glob"
+		case ":regex":
+			mode = "regex"
+		case ":all":
+			addressPart = "address"
+		case ":localpart", ":domain":
+			addressPart = strings.TrimPrefix(tag, ":")
+		default:
+			return nil, unsupported(test.Line, "%v %v is unsupported", test.Name, tag)
+		}
+
+		if test.Name == "header" && (tag == ":all" || tag == ":localpart" || tag == ":domain") {
+			return nil, fmt.Errorf("line %v: header doesn't take %v", test.Line, tag)
+		}
+	}
+
+	if len(args.strings) != 2 || args.number != "" {
+		return nil, fmt.Errorf("line %v: %v expects a list of header names and a list of keys", test.Line, test.Name)
+	}
+
+	var keys []interface{}
+	for _, key := range args.strings[1] {
+		if mode == "glob" && strings.Contains(key, `\`) {
+			return nil, unsupported(test.Line, "escaped wildcards in :matches keys are unsupported")
+		}
+
+		keys = append(keys, key)
+	}
+
+	var value interface{} = keys
+	if len(keys) == 1 {
+		value = keys[0]
+	}
+	pattern := map[string]interface{}{mode: value}
+
+	var conditions []map[string]interface{}
+	for _, name := range args.strings[0] {
+		name = strings.ToLower(name)
+		if test.Name == "address" {
+			name += ":" + addressPart
+		}
+
+		conditions = append(conditions, map[string]interface{}{name: pattern})
+	}
+
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+
+	return map[string]interface{}{"or": conditions}, nil
+}
+
+func lowerAll(values []string) []interface{} {
+	var lowered []interface{}
+	for _, value := range values {
+		lowered = append(lowered, strings.ToLower(value))
+	}
+
+	return lowered
+}
+
+// YAML renders the filters as a config file for the account. The filters use the ordered list form so that they keep the order of the script.
+// Problems are listed as comments at the top.
+func (result *ImportResult) YAML(account string) ([]byte, error) {
+	var out strings.Builder
+
+	out.WriteString("# Imported from a Sieve script\n")
+	for _, problem := range result.Problems {
+		out.WriteString(fmt.Sprintf("# Skipped %v\n", problem))
+	}
+
+	filters := result.Filters
+	if filters == nil {
+		filters = []NamedFilter{}
+	}
+
+	b, err := yaml.Marshal(map[string]map[string][]NamedFilter{"filters": {account: filters}})
+	if err != nil {
+		return nil, err
+	}
+
+	out.Write(b)
+	return []byte(out.String()), nil
+}
@@ -0,0 +1,177 @@
+package sieve_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/config"
+	"github.com/arnisoph/postisto/pkg/filter"
+	"github.com/arnisoph/postisto/pkg/server"
+	"github.com/arnisoph/postisto/pkg/sieve"
+	imapUtil "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImport(t *testing.T) {
+	require := require.New(t)
+
+	newMsg := func(size uint32, headers server.MessageHeaders) *server.Message {
+		return server.NewMessage(&imapUtil.Message{Size: size}, headers)
+	}
+
+	// ACTUAL TESTS BELOW
+
+	script, err := os.ReadFile("../../test/data/sieve/TestImport.sieve")
+	require.NoError(err)
+
+	result, err := sieve.Import(string(script))
+	require.NoError(err)
+
+	require.Equal([]sieve.Problem{
+		{Line: 35, Message: `action "redirect" is unsupported`},
+		{Line: 38, Message: `test "envelope" is unsupported`},
+	}, result.Problems)
+
+	var names []string
+	for _, f := range result.Filters {
+		names = append(names, f.Name)
+	}
+	require.Equal([]string{"Mailing lists", "Boss", "Shops", "Shops-elsif-1", "Shops-else", "sieve-line-29"}, names)
+
+	require.False(result.Filters[0].Continue)
+	require.True(result.Filters[1].Continue)
+	require.Equal(filter.Commands{Move: "Vendor", ReplaceAllFlags: []string{`\Seen`, "$Vendor"}}, result.Filters[3].Commands)
+
+	// The generated YAML must be loadable as config file
+	b, err := result.YAML("test")
+	require.NoError(err)
+	require.Contains(string(b), "# Skipped line 35: action \"redirect\" is unsupported\n")
+
+	configPath := filepath.Join(t.TempDir(), "filters.yaml")
+	require.NoError(os.WriteFile(configPath, b, 0600))
+
+	cfg, err := config.NewConfigFromFile(configPath)
+	require.NoError(err)
+	filters := cfg.Filters["test"]
+	require.Equal(names, filters.Names())
+
+	importTests := []struct {
+		msg         *server.Message
+		matchedCmds []filter.Commands
+	}{
+		{ // stop ends the evaluation
+			msg:         newMsg(20<<20, server.MessageHeaders{"list-id": "<list.example.com>", "subject": "your order"}),
+			matchedCmds: []filter.Commands{{Move: "Lists"}},
+		},
+		{ // no stop, so the following filters are evaluated
+			msg:         newMsg(20<<20, server.MessageHeaders{"from": "boss@example.com", "subject": "hi"}),
+			matchedCmds: []filter.Commands{{AddFlags: []string{`\Flagged`}}, {RemoveFlags: []string{"$Junk"}}, {Move: "Large"}},
+		},
+		{
+			msg:         newMsg(100, server.MessageHeaders{"from": "sales@vendor.example.com", "subject": "order 42 shipped"}),
+			matchedCmds: []filter.Commands{{Move: "Shops"}},
+		},
+		{ // elsif
+			msg:         newMsg(100, server.MessageHeaders{"from": "sales@vendor.example.com", "subject": "hi"}),
+			matchedCmds: []filter.Commands{{Move: "Vendor", ReplaceAllFlags: []string{`\Seen`, "$Vendor"}}},
+		},
+		{ // else
+			msg:         newMsg(100, server.MessageHeaders{"from": "sales@vendor.example.com", "subject": "invoice 42"}),
+			matchedCmds: []filter.Commands{{RemoveFlags: []string{"$Junk"}}},
+		},
+	}
+
+	for i, test := range importTests {
+		var matchedCmds []filter.Commands
+
+		for _, name := range filters.Names() {
+			matched, err := filters[name].Match(test.msg)
+			require.NoError(err)
+
+			if !matched {
+				continue
+			}
+
+			matchedCmds = append(matchedCmds, filters[name].Commands)
+			if !filters[name].Continue {
+				break
+			}
+		}
+
+		require.Equal(test.matchedCmds, matchedCmds, "Test #%v failed: headers=%v", i+1, test.msg.Headers)
+	}
+
+	// Unsupported constructs
+	unsupportedTests := []struct {
+		script   string
+		problems []sieve.Problem
+		filters  int
+	}{
+		{
+			script:   "if header :is \"subject\" \"a\" {\n  if exists \"x\" { stop; }\n}",
+			problems: []sieve.Problem{{Line: 2, Message: "nested if blocks are unsupported"}},
+		},
+		{
+			script:   "if true { stop; }\nelsif exists \"x\" { stop; }\nelse { keep; }\nif exists \"y\" { stop; }",
+			problems: []sieve.Problem{{Line: 1, Message: `test "true" is unsupported`}, {Line: 2, Message: "elsif depends on a block that can't be imported"}, {Line: 3, Message: "else depends on a block that can't be imported"}},
+			filters:  1,
+		},
+		{
+			script:   "if header :count \"ge\" \"received\" \"3\" { stop; }",
+			problems: []sieve.Problem{{Line: 1, Message: "header :count is unsupported"}},
+		},
+		{
+			script:   "if header :comparator \"i;octet\" :is \"subject\" \"A\" { stop; }",
+			problems: []sieve.Problem{{Line: 1, Message: "comparator \"i;octet\" is unsupported, matching is always case-insensitive"}},
+		},
+		{
+			script:   "if header :matches \"subject\" \"\\\\*\" { stop; }",
+			problems: []sieve.Problem{{Line: 1, Message: "escaped wildcards in :matches keys are unsupported"}},
+		},
+		{
+			script:   "if exists \"x\" { fileinto :copy \"A\"; }",
+			problems: []sieve.Problem{{Line: 1, Message: "fileinto :copy is unsupported"}},
+		},
+		{
+			script:   "if exists \"x\" { addflag \"flags\" \"\\\\Seen\"; }",
+			problems: []sieve.Problem{{Line: 1, Message: "addflag with a variable name is unsupported"}},
+		},
+		{
+			script:   "if exists \"x\" { fileinto \"A\"; fileinto \"B\"; }",
+			problems: []sieve.Problem{{Line: 1, Message: "filing a message into several mailboxes is unsupported"}},
+		},
+		{ // the test of the skipped block is still used for else
+			script:   "if exists \"x\" { discard; }\nelse { stop; }",
+			problems: []sieve.Problem{{Line: 1, Message: `action "discard" is unsupported`}},
+			filters:  1,
+		},
+		{
+			script:   "discard;\nif exists \"x\" { stop; }\nstop;\nif exists \"y\" { stop; }",
+			problems: []sieve.Problem{{Line: 1, Message: `command "discard" is only supported inside of if blocks`}},
+			filters:  1,
+		},
+	}
+
+	for i, test := range unsupportedTests {
+		result, err := sieve.Import(test.script)
+		require.NoError(err, "Test #%v", i+1)
+		require.Equal(test.problems, result.Problems, "Test #%v", i+1)
+		require.Len(result.Filters, test.filters, "Test #%v", i+1)
+	}
+
+	// Invalid scripts
+	invalidTests := []struct {
+		script string
+		err    string
+	}{
+		{script: `if exists "x" { fileinto; }`, err: "line 1: fileinto expects 1 argument(s), got 0"},
+		{script: `if size "x" { stop; }`, err: "line 1: size expects :over or :under and a number"},
+		{script: `if header "subject" { stop; }`, err: "line 1: header expects a list of header names and a list of keys"},
+		{script: `if exists "x";`, err: "line 1: if requires a block"},
+	}
+
+	for i, test := range invalidTests {
+		_, err := sieve.Import(test.script)
+		require.EqualError(err, test.err, "Test #%v", i+1)
+	}
+}
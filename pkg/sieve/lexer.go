@@ -0,0 +1,211 @@
+package sieve
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenSpecial // one of ; , ( ) { } [ ]
+)
+
+type token struct {
+	typ   tokenType
+	value string
+	line  int
+}
+
+// lexer splits a Sieve script into tokens (RFC 5228, section 8.1). Comments are kept by line so that rule names can be taken from them.
+type lexer struct {
+	input    []rune
+	pos      int
+	line     int
+	comments map[int]string
+}
+
+func newLexer(script string) *lexer {
+	return &lexer{input: []rune(strings.ReplaceAll(script, "\r\n", "\n")), line: 1, comments: map[int]string{}}
+}
+
+func (l *lexer) tokens() ([]token, error) {
+	var tokens []token
+
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, tok)
+		if tok.typ == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipWhitespaceAndComments(); err != nil {
+		return token{}, err
+	}
+
+	if l.pos >= len(l.input) {
+		return token{typ: tokenEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	r := l.input[l.pos]
+
+	switch {
+	case strings.ContainsRune(";,(){}[]", r):
+		l.pos++
+		return token{typ: tokenSpecial, value: string(r), line: line}, nil
+	case r == '"':
+		s, err := l.quotedString()
+		return token{typ: tokenString, value: s, line: line}, err
+	case r == ':':
+		l.pos++
+		name := l.identifier()
+		if name == "" {
+			return token{}, fmt.Errorf("line %v: tag without name", line)
+		}
+
+		return token{typ: tokenTag, value: ":" + strings.ToLower(name), line: line}, nil
+	case unicode.IsDigit(r):
+		start := l.pos
+		for l.pos < len(l.input) && unicode.IsDigit(l.input[l.pos]) {
+			l.pos++
+		}
+
+		// quantifiers K, M and G
+		if l.pos < len(l.input) && strings.ContainsRune("kKmMgG", l.input[l.pos]) {
+			l.pos++
+		}
+
+		return token{typ: tokenNumber, value: strings.ToUpper(string(l.input[start:l.pos])), line: line}, nil
+	case r == '_' || unicode.IsLetter(r):
+		name := strings.ToLower(l.identifier())
+
+		if name == "text" && l.pos < len(l.input) && l.input[l.pos] == ':' {
+			l.pos++
+			s, err := l.multiLineString()
+			return token{typ: tokenString, value: s, line: line}, err
+		}
+
+		return token{typ: tokenIdentifier, value: name, line: line}, nil
+	}
+
+	return token{}, fmt.Errorf("line %v: unexpected character %q", line, r)
+}
+
+func (l *lexer) skipWhitespaceAndComments() error {
+	for l.pos < len(l.input) {
+		switch r := l.input[l.pos]; {
+		case r == '\n':
+			l.line++
+			l.pos++
+		case unicode.IsSpace(r):
+			l.pos++
+		case r == '#':
+			start := l.pos + 1
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+			l.comments[l.line] = strings.TrimSpace(string(l.input[start:l.pos]))
+		case r == '/' && l.pos+1 < len(l.input) && l.input[l.pos+1] == '*':
+			line := l.line
+			end := strings.Index(string(l.input[l.pos+2:]), "*/")
+			if end < 0 {
+				return fmt.Errorf("line %v: unterminated comment", line)
+			}
+
+			comment := []rune(string(l.input[l.pos+2:])[:end])
+			l.line += strings.Count(string(comment), "\n")
+			l.pos += 2 + len(comment) + 2
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.input) {
+		r := l.input[l.pos]
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		l.pos++
+	}
+
+	return string(l.input[start:l.pos])
+}
+
+func (l *lexer) quotedString() (string, error) {
+	line := l.line
+	var s strings.Builder
+
+	// skip opening quote
+	l.pos++
+	for l.pos < len(l.input) {
+		r := l.input[l.pos]
+		l.pos++
+
+		switch r {
+		case '"':
+			return s.String(), nil
+		case '\\':
+			// only \" and \\ are defined, other escaped characters stand for themselves
+			if l.pos < len(l.input) {
+				r = l.input[l.pos]
+				l.pos++
+			}
+		case '\n':
+			l.line++
+		}
+
+		s.WriteRune(r)
+	}
+
+	return "", fmt.Errorf("line %v: unterminated string", line)
+}
+
+// multiLineString reads the lines after text: up to a line containing a single dot. Lines starting with two dots lose one of them.
+func (l *lexer) multiLineString() (string, error) {
+	line := l.line
+
+	// rest of the text: line may only contain whitespace and a comment
+	for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+		l.pos++
+	}
+
+	var lines []string
+	for l.pos < len(l.input) {
+		// skip newline
+		l.pos++
+		l.line++
+
+		start := l.pos
+		for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+			l.pos++
+		}
+		textLine := string(l.input[start:l.pos])
+
+		if textLine == "." {
+			return strings.Join(lines, "\n") + "\n", nil
+		}
+
+		lines = append(lines, strings.TrimPrefix(textLine, "."))
+	}
+
+	return "", fmt.Errorf("line %v: unterminated multi-line string", line)
+}
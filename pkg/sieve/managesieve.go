@@ -0,0 +1,471 @@
+package sieve
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection is the config of a ManageSieve server (RFC 5804).
+type Connection struct {
+	Server        string `yaml:"server"`
+	Port          int    `yaml:"port"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	Starttls      *bool  `yaml:"starttls"`
+	TLSVerify     *bool  `yaml:"tlsverify"`
+	TLSCACertFile string `yaml:"cacertfile"`
+	ScriptName    string `yaml:"script"`
+}
+
+// DefaultPort is the port registered for ManageSieve.
+const DefaultPort = 4190
+
+// DefaultScriptName is the name scripts are uploaded as unless the connection config sets another one.
+const DefaultScriptName = "postisto"
+
+// Client is a session with a ManageSieve server.
+type Client struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	capabilities map[string]string
+}
+
+// Response is the final response of a ManageSieve command. Code is the optional response code like TRYLATER.
+type Response struct {
+	Status string
+	Code   string
+	Text   string
+}
+
+// Error is returned when the server answers a command with NO or BYE.
+type Error struct {
+	Command  string
+	Response Response
+}
+
+func (err *Error) Error() string {
+	msg := fmt.Sprintf("%v failed: %v", err.Command, err.Response.Status)
+	if err.Response.Code != "" {
+		msg += fmt.Sprintf(" (%v)", err.Response.Code)
+	}
+
+	if err.Response.Text != "" {
+		msg += ": " + err.Response.Text
+	}
+
+	return msg
+}
+
+// Upload connects to the server, uploads the script and makes it the active one.
+func (conn *Connection) Upload(script string) error {
+	if err := conn.validate(); err != nil {
+		return err
+	}
+
+	log.Debugw("Connecting to ManageSieve server now", "username", conn.Username, "server", conn.Server)
+
+	var tlsConfig *tls.Config
+	if *conn.Starttls {
+		certPool := x509.NewCertPool()
+		if conn.TLSCACertFile != "" {
+			pemBytes, err := ioutil.ReadFile(conn.TLSCACertFile)
+			if err != nil {
+				log.Errorw("Failed to load CA cert file", err, "TLSCACertFile", conn.TLSCACertFile)
+				return err
+			}
+
+			certPool.AppendCertsFromPEM(pemBytes)
+		} else {
+			certPool = nil
+		}
+
+		tlsConfig = &tls.Config{
+			ServerName:         conn.Server,
+			InsecureSkipVerify: !*conn.TLSVerify,
+			MinVersion:         tls.VersionTLS12,
+			RootCAs:            certPool,
+		}
+	}
+
+	client, err := Dial(fmt.Sprintf("%v:%v", conn.Server, conn.Port), tlsConfig)
+	if err != nil {
+		log.Errorw("Failed to connect to ManageSieve server", err, "server", conn.Server)
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Authenticate(conn.Username, conn.Password); err != nil {
+		log.Errorw("Failed to login to ManageSieve server", err, "server", conn.Server, "username", conn.Username)
+		return err
+	}
+
+	if err := client.PutScript(conn.ScriptName, script); err != nil {
+		return err
+	}
+
+	if err := client.SetActive(conn.ScriptName); err != nil {
+		return err
+	}
+
+	log.Infow("Uploaded and activated Sieve script", "server", conn.Server, "script", conn.ScriptName)
+
+	return client.Logout()
+}
+
+func (conn *Connection) validate() error {
+	if conn.Server == "" {
+		return fmt.Errorf("server not set in managesieve config")
+	}
+
+	if conn.Username == "" {
+		return fmt.Errorf("username not set in managesieve config")
+	}
+
+	if conn.Port == 0 {
+		conn.Port = DefaultPort
+	}
+
+	if conn.ScriptName == "" {
+		conn.ScriptName = DefaultScriptName
+	}
+
+	// The password is sent as plain text so only skip TLS if this is configured explicitly
+	if conn.Starttls == nil {
+		b := true
+		conn.Starttls = &b
+	}
+
+	if conn.TLSVerify == nil {
+		b := true
+		conn.TLSVerify = &b
+	}
+
+	return nil
+}
+
+// Dial connects to a ManageSieve server and reads its capabilities. If tlsConfig is set, the session is secured with STARTTLS.
+func Dial(addr string, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{conn: conn, reader: bufio.NewReader(conn)}
+
+	if err := client.readCapabilities("greeting"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// Capability returns the value of a capability like SIEVE or SASL and whether the server announced it.
+func (client *Client) Capability(name string) (string, bool) {
+	value, ok := client.capabilities[strings.ToUpper(name)]
+	return value, ok
+}
+
+// StartTLS secures the session. The server announces its capabilities again afterwards.
+func (client *Client) StartTLS(tlsConfig *tls.Config) error {
+	if _, ok := client.Capability("STARTTLS"); !ok {
+		return fmt.Errorf("server doesn't support STARTTLS")
+	}
+
+	if _, err := client.command("STARTTLS"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(client.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	client.conn = tlsConn
+	client.reader = bufio.NewReader(tlsConn)
+
+	return client.readCapabilities("STARTTLS")
+}
+
+// Authenticate logs in with SASL PLAIN.
+func (client *Client) Authenticate(username, password string) error {
+	mechanisms, _ := client.Capability("SASL")
+	if !containsFold(strings.Fields(mechanisms), "PLAIN") {
+		return fmt.Errorf("server doesn't support SASL PLAIN authentication, only %q", mechanisms)
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+	_, err := client.command("AUTHENTICATE", quote("PLAIN"), quote(credentials))
+
+	return err
+}
+
+// CheckScript lets the server verify the script without storing it.
+func (client *Client) CheckScript(script string) error {
+	_, err := client.command("CHECKSCRIPT", literal(script))
+	return err
+}
+
+// PutScript uploads the script. The server verifies the script and rejects it with an error that usually contains the line number.
+func (client *Client) PutScript(name, script string) error {
+	_, err := client.command("PUTSCRIPT", quote(name), literal(script))
+	return err
+}
+
+// SetActive makes the script the active one. The previously active script is deactivated.
+func (client *Client) SetActive(name string) error {
+	_, err := client.command("SETACTIVE", quote(name))
+	return err
+}
+
+// ListScripts returns the names of the scripts on the server and the name of the active one.
+func (client *Client) ListScripts() ([]string, string, error) {
+	var names []string
+	var active string
+
+	if err := client.write("LISTSCRIPTS"); err != nil {
+		return nil, "", err
+	}
+
+	for {
+		words, err := client.readLine()
+		if err != nil {
+			return nil, "", err
+		}
+
+		if resp, ok := parseResponse(words); ok {
+			if resp.Status != "OK" {
+				return nil, "", &Error{Command: "LISTSCRIPTS", Response: resp}
+			}
+
+			return names, active, nil
+		}
+
+		if len(words) == 0 {
+			continue
+		}
+
+		names = append(names, words[0].value)
+		if len(words) > 1 && strings.EqualFold(words[1].value, "ACTIVE") {
+			active = words[0].value
+		}
+	}
+}
+
+// Logout ends the session and closes the connection.
+func (client *Client) Logout() error {
+	_, err := client.command("LOGOUT")
+	client.conn.Close()
+
+	return err
+}
+
+// Close closes the connection without logging out.
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+// command sends a command and waits for its final response. Lines before that are ignored.
+func (client *Client) command(name string, args ...string) (Response, error) {
+	if err := client.write(name, args...); err != nil {
+		return Response{}, err
+	}
+
+	for {
+		words, err := client.readLine()
+		if err != nil {
+			return Response{}, err
+		}
+
+		if resp, ok := parseResponse(words); ok {
+			if resp.Status != "OK" {
+				return resp, &Error{Command: name, Response: resp}
+			}
+
+			return resp, nil
+		}
+	}
+}
+
+func (client *Client) write(name string, args ...string) error {
+	line := strings.Join(append([]string{name}, args...), " ") + "\r\n"
+
+	// arguments aren't logged since they contain the credentials
+	log.Debugw("Sending ManageSieve command", "command", name)
+
+	_, err := io.WriteString(client.conn, line)
+	return err
+}
+
+// readCapabilities reads the capability lines that the server sends after connecting and after STARTTLS.
+func (client *Client) readCapabilities(after string) error {
+	client.capabilities = map[string]string{}
+
+	for {
+		words, err := client.readLine()
+		if err != nil {
+			return err
+		}
+
+		if resp, ok := parseResponse(words); ok {
+			if resp.Status != "OK" {
+				return &Error{Command: after, Response: resp}
+			}
+
+			return nil
+		}
+
+		if len(words) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(words) > 1 {
+			value = words[1].value
+		}
+		client.capabilities[strings.ToUpper(words[0].value)] = value
+	}
+}
+
+type word struct {
+	value string
+	atom  bool // unquoted like OK or a response code in parentheses
+}
+
+// readLine reads a response line and splits it into atoms, quoted strings and literals. Literals may span several lines.
+func (client *Client) readLine() ([]word, error) {
+	var words []word
+
+	line, err := client.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return words, nil
+		}
+
+		switch line[0] {
+		case '"':
+			var value strings.Builder
+			i := 1
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				value.WriteByte(line[i])
+			}
+
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated string in response %q", line)
+			}
+
+			words = append(words, word{value: value.String()})
+			line = line[i+1:]
+		case '{':
+			end := strings.IndexByte(line, '}')
+			if end < 0 || end != len(line)-1 {
+				return nil, fmt.Errorf("malformed literal in response %q", line)
+			}
+
+			size, err := strconv.Atoi(strings.TrimSuffix(line[1:end], "+"))
+			if err != nil {
+				return nil, fmt.Errorf("malformed literal in response %q", line)
+			}
+
+			value := make([]byte, size)
+			if _, err := io.ReadFull(client.reader, value); err != nil {
+				return nil, err
+			}
+			words = append(words, word{value: string(value)})
+
+			// the line continues after the literal
+			if line, err = client.readRawLine(); err != nil {
+				return nil, err
+			}
+		case '(':
+			end := strings.IndexByte(line, ')')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated response code in response %q", line)
+			}
+
+			words = append(words, word{value: line[1:end], atom: true})
+			line = line[end+1:]
+		default:
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+
+			words = append(words, word{value: line[:end], atom: true})
+			line = line[end:]
+		}
+	}
+}
+
+func (client *Client) readRawLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// parseResponse returns the final response if the line is one
+func parseResponse(words []word) (Response, bool) {
+	if len(words) == 0 || !words[0].atom {
+		return Response{}, false
+	}
+
+	resp := Response{Status: strings.ToUpper(words[0].value)}
+	switch resp.Status {
+	case "OK", "NO", "BYE":
+	default:
+		return Response{}, false
+	}
+
+	for _, w := range words[1:] {
+		if w.atom && resp.Code == "" && resp.Text == "" {
+			resp.Code = w.value
+		} else if !w.atom {
+			resp.Text = w.value
+		}
+	}
+
+	return resp, true
+}
+
+// literal encodes a string as non-synchronizing literal which every ManageSieve server supports
+func literal(s string) string {
+	return fmt.Sprintf("{%v+}\r\n%v", len(s), s)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(entry, s) {
+			return true
+		}
+	}
+
+	return false
+}
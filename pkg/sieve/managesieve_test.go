@@ -0,0 +1,204 @@
+package sieve_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/arnisoph/postisto/pkg/sieve"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeManageSieveServer implements the parts of RFC 5804 that the client uses. Scripts containing "invalid" are rejected.
+type fakeManageSieveServer struct {
+	listener net.Listener
+	username string
+	password string
+
+	mu       sync.Mutex
+	scripts  map[string]string
+	active   string
+	commands []string
+}
+
+func newFakeManageSieveServer(t *testing.T, username, password string) *fakeManageSieveServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &fakeManageSieveServer{listener: listener, username: username, password: password, scripts: map[string]string{}}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *fakeManageSieveServer) port() int {
+	return srv.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (srv *fakeManageSieveServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := false
+
+	fmt.Fprint(conn, "\"IMPLEMENTATION\" \"fake\"\r\n\"SASL\" \"PLAIN LOGIN\"\r\n\"SIEVE\" \"fileinto imap4flags\"\r\nOK \"fake ManageSieve ready\"\r\n")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		args := strings.Fields(strings.TrimSpace(line))
+		if len(args) == 0 {
+			continue
+		}
+
+		srv.mu.Lock()
+		srv.commands = append(srv.commands, args[0])
+		srv.mu.Unlock()
+
+		// the literal of PUTSCRIPT needs to be read first
+		if args[0] != "AUTHENTICATE" && args[0] != "LOGOUT" && args[0] != "PUTSCRIPT" && !authenticated {
+			fmt.Fprint(conn, "NO \"not authenticated\"\r\n")
+			continue
+		}
+
+		switch args[0] {
+		case "AUTHENTICATE":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.Trim(args[2], `"`))
+			if string(credentials) != "\x00"+srv.username+"\x00"+srv.password {
+				fmt.Fprint(conn, "NO \"Authentication failed\"\r\n")
+				continue
+			}
+
+			authenticated = true
+			fmt.Fprint(conn, "OK \"Logged in\"\r\n")
+		case "PUTSCRIPT":
+			size, _ := strconv.Atoi(strings.Trim(args[2], "{+}"))
+			script := make([]byte, size)
+			if _, err := io.ReadFull(reader, script); err != nil {
+				return
+			}
+			reader.ReadString('\n')
+
+			if !authenticated {
+				fmt.Fprint(conn, "NO \"not authenticated\"\r\n")
+				continue
+			}
+
+			if strings.Contains(string(script), "invalid") {
+				msg := "line 2: unknown command 'invalid'"
+				fmt.Fprintf(conn, "NO {%v}\r\n%v\r\n", len(msg), msg)
+				continue
+			}
+
+			srv.mu.Lock()
+			srv.scripts[strings.Trim(args[1], `"`)] = string(script)
+			srv.mu.Unlock()
+			fmt.Fprint(conn, "OK \"Stored\"\r\n")
+		case "SETACTIVE":
+			name := strings.Trim(args[1], `"`)
+
+			srv.mu.Lock()
+			_, ok := srv.scripts[name]
+			if ok {
+				srv.active = name
+			}
+			srv.mu.Unlock()
+
+			if !ok {
+				fmt.Fprint(conn, "NO (NONEXISTENT) \"There is no script by that name\"\r\n")
+				continue
+			}
+
+			fmt.Fprint(conn, "OK \"Activated\"\r\n")
+		case "LISTSCRIPTS":
+			srv.mu.Lock()
+			for name := range srv.scripts {
+				if name == srv.active {
+					fmt.Fprintf(conn, "%q ACTIVE\r\n", name)
+				} else {
+					fmt.Fprintf(conn, "%q\r\n", name)
+				}
+			}
+			srv.mu.Unlock()
+			fmt.Fprint(conn, "OK \"Listed\"\r\n")
+		case "LOGOUT":
+			fmt.Fprint(conn, "OK \"Bye\"\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "NO \"unknown command\"\r\n")
+		}
+	}
+}
+
+func TestManageSieve(t *testing.T) {
+	require := require.New(t)
+	noTLS := false
+
+	// ACTUAL TESTS BELOW
+
+	srv := newFakeManageSieveServer(t, "test@example.com", "secret")
+	script := "require \"fileinto\";\nif exists \"list-id\" { fileinto \"Lists\"; stop; }\n"
+
+	// Upload and activate
+	conn := sieve.Connection{Server: "127.0.0.1", Port: srv.port(), Username: "test@example.com", Password: "secret", Starttls: &noTLS}
+	require.NoError(conn.Upload(script))
+	require.Equal(map[string]string{sieve.DefaultScriptName: script}, srv.scripts)
+	require.Equal(sieve.DefaultScriptName, srv.active)
+	require.Equal([]string{"AUTHENTICATE", "PUTSCRIPT", "SETACTIVE", "LOGOUT"}, srv.commands)
+
+	// Lower level client
+	client, err := sieve.Dial(fmt.Sprintf("127.0.0.1:%v", srv.port()), nil)
+	require.NoError(err)
+
+	sasl, ok := client.Capability("sasl")
+	require.True(ok)
+	require.Equal("PLAIN LOGIN", sasl)
+
+	err = client.PutScript("other", script)
+	require.EqualError(err, `PUTSCRIPT failed: NO: not authenticated`)
+
+	require.NoError(client.Authenticate("test@example.com", "secret"))
+	require.NoError(client.PutScript("other", script))
+
+	err = client.PutScript("broken", "require \"fileinto\";\ninvalid;\n")
+	require.EqualError(err, `PUTSCRIPT failed: NO: line 2: unknown command 'invalid'`)
+
+	err = client.SetActive("broken")
+	require.EqualError(err, `SETACTIVE failed: NO (NONEXISTENT): There is no script by that name`)
+	require.Equal("NONEXISTENT", err.(*sieve.Error).Response.Code)
+
+	names, active, err := client.ListScripts()
+	require.NoError(err)
+	require.ElementsMatch([]string{sieve.DefaultScriptName, "other"}, names)
+	require.Equal(sieve.DefaultScriptName, active)
+
+	require.NoError(client.Logout())
+
+	// Failures
+	conn = sieve.Connection{Server: "127.0.0.1", Port: srv.port(), Username: "test@example.com", Password: "wrong", Starttls: &noTLS}
+	require.EqualError(conn.Upload(script), `AUTHENTICATE failed: NO: Authentication failed`)
+
+	conn = sieve.Connection{Server: "127.0.0.1", Port: srv.port(), Username: "test@example.com", Password: "secret"}
+	require.EqualError(conn.Upload(script), "server doesn't support STARTTLS")
+
+	conn = sieve.Connection{Port: srv.port(), Username: "test@example.com"}
+	require.EqualError(conn.Upload(script), "server not set in managesieve config")
+}
@@ -0,0 +1,248 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+// Command is a Sieve command like require, if, fileinto or stop. Control commands have tests and a block.
+type Command struct {
+	Name      string
+	Line      int
+	Arguments []Argument
+	Tests     []*Test
+	Block     []*Command // nil for commands without a block
+}
+
+// Test is a Sieve test like header, address or allof.
+type Test struct {
+	Name      string
+	Line      int
+	Arguments []Argument
+	Tests     []*Test
+}
+
+// Argument is either a tag like :contains, a number like 100K or a string list. Single strings are string lists with one entry.
+type Argument struct {
+	Tag     string
+	Number  string
+	Strings []string
+	Line    int
+}
+
+// Script is a parsed Sieve script.
+type Script struct {
+	Commands []*Command
+	Comments map[int]string // comments by line, without the leading #
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a Sieve script according to the grammar of RFC 5228. It doesn't check whether commands and tests are known.
+func Parse(script string) (*Script, error) {
+	l := newLexer(script)
+
+	tokens, err := l.tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.typ != tokenEOF {
+		return nil, fmt.Errorf("line %v: unexpected %q", tok.line, tok.value)
+	}
+
+	return &Script{Commands: commands, Comments: l.comments}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokenEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+func (p *parser) isSpecial(value string) bool {
+	tok := p.peek()
+	return tok.typ == tokenSpecial && tok.value == value
+}
+
+func (p *parser) expectSpecial(value string) error {
+	tok := p.advance()
+	if tok.typ != tokenSpecial || tok.value != value {
+		return unexpected(tok, value)
+	}
+
+	return nil
+}
+
+func unexpected(tok token, expected string) error {
+	if tok.typ == tokenEOF {
+		return fmt.Errorf("line %v: unexpected end of script, expected %q", tok.line, expected)
+	}
+
+	return fmt.Errorf("line %v: unexpected %q, expected %q", tok.line, tok.value, expected)
+}
+
+func (p *parser) commands() ([]*Command, error) {
+	var commands []*Command
+
+	for p.peek().typ == tokenIdentifier {
+		command, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, command)
+	}
+
+	return commands, nil
+}
+
+func (p *parser) command() (*Command, error) {
+	tok := p.advance()
+	command := &Command{Name: tok.value, Line: tok.line}
+
+	var err error
+	if command.Arguments, command.Tests, err = p.arguments(); err != nil {
+		return nil, err
+	}
+
+	if p.isSpecial(";") {
+		p.advance()
+		return command, nil
+	}
+
+	if !p.isSpecial("{") {
+		return nil, unexpected(p.peek(), ";")
+	}
+	p.advance()
+
+	if command.Block, err = p.commands(); err != nil {
+		return nil, err
+	}
+
+	if command.Block == nil {
+		command.Block = []*Command{}
+	}
+
+	return command, p.expectSpecial("}")
+}
+
+// arguments parses the arguments of a command or test including its test or test list.
+func (p *parser) arguments() ([]Argument, []*Test, error) {
+	var args []Argument
+
+	for {
+		tok := p.peek()
+
+		switch {
+		case tok.typ == tokenTag:
+			p.advance()
+			args = append(args, Argument{Tag: tok.value, Line: tok.line})
+		case tok.typ == tokenNumber:
+			p.advance()
+			args = append(args, Argument{Number: tok.value, Line: tok.line})
+		case tok.typ == tokenString:
+			p.advance()
+			args = append(args, Argument{Strings: []string{tok.value}, Line: tok.line})
+		case p.isSpecial("["):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			args = append(args, Argument{Strings: list, Line: tok.line})
+		case tok.typ == tokenIdentifier:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return args, []*Test{test}, nil
+		case p.isSpecial("("):
+			tests, err := p.testList()
+			return args, tests, err
+		default:
+			return args, nil, nil
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	var list []string
+
+	if err := p.expectSpecial("["); err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.advance()
+		if tok.typ != tokenString {
+			return nil, unexpected(tok, "string")
+		}
+		list = append(list, tok.value)
+
+		if p.isSpecial("]") {
+			p.advance()
+			return list, nil
+		}
+
+		if err := p.expectSpecial(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) test() (*Test, error) {
+	tok := p.advance()
+	if tok.typ != tokenIdentifier {
+		return nil, unexpected(tok, "test")
+	}
+
+	test := &Test{Name: tok.value, Line: tok.line}
+
+	var err error
+	test.Arguments, test.Tests, err = p.arguments()
+
+	return test, err
+}
+
+func (p *parser) testList() ([]*Test, error) {
+	var tests []*Test
+
+	if err := p.expectSpecial("("); err != nil {
+		return nil, err
+	}
+
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+
+		if p.isSpecial(")") {
+			p.advance()
+			return tests, nil
+		}
+
+		if err := p.expectSpecial(","); err != nil {
+			return nil, err
+		}
+	}
+}
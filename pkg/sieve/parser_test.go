@@ -0,0 +1,71 @@
+package sieve_test
+
+import (
+	"github.com/arnisoph/postisto/pkg/sieve"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	require := require.New(t)
+
+	// ACTUAL TESTS BELOW
+
+	script, err := sieve.Parse(`require ["fileinto", "imap4flags"];
+# rule:[Lists]
+if anyof (exists "List-Id", header :Contains "Subject" text:
+[list]
+..dot-stuffed
+.
+) {
+    fileinto "Lists"; /* multi-line
+    comment */ stop;
+}
+if size :over 10K { addflag "\\Flagged"; }
+`)
+	require.NoError(err)
+	require.Len(script.Commands, 3)
+	require.Equal("Lists", script.Comments[2][len("rule:["):len(script.Comments[2])-1])
+
+	require.Equal("require", script.Commands[0].Name)
+	require.Nil(script.Commands[0].Block)
+	require.Equal([]string{"fileinto", "imap4flags"}, script.Commands[0].Arguments[0].Strings)
+
+	ifCmd := script.Commands[1]
+	require.Equal("if", ifCmd.Name)
+	require.Equal(3, ifCmd.Line)
+	require.Len(ifCmd.Tests, 1)
+	require.Equal("anyof", ifCmd.Tests[0].Name)
+	require.Len(ifCmd.Tests[0].Tests, 2)
+	require.Equal([]string{"List-Id"}, ifCmd.Tests[0].Tests[0].Arguments[0].Strings)
+
+	headerTest := ifCmd.Tests[0].Tests[1]
+	require.Equal(":contains", headerTest.Arguments[0].Tag)
+	require.Equal([]string{"[list]\n.dot-stuffed\n"}, headerTest.Arguments[2].Strings)
+
+	require.Len(ifCmd.Block, 2)
+	require.Equal("fileinto", ifCmd.Block[0].Name)
+	require.Equal("stop", ifCmd.Block[1].Name)
+	require.Equal(9, ifCmd.Block[1].Line)
+
+	sizeTest := script.Commands[2].Tests[0]
+	require.Equal(":over", sizeTest.Arguments[0].Tag)
+	require.Equal("10K", sizeTest.Arguments[1].Number)
+	require.Equal([]string{`\Flagged`}, script.Commands[2].Block[0].Arguments[0].Strings)
+
+	// Syntax errors
+	invalidScripts := []struct {
+		script string
+		err    string
+	}{
+		{script: `fileinto "Lists"`, err: "line 1: unexpected end of script, expected \";\""},
+		{script: "if exists \"list-id\" {\n  stop;\n", err: "line 3: unexpected end of script, expected \"}\""},
+		{script: `if header :is "subject" "unterminated;`, err: "line 1: unterminated string"},
+		{script: "/* unterminated", err: "line 1: unterminated comment"},
+	}
+
+	for i, test := range invalidScripts {
+		_, err := sieve.Parse(test.script)
+		require.EqualError(err, test.err, "Test #%v", i+1)
+	}
+}